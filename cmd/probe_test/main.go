@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -12,7 +13,7 @@ import (
 )
 
 func main() {
-	mode := flag.String("mode", "ping", "Mode: ping, trace, speed")
+	mode := flag.String("mode", "ping", "Mode: ping, trace, speed, db-test")
 	target := flag.String("target", "", "Target IP or Hostname")
 
 	// SSH Flags
@@ -21,6 +22,10 @@ func main() {
 	sshPass := flag.String("pass", "", "SSH Password")
 	sshKey := flag.String("key", "", "SSH Key Path")
 
+	// Trace Flags
+	traceMethod := flag.String("method", "icmp", "Trace method: icmp, udp, tcp")
+	tracePort := flag.Int("trace-port", 0, "Trace destination port for udp/tcp (0 = default)")
+
 	// Database Test Flag
 	dbPath := flag.String("db", "test.db", "Database path for db-test mode")
 
@@ -40,7 +45,7 @@ func main() {
 	case "ping":
 		runPing(*target)
 	case "trace":
-		runTrace(*target)
+		runTrace(*target, prober.TraceMethod(*traceMethod), *tracePort)
 	case "speed":
 		runSpeed(*target, *sshPort, *sshUser, *sshPass, *sshKey)
 	default:
@@ -56,20 +61,24 @@ func runDBTest(path string) {
 	}
 
 	fmt.Println("Querying history...")
-	recs, err := db.GetHistory("8.8.8.8", time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+	target, err := db.GetTargetByAddress("8.8.8.8")
+	if err != nil {
+		log.Fatalf("Target lookup failed: %v", err)
+	}
+	recs, err := db.GetLatencyHistory(target.ID, time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
 	if err != nil {
 		log.Fatalf("Query failed: %v", err)
 	}
 
 	fmt.Printf("Found %d records.\n", len(recs))
 	for _, r := range recs {
-		fmt.Printf("- ID: %d, Time: %s, Latency: %.2fms, TraceJson: %v (Should be nil)\n",
-			r.ID, r.CreatedAt.Format(time.RFC3339), r.LatencyMs, r.TraceJson)
+		fmt.Printf("- ID: %d, Time: %s, Latency: %.2fms\n",
+			r.ID, r.CreatedAt.Format(time.RFC3339), r.LatencyMs)
 	}
 
-	if len(recs) > 0 {
-		fmt.Println("Fetching detail for first record...")
-		full, err := db.GetRecordDetail(recs[0].ID)
+	fmt.Println("Fetching latest trace...")
+	if trace, err := db.GetLatestTrace(target.ID); err == nil {
+		full, err := db.GetTraceDetail(trace.ID)
 		if err != nil {
 			log.Fatalf("Detail fetch failed: %v", err)
 		}
@@ -87,7 +96,7 @@ func runDBTest(path string) {
 func runPing(target string) {
 	fmt.Printf("Pinging %s...\n", target)
 	pinger := prober.NewICMPPinger(target, 4)
-	res, err := pinger.Run()
+	res, err := pinger.Run(context.Background())
 	if err != nil {
 		log.Fatalf("Ping failed: %v", err)
 	}
@@ -99,11 +108,13 @@ func runPing(target string) {
 		res.MinRtt, res.AvgRtt, res.MaxRtt)
 }
 
-func runTrace(target string) {
-	fmt.Printf("Tracing route to %s over a maximum of 30 hops...\n", target)
+func runTrace(target string, method prober.TraceMethod, port int) {
+	fmt.Printf("Tracing route to %s over a maximum of 30 hops (%s)...\n", target, method)
 
 	runner := prober.NewTracerouteRunner(target)
-	res, err := runner.Run()
+	runner.Method = method
+	runner.Port = port
+	res, err := runner.Run(context.Background())
 	if err != nil {
 		log.Fatalf("Trace failed: %v", err)
 	}
@@ -130,7 +141,7 @@ func runSpeed(host string, port int, user, pass, key string) {
 	}
 
 	tester := prober.NewSSHSpeedTester(cfg)
-	res, err := tester.Run()
+	res, err := tester.Run(context.Background())
 	if err != nil {
 		log.Fatalf("Speed test failed: %v", err)
 	}
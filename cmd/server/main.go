@@ -4,11 +4,17 @@ import (
 	_ "embed"
 	"encoding/json"
 	"log"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/yuanweize/RouteLens/internal/api"
 	"github.com/yuanweize/RouteLens/internal/cli"
 	"github.com/yuanweize/RouteLens/internal/monitor"
+	"github.com/yuanweize/RouteLens/pkg/prober"
+	"github.com/yuanweize/RouteLens/pkg/push"
+	"github.com/yuanweize/RouteLens/pkg/secrets"
 	"github.com/yuanweize/RouteLens/pkg/storage"
 	"github.com/yuanweize/RouteLens/web"
 )
@@ -63,22 +69,56 @@ func runServer(port, dbPath string) {
 	}
 
 	// 2. Storage
-	log.Printf("Connecting to DB at %s...", dbPath)
+	log.Printf("Connecting to DB at %s...", storage.RedactDSN(dbPath))
 	db, err := storage.NewDB(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to init DB: %v", err)
 	}
+	box, err := secrets.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid master key: %v", err)
+	}
+	db.SetSecretBox(box)
+	db.SetSecretKeys(prober.SecretKeys)
+	sealSecrets(db, box)
 
 	// Seed default targets if none exist
 	seedTargets(db)
 
 	// 3. Monitor Service
 	mon := monitor.NewService(db)
+	if pusher := newPusher(db); pusher != nil {
+		mon.SetPusher(pusher)
+		pusher.Start()
+		defer pusher.Stop() // After mon.Stop, so records of the last probes still go out
+	}
+	settings := loadSettings(db, mon.DefaultSettings())
+	mon.ApplySettings(settings)
+	db.OnSettingsChange(mon.ApplySettings)
 	mon.Start()
 	defer mon.Stop()
 
+	cleaner := storage.NewRetentionCleaner(db, settings.RetentionDays)
+	if strings.EqualFold(os.Getenv("RS_DB_AUTO_VACUUM"), "incremental") {
+		if db.Backend() != storage.BackendSQLite {
+			log.Printf("RS_DB_AUTO_VACUUM applies to SQLite only, ignoring")
+		} else if err := db.EnableIncrementalVacuum(); err != nil {
+			log.Printf("Failed to enable incremental auto_vacuum: %v", err)
+		} else {
+			cleaner.Vacuum = true
+		}
+	}
+	db.OnSettingsChange(func(st storage.SystemSettings) { cleaner.SetRetention(st.RetentionDays) })
+	cleaner.Start()
+	defer cleaner.Stop()
+
+	if backups := newBackupScheduler(db); backups != nil {
+		backups.Start()
+		defer backups.Stop()
+	}
+
 	// 4. API Server
-	server := api.NewServer(db, mon, web.DistFS, dbPath)
+	server := api.NewServer(db, mon, web.DistFS)
 
 	log.Printf("Starting API Server on %s...", port)
 	if err := server.Run(port); err != nil {
@@ -86,6 +126,121 @@ func runServer(port, dbPath string) {
 	}
 }
 
+// loadSettings reads the persisted system settings, storing defaults for any
+// that were never saved
+func loadSettings(db *storage.DB, defaults storage.SystemSettings) storage.SystemSettings {
+	if err := db.EnsureSettings(defaults); err != nil {
+		log.Printf("Failed to store default settings: %v", err)
+		return defaults
+	}
+	settings, err := db.GetSettings()
+	if err != nil {
+		log.Printf("Failed to load settings, using defaults: %v", err)
+		return defaults
+	}
+	return settings
+}
+
+// sealSecrets encrypts probe secrets saved before a master key was set, or
+// warns that they are stored in plain text
+func sealSecrets(db *storage.DB, box *secrets.Box) {
+	if box == nil {
+		if n, err := db.CountPlainSecrets(); err == nil && n > 0 {
+			log.Printf("Warning: secrets of %d target(s) or secrets store entries are stored unencrypted; set RS_MASTER_KEY to encrypt them", n)
+		}
+		return
+	}
+	n, err := db.ResealSecrets(nil, box)
+	if err != nil {
+		log.Printf("Failed to encrypt probe secrets (use 'routelens secrets rotate' after changing RS_MASTER_KEY): %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Encrypted secrets of %d target(s) and secrets store entries", n)
+	}
+}
+
+// newBackupScheduler configures scheduled backups from the environment:
+// RS_BACKUP_DIR enables them, RS_BACKUP_INTERVAL (default 24h),
+// RS_BACKUP_KEEP (default 7) and RS_BACKUP_GZIP (default true) tune them
+func newBackupScheduler(db *storage.DB) *storage.BackupScheduler {
+	dir := os.Getenv("RS_BACKUP_DIR")
+	if dir == "" {
+		return nil
+	}
+	if db.Backend() != storage.BackendSQLite {
+		log.Printf("RS_BACKUP_DIR applies to SQLite only, ignoring")
+		return nil
+	}
+	interval := 24 * time.Hour
+	if v := os.Getenv("RS_BACKUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			log.Printf("Invalid RS_BACKUP_INTERVAL=%q, using %s", v, interval)
+		} else {
+			interval = d
+		}
+	}
+	b := storage.NewBackupScheduler(db, dir, interval)
+	if v := os.Getenv("RS_BACKUP_KEEP"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			log.Printf("Invalid RS_BACKUP_KEEP=%q, keeping %d", v, b.Keep)
+		} else {
+			b.Keep = n
+		}
+	}
+	b.Compress = !strings.EqualFold(os.Getenv("RS_BACKUP_GZIP"), "false")
+	log.Printf("Backing up database to %s every %s, keeping %d", dir, interval, b.Keep)
+	return b
+}
+
+// newPusher configures the push sinks from the environment: RS_PUSH_INFLUX_URL
+// (with RS_PUSH_INFLUX_ORG, RS_PUSH_INFLUX_BUCKET and RS_PUSH_INFLUX_TOKEN),
+// RS_PUSH_REMOTE_WRITE_URL (with RS_PUSH_REMOTE_WRITE_TOKEN) and
+// RS_PUSH_HTTP_URL (with RS_PUSH_HTTP_TOKEN). Tokens may be secret
+// references. RS_PUSH_BUFFER sizes the buffer of each sink.
+func newPusher(db *storage.DB) *push.Pusher {
+	token := func(name string) string {
+		v, err := secrets.Resolve(os.Getenv(name), db)
+		if err != nil {
+			log.Printf("Invalid %s: %v", name, err)
+		}
+		return v
+	}
+	var sinks []push.Sink
+	if u := os.Getenv("RS_PUSH_INFLUX_URL"); u != "" {
+		org, bucket := os.Getenv("RS_PUSH_INFLUX_ORG"), os.Getenv("RS_PUSH_INFLUX_BUCKET")
+		if org == "" || bucket == "" {
+			log.Printf("RS_PUSH_INFLUX_URL needs RS_PUSH_INFLUX_ORG and RS_PUSH_INFLUX_BUCKET, ignoring")
+		} else {
+			sinks = append(sinks, push.NewInfluxSink(u, org, bucket, token("RS_PUSH_INFLUX_TOKEN")))
+		}
+	}
+	if u := os.Getenv("RS_PUSH_REMOTE_WRITE_URL"); u != "" {
+		sinks = append(sinks, push.NewRemoteWriteSink(u, token("RS_PUSH_REMOTE_WRITE_TOKEN")))
+	}
+	if u := os.Getenv("RS_PUSH_HTTP_URL"); u != "" {
+		sinks = append(sinks, push.NewHTTPSink(u, token("RS_PUSH_HTTP_TOKEN")))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	size := push.DefaultBufferSize
+	if v := os.Getenv("RS_PUSH_BUFFER"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < push.BatchSize {
+			log.Printf("Invalid RS_PUSH_BUFFER=%q (minimum %d), using %d", v, push.BatchSize, size)
+		} else {
+			size = n
+		}
+	}
+	names := make([]string, 0, len(sinks))
+	for _, sink := range sinks {
+		names = append(names, sink.Name())
+	}
+	log.Printf("Pushing records to %s, buffering up to %d each", strings.Join(names, ", "), size)
+	return push.New(size, sinks...)
+}
+
 func seedTargets(db *storage.DB) {
 	existing, _ := db.GetTargets(false)
 	if len(existing) == 0 {
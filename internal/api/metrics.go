@@ -0,0 +1,268 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yuanweize/RouteLens/internal/monitor"
+	"github.com/yuanweize/RouteLens/pkg/logging"
+	"github.com/yuanweize/RouteLens/pkg/push"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsAuth protects /metrics with the bearer token in RS_METRICS_TOKEN, as
+// set in a Prometheus scrape config's authorization section. Without the
+// variable the endpoint is public.
+func metricsAuth() gin.HandlerFunc {
+	token := os.Getenv("RS_METRICS_TOKEN")
+	return func(c *gin.Context) {
+		if token == "" {
+			c.Next()
+			return
+		}
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleMetrics exports the latest measurements of every active target and
+// the internal metrics of the service for Prometheus
+func (s *Server) handleMetrics(c *gin.Context) {
+	targets, err := s.db.GetTargets(false)
+	if err != nil {
+		logging.Error("api", "Failed to get targets for metrics: %v", err)
+		c.String(http.StatusInternalServerError, "failed to fetch targets\n")
+		return
+	}
+	ids := make([]uint, len(targets))
+	for i, t := range targets {
+		ids[i] = t.ID
+	}
+	byID, err := s.db.GetTargetSnapshots(ids)
+	if err != nil {
+		logging.Error("api", "Failed to get metrics of targets: %v", err)
+		c.String(http.StatusInternalServerError, "failed to fetch measurements\n")
+		return
+	}
+	snaps := make([]*storage.TargetSnapshot, len(targets))
+	for i, t := range targets {
+		snaps[i] = byID[t.ID]
+	}
+
+	var w metricsWriter
+	s.writeTargetMetrics(&w, targets, snaps)
+	s.writeProbeMetrics(&w, s.monitor.ProbeStats())
+	s.writeSchedulerMetrics(&w, s.monitor.SchedulerStats())
+	s.writePushMetrics(&w, s.monitor.PushStats())
+
+	w.family("routelens_database_size_bytes", "gauge", "Size of the database file and its write-ahead log, or of the database on a PostgreSQL server.")
+	if size, err := s.db.SizeBytes(); err == nil {
+		w.sample("routelens_database_size_bytes", float64(size))
+	}
+
+	logger := logging.GetGlobalLogger()
+	w.family("routelens_log_entries_total", "counter", "Log entries written since start, by level.")
+	totals := logger.Totals()
+	for _, level := range []logging.LogLevel{logging.LevelDebug, logging.LevelInfo, logging.LevelWarn, logging.LevelError} {
+		w.sample("routelens_log_entries_total", float64(totals[level]), "level", strings.ToLower(string(level)))
+	}
+	count, size := logger.Len()
+	w.family("routelens_log_buffer_entries", "gauge", "Log entries held by the in-memory log buffer.")
+	w.sample("routelens_log_buffer_entries", float64(count))
+	w.family("routelens_log_buffer_capacity", "gauge", "Capacity of the in-memory log buffer.")
+	w.sample("routelens_log_buffer_capacity", float64(size))
+
+	w.family("routelens_build_info", "gauge", "Version of the running RouteLens build.")
+	w.sample("routelens_build_info", 1, "version", Version, "commit", Commit)
+
+	c.Data(http.StatusOK, metricsContentType, []byte(w.b.String()))
+}
+
+// writeTargetMetrics writes the per-target gauges. Targets without a
+// measurement of a kind yet have no sample for it.
+func (s *Server) writeTargetMetrics(w *metricsWriter, targets []storage.Target, snaps []*storage.TargetSnapshot) {
+	labels := func(t storage.Target, extra ...string) []string {
+		return append([]string{"name", t.Name, "address", t.Address, "probe_type", t.ProbeType}, extra...)
+	}
+	gauge := func(name, help string, value func(*storage.TargetSnapshot) (float64, bool)) {
+		w.family(name, "gauge", help)
+		for i, t := range targets {
+			if v, ok := value(snaps[i]); ok {
+				w.sample(name, v, labels(t)...)
+			}
+		}
+	}
+
+	gauge("routelens_target_latency_seconds", "Latest round-trip time to the target, absent while every packet of it was lost.", func(s *storage.TargetSnapshot) (float64, bool) {
+		// A sample that lost every packet has no round-trip time
+		if s.Latency == nil || s.Latency.PacketLoss >= 100 {
+			return 0, false
+		}
+		return s.Latency.LatencyMs / 1000, true
+	})
+	gauge("routelens_target_packet_loss_ratio", "Latest packet loss to the target, from 0 to 1.", func(s *storage.TargetSnapshot) (float64, bool) {
+		if s.Latency == nil {
+			return 0, false
+		}
+		return s.Latency.PacketLoss / 100, true
+	})
+	gauge("routelens_target_jitter_seconds", fmt.Sprintf("Mean difference between consecutive round-trip times over the latest %d samples.", storage.JitterWindow),
+		func(s *storage.TargetSnapshot) (float64, bool) { return s.JitterMs / 1000, s.Jitter })
+	gauge("routelens_target_last_sample_timestamp_seconds", "Time of the latest latency sample of the target.", func(s *storage.TargetSnapshot) (float64, bool) {
+		if s.Latency == nil {
+			return 0, false
+		}
+		return float64(s.Latency.CreatedAt.UnixMilli()) / 1000, true
+	})
+
+	w.family("routelens_target_bandwidth_bits_per_second", "gauge", "Latest bandwidth test result of the target, by direction.")
+	for i, t := range targets {
+		if sp := snaps[i].Speed; sp != nil {
+			w.sample("routelens_target_bandwidth_bits_per_second", sp.SpeedDown*1e6, labels(t, "direction", "down")...)
+			w.sample("routelens_target_bandwidth_bits_per_second", sp.SpeedUp*1e6, labels(t, "direction", "up")...)
+		}
+	}
+
+	gauge("routelens_target_hops", "Number of hops in the latest route trace of the target.", func(s *storage.TargetSnapshot) (float64, bool) {
+		return float64(s.Hops), s.HopsTrace != 0
+	})
+
+	w.family("routelens_target_error", "gauge", "1 if the latest probe of the target failed or timed out.")
+	for _, t := range targets {
+		failed := 0.0
+		if t.LastError != "" {
+			failed = 1
+		}
+		w.sample("routelens_target_error", failed, labels(t)...)
+	}
+}
+
+func (s *Server) writeProbeMetrics(w *metricsWriter, st monitor.ProbeStats) {
+	w.family("routelens_probe_duration_seconds", "histogram", "Duration of probe runs since start, by probe.")
+	for _, probe := range sortedKeys(st.Durations) {
+		h := st.Durations[probe]
+		for i, le := range monitor.DurationBuckets {
+			w.sample("routelens_probe_duration_seconds_bucket", float64(h.Counts[i]), "probe", probe, "le", formatMetric(le))
+		}
+		w.sample("routelens_probe_duration_seconds_bucket", float64(h.Count), "probe", probe, "le", "+Inf")
+		w.sample("routelens_probe_duration_seconds_sum", h.Sum, "probe", probe)
+		w.sample("routelens_probe_duration_seconds_count", float64(h.Count), "probe", probe)
+	}
+
+	w.family("routelens_probe_failures_total", "counter", "Failed probe runs since start, by probe and error class.")
+	for _, probe := range sortedKeys(st.Failures) {
+		classes := st.Failures[probe]
+		for _, class := range sortedKeys(classes) {
+			w.sample("routelens_probe_failures_total", float64(classes[class]), "probe", probe, "class", class)
+		}
+	}
+}
+
+func (s *Server) writeSchedulerMetrics(w *metricsWriter, pools []monitor.PoolStats) {
+	w.family("routelens_scheduler_skipped_runs_total", "counter", "Probe runs skipped because the previous run of the target had not finished, by pool.")
+	for _, p := range pools {
+		w.sample("routelens_scheduler_skipped_runs_total", float64(p.Skipped), "pool", p.Name)
+	}
+	w.family("routelens_scheduler_workers", "gauge", "Size of the probe pool.")
+	for _, p := range pools {
+		w.sample("routelens_scheduler_workers", float64(p.Workers), "pool", p.Name)
+	}
+	w.family("routelens_scheduler_active", "gauge", "Probes running in the pool.")
+	for _, p := range pools {
+		w.sample("routelens_scheduler_active", float64(p.Active), "pool", p.Name)
+	}
+	w.family("routelens_scheduler_queued", "gauge", "Probes waiting for a worker of the pool.")
+	for _, p := range pools {
+		w.sample("routelens_scheduler_queued", float64(p.Queued), "pool", p.Name)
+	}
+}
+
+// writePushMetrics writes the queue stats of the push sinks; there are no
+// samples when pushing is not configured
+func (s *Server) writePushMetrics(w *metricsWriter, sinks []push.SinkStats) {
+	w.family("routelens_push_queued_records", "gauge", "Records waiting to be pushed, by sink.")
+	for _, st := range sinks {
+		w.sample("routelens_push_queued_records", float64(st.Queued), "sink", st.Name)
+	}
+	w.family("routelens_push_sent_records_total", "counter", "Records accepted by the sink.")
+	for _, st := range sinks {
+		w.sample("routelens_push_sent_records_total", float64(st.Sent), "sink", st.Name)
+	}
+	w.family("routelens_push_dropped_records_total", "counter", "Records lost to a full buffer or rejected by the sink.")
+	for _, st := range sinks {
+		w.sample("routelens_push_dropped_records_total", float64(st.Dropped), "sink", st.Name)
+	}
+	w.family("routelens_push_failures_total", "counter", "Failed batch writes to the sink.")
+	for _, st := range sinks {
+		w.sample("routelens_push_failures_total", float64(st.Failures), "sink", st.Name)
+	}
+}
+
+// metricsWriter builds a page of the Prometheus text exposition format
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// family starts a metric family with its HELP and TYPE lines
+func (w *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+}
+
+// sample writes one sample; labels are name, value pairs
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			fmt.Fprintf(&w.b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.b.WriteByte('}')
+	}
+	w.b.WriteByte(' ')
+	w.b.WriteString(formatMetric(value))
+	w.b.WriteByte('\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+func formatMetric(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -17,7 +18,10 @@ import (
 	"github.com/oschwald/geoip2-golang"
 	"github.com/yuanweize/RouteLens/internal/auth"
 	"github.com/yuanweize/RouteLens/internal/monitor"
+	"github.com/yuanweize/RouteLens/pkg/export"
 	"github.com/yuanweize/RouteLens/pkg/logging"
+	"github.com/yuanweize/RouteLens/pkg/prober"
+	"github.com/yuanweize/RouteLens/pkg/secrets"
 	"github.com/yuanweize/RouteLens/pkg/storage"
 )
 
@@ -74,27 +78,19 @@ func formatBytes(bytes int64) string {
 }
 
 type Server struct {
-	router   *gin.Engine
-	db       *storage.DB
-	monitor  *monitor.Service
-	distFS   fs.FS
-	dbPath   string
-	settings SystemSettings
+	router  *gin.Engine
+	db      *storage.DB
+	monitor *monitor.Service
+	distFS  fs.FS
 }
 
-func NewServer(db *storage.DB, mon *monitor.Service, distFS fs.FS, dbPath string) *Server {
+func NewServer(db *storage.DB, mon *monitor.Service, distFS fs.FS) *Server {
 	r := gin.Default()
 	s := &Server{
 		router:  r,
 		db:      db,
 		monitor: mon,
 		distFS:  distFS,
-		dbPath:  dbPath,
-		settings: SystemSettings{
-			RetentionDays:     30,
-			SpeedTestInterval: 5,
-			PingInterval:      30,
-		},
 	}
 	s.setupRoutes()
 	return s
@@ -185,6 +181,7 @@ func (s *Server) setupRoutes() {
 	s.router.POST("/login", LoginRateLimitMiddleware(loginRateLimiter), s.handleLogin)
 	s.router.GET("/api/v1/system/info", s.handleSystemInfo)      // Public: version info is not sensitive
 	s.router.GET("/api/v1/system/releases", s.handleGetReleases) // Public: GitHub releases info
+	s.router.GET("/metrics", metricsAuth(), s.handleMetrics)     // Prometheus; bearer token in RS_METRICS_TOKEN, public without
 
 	// Protected API
 	api := s.router.Group("/api/v1")
@@ -192,15 +189,25 @@ func (s *Server) setupRoutes() {
 	{
 		api.GET("/status", s.handleStatus)
 		api.GET("/history", s.handleHistory)
+		api.GET("/dns/history", s.handleDNSHistory)
+		api.GET("/hops/history", s.handleHopHistory)
 		api.GET("/trace", s.handleTrace)
+		api.GET("/trace/history", s.handleTraceHistory)
+		api.GET("/export", s.handleExport)
 		api.POST("/probe", s.handleProbe)
 		api.POST("/user/password", s.handleUpdatePassword)
 
 		// Target CRUD
+		api.GET("/probe-types", s.handleGetProbeTypes)
 		api.GET("/targets", s.handleGetTargets)
 		api.POST("/targets", s.handleSaveTarget)
 		api.DELETE("/targets/:id", s.handleDeleteTarget)
 
+		// Secrets store, referenced from probe configs as ${secret:name}
+		api.GET("/secrets", s.handleGetSecrets)
+		api.POST("/secrets", s.handleSaveSecret)
+		api.DELETE("/secrets/:name", s.handleDeleteSecret)
+
 		// System Logs
 		api.GET("/logs", s.handleGetLogs)
 
@@ -212,8 +219,11 @@ func (s *Server) setupRoutes() {
 		api.GET("/system/database/stats", s.handleGetDatabaseStats)
 		api.POST("/system/database/clean", s.handleCleanDatabase)
 		api.POST("/system/database/vacuum", s.handleVacuumDatabase)
+		api.POST("/system/database/backup", s.handleBackupDatabase)
+		api.POST("/system/database/restore", s.handleRestoreDatabase)
 		api.GET("/system/settings", s.handleGetSettings)
 		api.POST("/system/settings", s.handleSaveSettings)
+		api.GET("/system/settings/audit", s.handleGetSettingsAudit)
 
 		// GeoIP Management - Protected
 		api.GET("/system/geoip/status", s.handleGetGeoIPStatus)
@@ -352,62 +362,219 @@ func (s *Server) handleStatus(c *gin.Context) {
 
 	status := make([]gin.H, 0, len(targets))
 	for _, t := range targets {
-		rec, recErr := s.db.GetLatestRecord(t.Address)
-		if recErr != nil {
-			status = append(status, gin.H{
-				"target":     t,
-				"latency":    0,
-				"loss":       0,
-				"speed_down": 0,
-				"speed_up":   0,
-				"updated_at": nil,
-			})
-			continue
-		}
-		status = append(status, gin.H{
+		redactTarget(&t)
+		entry := gin.H{
 			"target":     t,
-			"latency":    rec.LatencyMs,
-			"loss":       rec.PacketLoss,
-			"speed_down": rec.SpeedDown,
-			"speed_up":   rec.SpeedUp,
-			"updated_at": rec.CreatedAt,
-		})
+			"latency":    0,
+			"loss":       0,
+			"speed_down": 0,
+			"speed_up":   0,
+			"updated_at": nil,
+		}
+		var updated time.Time
+		if rec, err := s.db.GetLatestLatency(t.ID); err == nil {
+			entry["latency"] = rec.LatencyMs
+			entry["loss"] = rec.PacketLoss
+			updated = rec.CreatedAt
+		}
+		if rec, err := s.db.GetLatestSpeed(t.ID); err == nil {
+			entry["speed_down"] = rec.SpeedDown
+			entry["speed_up"] = rec.SpeedUp
+			if rec.CreatedAt.After(updated) {
+				updated = rec.CreatedAt
+			}
+		}
+		if !updated.IsZero() {
+			entry["updated_at"] = updated
+		}
+		status = append(status, entry)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"targets": status})
+	c.JSON(http.StatusOK, gin.H{"targets": status, "scheduler": s.monitor.SchedulerStats()})
 }
 
-func (s *Server) handleHistory(c *gin.Context) {
-	target := c.Query("target")
-	if target == "" {
+// lookupTarget resolves the target of a request from target_id, or from the
+// target address: the active target with it, else the latest archived one.
+// It responds with an error and returns nil if there is none.
+func (s *Server) lookupTarget(c *gin.Context) *storage.Target {
+	if idStr := c.Query("target_id"); idStr != "" {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target_id"})
+			return nil
+		}
+		t, err := s.db.GetTargetByID(uint(id))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Target not found"})
+			return nil
+		}
+		return t
+	}
+	address := c.Query("target")
+	if address == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "target is required"})
+		return nil
+	}
+	t, err := s.db.GetTargetByAddress(address)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Target not found"})
+		return nil
+	}
+	return t
+}
+
+func (s *Server) handleHistory(c *gin.Context) {
+	target := s.lookupTarget(c)
+	if target == nil {
+		return
+	}
+
+	resolution, err := storage.ParseResolution(c.Query("resolution"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	kind, err := storage.ParseHistoryKind(c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	start, end := historyRange(c)
+	records, resolution, err := s.db.GetHistoryAt(target.ID, kind, resolution, start, end)
+	if err != nil {
+		logging.Error("api", "Failed to get history for %s: %v", target.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch history"})
+		return
+	}
+
+	c.Header("X-Resolution", resolution)
+	c.JSON(http.StatusOK, records)
+}
+
+// handleDNSHistory returns the per-resolver answers of a MODE_DNS target
+func (s *Server) handleDNSHistory(c *gin.Context) {
+	target := s.lookupTarget(c)
+	if target == nil {
+		return
+	}
+
+	start, end := historyRange(c)
+	records, err := s.db.GetDNSHistory(target.ID, start, end)
+	if err != nil {
+		logging.Error("api", "Failed to get DNS history for %s: %v", target.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch DNS history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, records)
+}
+
+// handleHopHistory returns the samples of one hop over time, selected either
+// by target and ttl or by the hop's ip (optionally within one target's
+// routes), along with a summary
+func (s *Server) handleHopHistory(c *gin.Context) {
+	ip := c.Query("ip")
+	ttl := 0
+	if ip == "" {
+		var err error
+		ttl, err = strconv.Atoi(c.Query("ttl"))
+		if err != nil || ttl < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ip, or target and a positive ttl, is required"})
+			return
+		}
+	}
+	var targetID uint
+	if ip == "" || c.Query("target") != "" || c.Query("target_id") != "" {
+		target := s.lookupTarget(c)
+		if target == nil {
+			return
+		}
+		targetID = target.ID
+	}
+
+	start, end := historyRange(c)
+	hops, err := s.db.GetHopHistory(targetID, ttl, ip, start, end)
+	if err != nil {
+		logging.Error("api", "Failed to get hop history (target=%d ttl=%d ip=%q): %v", targetID, ttl, ip, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch hop history"})
 		return
 	}
 
-	startStr := c.Query("start")
-	endStr := c.Query("end")
+	c.JSON(http.StatusOK, gin.H{
+		"hops":    hops,
+		"summary": storage.SummarizeHops(hops),
+	})
+}
 
-	end := time.Now()
-	start := end.Add(-6 * time.Hour)
-	if startStr != "" {
+// historyRange reads the optional RFC3339 start/end query parameters,
+// defaulting to the last 6 hours
+func historyRange(c *gin.Context) (start, end time.Time) {
+	end = time.Now()
+	start = end.Add(-6 * time.Hour)
+	if startStr := c.Query("start"); startStr != "" {
 		if parsed, err := time.Parse(time.RFC3339, startStr); err == nil {
 			start = parsed
 		}
 	}
-	if endStr != "" {
+	if endStr := c.Query("end"); endStr != "" {
 		if parsed, err := time.Parse(time.RFC3339, endStr); err == nil {
 			end = parsed
 		}
 	}
+	return start, end
+}
 
-	records, err := s.db.GetHistory(target, start, end)
+// handleExport streams the records of the targets given by target_id and/or
+// target (repeated or comma-separated; all targets if neither) within the
+// start/end range as CSV, NDJSON or Influx line protocol, with trace hops if
+// hops=true
+func (s *Server) handleExport(c *gin.Context) {
+	format, err := export.ParseFormat(c.Query("format"))
 	if err != nil {
-		logging.Error("api", "Failed to get history for %s: %v", target, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch history"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	opts := export.Options{Hops: c.Query("hops") == "true"}
+	for _, idStr := range splitQuery(c, "target_id") {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target_id"})
+			return
+		}
+		opts.TargetIDs = append(opts.TargetIDs, uint(id))
+	}
+	for _, address := range splitQuery(c, "target") {
+		t, err := s.db.GetTargetByAddress(address)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Target %s not found", address)})
+			return
+		}
+		opts.TargetIDs = append(opts.TargetIDs, t.ID)
+	}
+	opts.Start, opts.End = historyRange(c)
 
-	c.JSON(http.StatusOK, records)
+	name := fmt.Sprintf("routelens-%s.%s", time.Now().Format("20060102-150405"), export.Extension(format))
+	c.Header("Content-Type", export.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	c.Status(http.StatusOK)
+	if err := export.Export(s.db, c.Writer, format, opts); err != nil {
+		// Headers are sent; the client sees a truncated file
+		logging.Error("api", "Export failed: %v", err)
+	}
+}
+
+// splitQuery collects a repeated, possibly comma-separated query parameter
+func splitQuery(c *gin.Context, key string) []string {
+	var values []string
+	for _, v := range c.QueryArray(key) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
 }
 
 func (s *Server) handleProbe(c *gin.Context) {
@@ -429,14 +596,41 @@ func (s *Server) handleProbe(c *gin.Context) {
 	c.JSON(http.StatusAccepted, gin.H{"message": "Probe triggered", "target": req.Target})
 }
 
+// handleTraceHistory lists the distinct paths to a target seen in the time
+// range, with first and last seen times, and the reroutes between them
+func (s *Server) handleTraceHistory(c *gin.Context) {
+	target := s.lookupTarget(c)
+	if target == nil {
+		return
+	}
+
+	start, end := historyRange(c)
+	paths, err := s.db.GetRoutePaths(target.ID, start, end)
+	if err != nil {
+		logging.Error("api", "Failed to get route paths for %s: %v", target.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trace history"})
+		return
+	}
+	changes, err := s.db.GetRouteChanges(target.ID, start, end)
+	if err != nil {
+		logging.Error("api", "Failed to get route changes for %s: %v", target.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trace history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"paths":   paths,
+		"changes": changes,
+	})
+}
+
 func (s *Server) handleTrace(c *gin.Context) {
-	target := c.Query("target")
-	if target == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "target is required"})
+	target := s.lookupTarget(c)
+	if target == nil {
 		return
 	}
 
-	rec, err := s.db.GetLatestTrace(target)
+	rec, err := s.db.GetLatestTrace(target.ID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "trace not found"})
 		return
@@ -482,22 +676,112 @@ func (s *Server) handleTrace(c *gin.Context) {
 	c.Data(http.StatusOK, "application/json", localizedJson)
 }
 
+// handleGetProbeTypes lists the registered probe modes with their config schema
+func (s *Server) handleGetProbeTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, prober.Descriptors())
+}
+
 func (s *Server) handleGetTargets(c *gin.Context) {
-	targets, err := s.db.GetTargets(false)
+	var targets []storage.Target
+	var err error
+	if c.Query("archived") == "true" {
+		targets, err = s.db.GetArchivedTargets()
+	} else {
+		targets, err = s.db.GetTargets(false)
+	}
 	if err != nil {
 		logging.Error("api", "Failed to get targets: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch targets"})
 		return
 	}
+	for i := range targets {
+		redactTarget(&targets[i])
+	}
 	c.JSON(http.StatusOK, targets)
 }
 
+// handleGetSecrets lists the entries of the secrets store. Values are
+// write-only and never returned.
+func (s *Server) handleGetSecrets(c *gin.Context) {
+	list, err := s.db.ListSecrets()
+	if err != nil {
+		logging.Error("api", "Failed to list secrets: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list secrets"})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// handleSaveSecret creates or replaces an entry of the secrets store. Probers
+// resolve references on every run, so no reload is needed.
+func (s *Server) handleSaveSecret(c *gin.Context) {
+	var req struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if err := secrets.CheckName(req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value is required"})
+		return
+	}
+	if err := s.db.SetSecret(req.Name, req.Value); err != nil {
+		logging.Error("api", "Failed to save secret %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save secret"})
+		return
+	}
+	logging.Info("api", "Secret %s saved by %s", req.Name, c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{"message": "Secret saved"})
+}
+
+// handleDeleteSecret removes an entry of the secrets store. Entries still
+// referenced by a target are kept unless force=true.
+func (s *Server) handleDeleteSecret(c *gin.Context) {
+	name := c.Param("name")
+	if c.Query("force") != "true" {
+		users, err := s.db.SecretUsers(name)
+		if err != nil {
+			logging.Error("api", "Failed to check secret %s: %v", name, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete secret"})
+			return
+		}
+		if len(users) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Secret is referenced by targets", "targets": users})
+			return
+		}
+	}
+	if err := s.db.DeleteSecret(name); err != nil {
+		if errors.Is(err, storage.ErrSecretNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Secret not found"})
+			return
+		}
+		logging.Error("api", "Failed to delete secret %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete secret"})
+		return
+	}
+	logging.Info("api", "Secret %s deleted by %s", name, c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{"message": "Secret deleted"})
+}
+
+// redactTarget hides the secrets in a target's probe config, which are
+// write-only: clients see secrets.Redacted and may send it back unchanged
+func redactTarget(t *storage.Target) {
+	t.ProbeConfig = secrets.RedactFields(t.ProbeConfig, prober.SecretKeys(t.ProbeType))
+}
+
 func (s *Server) handleSaveTarget(c *gin.Context) {
 	var t storage.Target
 	if err := c.ShouldBindJSON(&t); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
 		return
 	}
+	t.ArchivedAt = nil // Only set by deleting with archive
 
 	// Security: Validate target address to prevent command injection
 	if t.Address == "" {
@@ -522,20 +806,59 @@ func (s *Server) handleSaveTarget(c *gin.Context) {
 	if t.ProbeType == "" {
 		t.ProbeType = storage.ProbeModeICMP
 	}
-	switch t.ProbeType {
-	case storage.ProbeModeICMP, storage.ProbeModeHTTP, storage.ProbeModeSSH, storage.ProbeModeIPERF:
-		// ok
-	default:
+	desc, ok := prober.Lookup(t.ProbeType)
+	if !ok || desc.Kind == prober.KindTrace {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid probe_type"})
 		return
 	}
+	family, err := prober.ParseFamily(t.AddressFamily)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.AddressFamily = string(family)
+
+	var stored string
+	if t.ID != 0 {
+		if existing, err := s.db.GetTargetByID(t.ID); err == nil {
+			stored = existing.ProbeConfig
+		}
+	}
+	t.ProbeConfig, err = secrets.KeepRedacted(t.ProbeConfig, stored, prober.SecretKeys(t.ProbeType))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid probe_config: %v", err)})
+		return
+	}
+
+	if err := secrets.CheckConfig(t.ProbeConfig, prober.SecretKeys(t.ProbeType)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid probe_config: %v", err)})
+		return
+	}
+
+	// Factories only parse the config, so building one validates it
+	if _, err := desc.New(prober.Spec{Address: t.Address, Family: family, Config: t.ProbeConfig}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid probe_config: %v", err)})
+		return
+	}
+	if _, err := prober.ParseTraceOptions(t.ProbeConfig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid probe_config: %v", err)})
+		return
+	}
+	if t.TimeoutSec < 0 || t.TimeoutSec > 3600 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timeout_sec must be between 0 (default) and 3600"})
+		return
+	}
+	if err := validateIntervals(t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Distinguish between Create (ID=0) and Update (ID>0)
 	if t.ID == 0 {
 		// Create new target
 		if err := s.db.CreateTarget(&t); err != nil {
 			// Handle duplicate address error gracefully
-			if strings.Contains(err.Error(), "UNIQUE constraint") {
+			if errors.Is(err, storage.ErrDuplicateAddress) {
 				c.JSON(http.StatusConflict, gin.H{"error": "Target with this address already exists"})
 				return
 			}
@@ -549,18 +872,30 @@ func (s *Server) handleSaveTarget(c *gin.Context) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Target not found"})
 			return
 		}
+		if existing.ArchivedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Target is archived"})
+			return
+		}
 		// Preserve created_at from existing record
 		t.CreatedAt = existing.CreatedAt
 		if err := s.db.UpdateTarget(&t); err != nil {
+			if errors.Is(err, storage.ErrDuplicateAddress) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Target with this address already exists"})
+				return
+			}
 			logging.Error("api", "Failed to update target %d: %v", t.ID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update target"})
 			return
 		}
 	}
 
+	s.monitor.Reload()
+	redactTarget(&t)
 	c.JSON(http.StatusOK, t)
 }
 
+// handleDeleteTarget deletes a target with all of its data, or with
+// ?archive=true keeps the data and archives the target
 func (s *Server) handleDeleteTarget(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
@@ -568,11 +903,22 @@ func (s *Server) handleDeleteTarget(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	if c.Query("archive") == "true" {
+		if err := s.db.ArchiveTarget(uint(id)); err != nil {
+			logging.Error("api", "Failed to archive target %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive target"})
+			return
+		}
+		s.monitor.Reload()
+		c.JSON(http.StatusOK, gin.H{"message": "Target archived"})
+		return
+	}
 	if err := s.db.DeleteTarget(uint(id)); err != nil {
 		logging.Error("api", "Failed to delete target %d: %v", id, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete target"})
 		return
 	}
+	s.monitor.Reload()
 	c.JSON(http.StatusOK, gin.H{"message": "Target deleted"})
 }
 
@@ -625,7 +971,13 @@ func (s *Server) handleGetLogs(c *gin.Context) {
 // --- Database Management Handlers ---
 
 func (s *Server) handleGetDatabaseStats(c *gin.Context) {
-	stats, err := s.db.GetDatabaseStats(s.dbPath, s.settings.RetentionDays)
+	settings, err := s.db.GetSettings()
+	if err != nil {
+		logging.Error("api", "Failed to load settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	stats, err := s.db.GetDatabaseStats(settings.RetentionDays)
 	if err != nil {
 		logging.Error("api", "Failed to get database stats: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get database statistics"})
@@ -639,7 +991,7 @@ func (s *Server) handleCleanDatabase(c *gin.Context) {
 		Days int `json:"days"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		req.Days = s.settings.RetentionDays
+		req.Days, _ = s.db.GetSettingInt(storage.SettingRetentionDays, 0)
 	}
 	if req.Days < 1 {
 		req.Days = 7
@@ -670,19 +1022,101 @@ func (s *Server) handleVacuumDatabase(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Database vacuumed successfully"})
 }
 
-// Settings management
-type SystemSettings struct {
-	RetentionDays     int `json:"retention_days"`
-	SpeedTestInterval int `json:"speed_test_interval_minutes"`
-	PingInterval      int `json:"ping_interval_seconds"`
+// handleBackupDatabase downloads a consistent snapshot of the live database,
+// gzip-compressed unless ?gzip=false
+func (s *Server) handleBackupDatabase(c *gin.Context) {
+	compress := c.Query("gzip") != "false"
+	dir, err := os.MkdirTemp("", "routelens-backup-")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create temp dir: %v", err)})
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := storage.BackupName(time.Now(), compress)
+	path := filepath.Join(dir, name)
+	if err := s.db.Backup(path, compress); err != nil {
+		if errors.Is(err, storage.ErrBackupUnsupported) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		logging.Error("database", "Backup failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to back up database"})
+		return
+	}
+	logging.Info("database", "Database backup downloaded (%s)", name)
+	c.FileAttachment(path, name)
 }
 
+// handleRestoreDatabase replaces the database contents with an uploaded
+// backup (multipart field "file", plain or gzipped) and reloads the monitor
+func (s *Server) handleRestoreDatabase(c *gin.Context) {
+	upload, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	tmp, err := os.CreateTemp("", "routelens-restore-*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create temp file: %v", err)})
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := c.SaveUploadedFile(upload, tmp.Name()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save upload: %v", err)})
+		return
+	}
+
+	snapshot, err := s.db.Restore(tmp.Name())
+	if err != nil {
+		logging.Error("database", "Restore from %s failed: %v", upload.Filename, err)
+		if errors.Is(err, storage.ErrInvalidBackup) || errors.Is(err, storage.ErrBackupUnsupported) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.monitor.Reload()
+	logging.Info("database", "Database restored from %s, previous data saved to %s", upload.Filename, snapshot)
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Database restored",
+		"snapshot": snapshot,
+	})
+}
+
+// validateIntervals checks a target's own probe intervals (0 = global setting)
+func validateIntervals(t storage.Target) error {
+	for _, iv := range []struct {
+		name     string
+		sec, min int
+	}{
+		{"ping_interval_sec", t.PingIntervalSec, 10},
+		{"trace_interval_sec", t.TraceIntervalSec, 10},
+		{"speed_interval_sec", t.SpeedIntervalSec, 60},
+	} {
+		if iv.sec != 0 && (iv.sec < iv.min || iv.sec > 86400) {
+			return fmt.Errorf("%s must be 0 (global setting) or between %d and 86400", iv.name, iv.min)
+		}
+	}
+	return nil
+}
+
+// Settings management
+
 func (s *Server) handleGetSettings(c *gin.Context) {
-	c.JSON(http.StatusOK, s.settings)
+	settings, err := s.db.GetSettings()
+	if err != nil {
+		logging.Error("api", "Failed to load settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings"})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
 }
 
 func (s *Server) handleSaveSettings(c *gin.Context) {
-	var req SystemSettings
+	var req storage.SystemSettings
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
 		return
@@ -701,12 +1135,34 @@ func (s *Server) handleSaveSettings(c *gin.Context) {
 	if req.PingInterval < 10 {
 		req.PingInterval = 30
 	}
+	if req.TraceInterval != 0 && req.TraceInterval < req.PingInterval {
+		req.TraceInterval = req.PingInterval
+	}
 
-	s.settings = req
-	// TODO: Persist settings to database or config file
-	logging.Info("settings", "Settings updated: retention=%d days, speed=%d min, ping=%d sec",
-		req.RetentionDays, req.SpeedTestInterval, req.PingInterval)
-	c.JSON(http.StatusOK, s.settings)
+	// Subscribers (monitor, retention cleaner) pick the change up from storage
+	actor := c.GetString("username")
+	if err := s.db.SaveSettings(req, actor); err != nil {
+		logging.Error("settings", "Failed to save settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings"})
+		return
+	}
+	logging.Info("settings", "Settings updated by %s: retention=%d days, speed=%d min, ping=%d sec, trace=%d sec",
+		actor, req.RetentionDays, req.SpeedTestInterval, req.PingInterval, req.TraceInterval)
+	c.JSON(http.StatusOK, req)
+}
+
+func (s *Server) handleGetSettingsAudit(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	audits, err := s.db.GetSettingAudit(limit)
+	if err != nil {
+		logging.Error("api", "Failed to load settings audit: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load settings audit"})
+		return
+	}
+	c.JSON(http.StatusOK, audits)
 }
 
 // GeoIP Status Response
@@ -727,8 +1183,17 @@ type GeoIPStatus struct {
 	Description   string `json:"description"`
 }
 
+// dataDir is where local data such as the GeoIP databases live: next to the
+// SQLite file, or ./data when the database is remote
+func (s *Server) dataDir() string {
+	if path := s.db.Path(); path != "" {
+		return filepath.Dir(path)
+	}
+	return "data"
+}
+
 func (s *Server) handleGetGeoIPStatus(c *gin.Context) {
-	geoipPath := filepath.Join(filepath.Dir(s.dbPath), "geoip", "GeoLite2-City.mmdb")
+	geoipPath := filepath.Join(s.dataDir(), "geoip", "GeoLite2-City.mmdb")
 
 	status := GeoIPStatus{
 		Available: false,
@@ -763,7 +1228,7 @@ func (s *Server) handleGetGeoIPStatus(c *gin.Context) {
 }
 
 func (s *Server) handleUpdateGeoIP(c *gin.Context) {
-	geoipDir := filepath.Join(filepath.Dir(s.dbPath), "geoip")
+	geoipDir := filepath.Join(s.dataDir(), "geoip")
 	geoipPath := filepath.Join(geoipDir, "GeoLite2-City.mmdb")
 
 	// Create directory if not exists
@@ -42,10 +42,14 @@ func NewRootCmd(runServer func(port, dbPath string)) *cobra.Command {
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&port, "port", "p", "8080", "HTTP port to listen on")
-	rootCmd.PersistentFlags().StringVarP(&dbPath, "db", "d", "data/routelens.db", "Path to SQLite database")
+	rootCmd.PersistentFlags().StringVarP(&dbPath, "db", "d", "data/routelens.db", "SQLite database path, or postgres:// DSN")
 
 	rootCmd.AddCommand(newServiceCmd())
 	rootCmd.AddCommand(newAdminCmd())
+	rootCmd.AddCommand(newProbeCmd())
+	rootCmd.AddCommand(newDBCmd())
+	rootCmd.AddCommand(newExportCmd())
+	rootCmd.AddCommand(newSecretsCmd())
 
 	return rootCmd
 }
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+func newDBCmd() *cobra.Command {
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Database maintenance",
+	}
+
+	var status bool
+	var to int
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending schema migrations, or show their status",
+		Run: func(cmd *cobra.Command, args []string) {
+			db, err := storage.Open(dbPath)
+			if err != nil {
+				log.Fatalf("Failed to open DB: %v", err)
+			}
+			defer db.Close()
+
+			if !status {
+				if err := db.Migrate(to); err != nil {
+					log.Fatalf("Migration failed: %v", err)
+				}
+			}
+			printMigrationStatus(db)
+		},
+	}
+	migrateCmd.Flags().BoolVar(&status, "status", false, "Only show which migrations are applied")
+	migrateCmd.Flags().IntVar(&to, "to", 0, "Migrate up to this schema version (default latest)")
+
+	var compress bool
+	backupCmd := &cobra.Command{
+		Use:   "backup [file]",
+		Short: "Write a consistent snapshot of the database, also while the service runs",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			db, err := storage.Open(dbPath)
+			if err != nil {
+				log.Fatalf("Failed to open DB: %v", err)
+			}
+			defer db.Close()
+
+			if err := db.Backup(args[0], compress); err != nil {
+				log.Fatalf("Backup failed: %v", err)
+			}
+			fmt.Printf("Database backed up to %s\n", args[0])
+		},
+	}
+	backupCmd.Flags().BoolVar(&compress, "gzip", false, "Gzip-compress the backup")
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore [file]",
+		Short: "Replace the database contents with a backup (plain or gzipped)",
+		Long: `Validate a backup, migrate it to the current schema and swap its data in.
+The current data is saved next to the database file first; the newest 7
+of these snapshots are kept. A running service keeps working but should be restarted to reload its targets.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			db, err := storage.NewDB(dbPath)
+			if err != nil {
+				log.Fatalf("Failed to open DB: %v", err)
+			}
+			defer db.Close()
+
+			snapshot, err := db.Restore(args[0])
+			if err != nil {
+				log.Fatalf("Restore failed: %v", err)
+			}
+			fmt.Printf("Database restored from %s\n", args[0])
+			fmt.Printf("Previous data saved to %s\n", snapshot)
+		},
+	}
+
+	dbCmd.AddCommand(migrateCmd, backupCmd, restoreCmd)
+	return dbCmd
+}
+
+func printMigrationStatus(db *storage.DB) {
+	states, err := db.MigrationStatus()
+	if err != nil {
+		log.Fatalf("Failed to read migration status: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, st := range states {
+		applied := "pending"
+		if st.AppliedAt != nil {
+			applied = st.AppliedAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, applied)
+	}
+	w.Flush()
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yuanweize/RouteLens/pkg/export"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+func newExportCmd() *cobra.Command {
+	var format, output, start, end string
+	var targets []string
+	var targetIDs []uint
+	var since time.Duration
+	var hops bool
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export latency, speed and trace hop records as CSV, NDJSON or Influx line protocol",
+		Run: func(cmd *cobra.Command, args []string) {
+			f, err := export.ParseFormat(format)
+			if err != nil {
+				log.Fatal(err)
+			}
+			db, err := storage.NewDB(dbPath)
+			if err != nil {
+				log.Fatalf("Failed to open DB: %v", err)
+			}
+			defer db.Close()
+
+			opts := export.Options{Hops: hops}
+			opts.TargetIDs = append(opts.TargetIDs, targetIDs...)
+			for _, address := range targets {
+				t, err := db.GetTargetByAddress(address)
+				if err != nil {
+					log.Fatalf("Target %s not found", address)
+				}
+				opts.TargetIDs = append(opts.TargetIDs, t.ID)
+			}
+			opts.End = time.Now()
+			if end != "" {
+				if opts.End, err = time.Parse(time.RFC3339, end); err != nil {
+					log.Fatalf("Invalid --end: %v", err)
+				}
+			}
+			opts.Start = opts.End.Add(-since)
+			if start != "" {
+				if opts.Start, err = time.Parse(time.RFC3339, start); err != nil {
+					log.Fatalf("Invalid --start: %v", err)
+				}
+			}
+
+			var w io.Writer = os.Stdout
+			if output != "" && output != "-" {
+				file, err := os.Create(output)
+				if err != nil {
+					log.Fatalf("Failed to create %s: %v", output, err)
+				}
+				defer file.Close()
+				w = file
+			}
+			if err := export.Export(db, w, f, opts); err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+		},
+	}
+	exportCmd.Flags().StringVarP(&format, "format", "f", export.FormatCSV, "Output format: csv, ndjson or influx")
+	exportCmd.Flags().StringVarP(&output, "output", "o", "", "Output file (default stdout)")
+	exportCmd.Flags().StringSliceVarP(&targets, "target", "t", nil, "Target address to export (repeatable; default all targets)")
+	exportCmd.Flags().UintSliceVar(&targetIDs, "target-id", nil, "Target ID to export (repeatable)")
+	exportCmd.Flags().StringVar(&start, "start", "", "Start of the range, RFC3339 (default end minus --since)")
+	exportCmd.Flags().StringVar(&end, "end", "", "End of the range, RFC3339 (default now)")
+	exportCmd.Flags().DurationVar(&since, "since", 24*time.Hour, "Length of the range when --start is not given")
+	exportCmd.Flags().BoolVar(&hops, "hops", false, "Also export trace hops")
+	return exportCmd
+}
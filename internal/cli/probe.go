@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yuanweize/RouteLens/pkg/prober"
+)
+
+func newProbeCmd() *cobra.Command {
+	probeCmd := &cobra.Command{
+		Use:   "probe",
+		Short: "Inspect and run registered probe modes",
+	}
+
+	typesCmd := &cobra.Command{
+		Use:   "types",
+		Short: "List registered probe types and their config keys",
+		Run: func(cmd *cobra.Command, args []string) {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TYPE\tKIND\tCONFIG")
+			for _, d := range prober.Descriptors() {
+				keys := make([]string, 0, len(d.Config))
+				for _, f := range d.Config {
+					if f.Required {
+						keys = append(keys, f.Key+"*")
+					} else {
+						keys = append(keys, f.Key)
+					}
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", d.Type, d.Kind, strings.Join(keys, ", "))
+			}
+			w.Flush()
+		},
+	}
+
+	var probeType, probeConfig, family string
+	var timeout time.Duration
+	runCmd := &cobra.Command{
+		Use:   "run [address]",
+		Short: "Run a single probe against an address and print the result",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := prober.ValidateTarget(args[0]); err != nil {
+				log.Fatalf("Invalid address: %v", err)
+			}
+			fam, err := prober.ParseFamily(family)
+			if err != nil {
+				log.Fatalf("Invalid family: %v", err)
+			}
+			p, err := prober.New(probeType, prober.Spec{Address: args[0], Family: fam, Config: probeConfig})
+			if err != nil {
+				log.Fatalf("Invalid probe: %v", err)
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+			ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+			defer cancelTimeout()
+			res, err := p.Run(ctx)
+			if prober.IsTimeout(err) {
+				log.Fatalf("Probe timed out after %v: %v", timeout, err)
+			}
+			if err != nil {
+				log.Fatalf("Probe failed: %v", err)
+			}
+			printProbeResult(res)
+		},
+	}
+	runCmd.Flags().StringVarP(&probeType, "type", "t", prober.ModeICMP, "Probe type (see 'probe types'), or a trace engine: "+strings.Join([]string{prober.TracerNative, prober.TracerBinary, prober.TracerTraceroute}, ", "))
+	runCmd.Flags().StringVarP(&probeConfig, "config", "c", "", "Probe config as JSON")
+	runCmd.Flags().StringVar(&family, "family", "auto", "Address family: auto, v4 or v6")
+	runCmd.Flags().DurationVar(&timeout, "timeout", 2*time.Minute, "Abort the probe after this long")
+
+	probeCmd.AddCommand(typesCmd)
+	probeCmd.AddCommand(runCmd)
+	return probeCmd
+}
+
+func printProbeResult(res *prober.Result) {
+	if res == nil {
+		fmt.Println("No result")
+		return
+	}
+	if p := res.Ping; p != nil {
+		fmt.Printf("--- %s (%s) ---\n", p.Addr, p.Family)
+		fmt.Printf("%d packets transmitted, %d received, %.1f%% packet loss\n", p.PacketsSent, p.PacketsRecv, p.LossRate)
+		fmt.Printf("rtt min/avg/max = %v / %v / %v\n", p.MinRtt, p.AvgRtt, p.MaxRtt)
+	}
+	if sp := res.Speed; sp != nil {
+		fmt.Printf("Download: %.2f Mbps\n", sp.DownloadSpeed)
+		fmt.Printf("Upload:   %.2f Mbps\n", sp.UploadSpeed)
+	}
+	if h := res.HTTP; h != nil {
+		fmt.Printf("--- %s (%s %s) ---\n", h.URL, h.Family, h.Addr)
+		fmt.Printf("Status:  %d\n", h.StatusCode)
+		fmt.Printf("DNS:     %v\n", h.DNS)
+		fmt.Printf("Connect: %v\n", h.Connect)
+		fmt.Printf("TLS:     %v\n", h.TLS)
+		fmt.Printf("TTFB:    %v\n", h.TTFB)
+		fmt.Printf("Total:   %v\n", h.Total)
+	}
+	if d := res.DNS; d != nil {
+		fmt.Printf("--- %s %s ---\n", d.Name, d.Type)
+		for _, a := range d.Answers {
+			if a.Err != "" {
+				fmt.Printf("%s: error: %s\n", a.Resolver, a.Err)
+				continue
+			}
+			fmt.Printf("%s: %s in %v\n", a.Resolver, a.Rcode, a.QueryTime)
+			for _, rr := range a.Answers {
+				fmt.Printf("  %s\n", rr)
+			}
+		}
+	}
+	if m := res.MTR; m != nil {
+		fmt.Printf("--- %s (%s, %s) ---\n", m.Target, m.Family, m.Method)
+		for _, h := range m.Hops {
+			fmt.Printf("%2d  %-40s loss=%5.1f%%  avg=%.1fms  best=%.1fms  worst=%.1fms\n", h.Hop, h.Host, h.Loss, h.Avg, h.Best, h.Worst)
+		}
+	}
+	if tr := res.Trace; tr != nil {
+		fmt.Printf("--- %s (%s, %s) ---\n", tr.Target, tr.Family, tr.Method)
+		for _, h := range tr.Hops {
+			fmt.Printf("%2d  %-40s %v\n", h.Hop, h.IP, h.Latency)
+		}
+	}
+}
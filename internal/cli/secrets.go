@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yuanweize/RouteLens/pkg/prober"
+	"github.com/yuanweize/RouteLens/pkg/secrets"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+func newSecretsCmd() *cobra.Command {
+	secretsCmd := &cobra.Command{
+		Use:   "secrets",
+		Short: "Manage probe credentials: encryption and the secrets store",
+	}
+
+	var decrypt bool
+	rotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Re-encrypt probe credentials from RS_MASTER_KEY_OLD to RS_MASTER_KEY",
+		Long: `Re-encrypt the probe credentials of all targets and the entries of the
+secrets store in one transaction.
+The old key is read from RS_MASTER_KEY_OLD (unset if secrets are stored
+unencrypted), the new one from RS_MASTER_KEY or RS_MASTER_KEY_FILE.
+With --decrypt they are stored unencrypted instead.
+Restart the service with the new key afterwards.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var from *secrets.Box
+			if old := os.Getenv("RS_MASTER_KEY_OLD"); old != "" {
+				var err error
+				if from, err = secrets.NewBox(old); err != nil {
+					log.Fatalf("Invalid RS_MASTER_KEY_OLD: %v", err)
+				}
+			}
+			var to *secrets.Box
+			if !decrypt {
+				var err error
+				if to, err = secrets.FromEnv(); err != nil {
+					log.Fatalf("Invalid master key: %v", err)
+				}
+				if to == nil {
+					log.Fatal("Set RS_MASTER_KEY to the new key, or pass --decrypt")
+				}
+			}
+
+			db, err := storage.NewDB(dbPath)
+			if err != nil {
+				log.Fatalf("Failed to open DB: %v", err)
+			}
+			defer db.Close()
+			db.SetSecretKeys(prober.SecretKeys)
+
+			n, err := db.ResealSecrets(from, to)
+			if errors.Is(err, secrets.ErrNoKey) {
+				log.Fatalf("Rotation failed, nothing changed: %v (set RS_MASTER_KEY_OLD to the key in use)", err)
+			}
+			if err != nil {
+				log.Fatalf("Rotation failed, nothing changed: %v", err)
+			}
+			if to == nil {
+				fmt.Printf("Decrypted secrets of %d target(s) and secrets store entries\n", n)
+				return
+			}
+			fmt.Printf("Re-encrypted secrets of %d target(s) and secrets store entries with key %s\n", n, to.ID())
+		},
+	}
+	rotateCmd.Flags().BoolVar(&decrypt, "decrypt", false, "Store the secrets unencrypted instead")
+
+	setCmd := &cobra.Command{
+		Use:   "set <name>",
+		Short: "Create or replace an entry of the secrets store, reading the value from stdin",
+		Long: `Create or replace an entry of the secrets store. The value is read from
+stdin, without its trailing newline, so it stays out of the shell history.
+Reference it from a probe config as ${secret:<name>}.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatalf("Failed to read the value: %v", err)
+			}
+			db := openSecretsDB()
+			defer db.Close()
+			if err := db.SetSecret(args[0], strings.TrimRight(string(data), "\r\n")); err != nil {
+				log.Fatalf("Failed to save secret: %v", err)
+			}
+			fmt.Printf("Secret %s saved\n", args[0])
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the entries of the secrets store (names only)",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := openSecretsDB()
+			defer db.Close()
+			list, err := db.ListSecrets()
+			if err != nil {
+				log.Fatalf("Failed to list secrets: %v", err)
+			}
+			for _, s := range list {
+				fmt.Printf("%-32s updated %s\n", s.Name, s.UpdatedAt.Format(time.RFC3339))
+			}
+		},
+	}
+
+	var force bool
+	deleteCmd := &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete an entry of the secrets store",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			db := openSecretsDB()
+			defer db.Close()
+			if !force {
+				users, err := db.SecretUsers(args[0])
+				if err != nil {
+					log.Fatalf("Failed to check references: %v", err)
+				}
+				if len(users) > 0 {
+					log.Fatalf("Secret %s is referenced by %s; pass --force to delete it anyway", args[0], strings.Join(users, ", "))
+				}
+			}
+			if err := db.DeleteSecret(args[0]); err != nil {
+				log.Fatalf("Failed to delete secret %s: %v", args[0], err)
+			}
+			fmt.Printf("Secret %s deleted\n", args[0])
+		},
+	}
+	deleteCmd.Flags().BoolVar(&force, "force", false, "Delete even if targets reference it")
+
+	secretsCmd.AddCommand(rotateCmd, setCmd, listCmd, deleteCmd)
+	return secretsCmd
+}
+
+// openSecretsDB opens the database with the master key from the environment,
+// so store entries are encrypted and decrypted like the running service does
+func openSecretsDB() *storage.DB {
+	box, err := secrets.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid master key: %v", err)
+	}
+	db, err := storage.NewDB(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open DB: %v", err)
+	}
+	db.SetSecretBox(box)
+	db.SetSecretKeys(prober.SecretKeys)
+	return db
+}
@@ -0,0 +1,157 @@
+package monitor
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/prober"
+	"github.com/yuanweize/RouteLens/pkg/push"
+)
+
+// Probe runs, the probe label of the probe metrics
+const (
+	probePing  = "ping"  // Ping only
+	probeTrace = "trace" // Ping and route trace
+	probeHTTP  = "http"  // Request timing, part of a ping run
+	probeDNS   = "dns"   // DNS query, part of a ping run
+	probeSpeed = "speed" // Bandwidth test
+)
+
+// Failure classes, the class label of the probe failure metrics
+const (
+	failTimeout     = "timeout"
+	failConfig      = "config"
+	failUnreachable = "unreachable"
+	failRefused     = "refused"
+	failResolve     = "resolve"
+	failAuth        = "auth"
+	failError       = "error"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the probe duration
+// histogram
+var DurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// configError marks a probe that could not be built from the target's
+// config, e.g. an unresolved secret reference
+type configError struct{ error }
+
+func (e configError) Unwrap() error { return e.error }
+
+// failureClass sorts a probe error into a failure class
+func failureClass(err error) string {
+	var dnsErr *net.DNSError
+	var cfgErr configError
+	switch {
+	case err == nil:
+		return failError
+	case errors.As(err, &cfgErr):
+		return failConfig
+	case prober.IsTimeout(err):
+		return failTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return failUnreachable
+	case errors.As(err, &dnsErr):
+		return failResolve
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return failAuth
+	}
+	return failError
+}
+
+// Histogram is a snapshot of a duration histogram. Counts[i] is the number
+// of observations up to DurationBuckets[i], cumulative as Prometheus expects.
+type Histogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    float64 // Seconds
+}
+
+// ProbeStats is a snapshot of the probe metrics since the service started
+type ProbeStats struct {
+	Durations map[string]Histogram         // By probe
+	Failures  map[string]map[string]uint64 // By probe, then failure class
+}
+
+// probeMetrics counts probe runs and failures
+type probeMetrics struct {
+	mu        sync.Mutex
+	durations map[string]*Histogram
+	failures  map[string]map[string]uint64
+}
+
+func newProbeMetrics() *probeMetrics {
+	return &probeMetrics{
+		durations: make(map[string]*Histogram),
+		failures:  make(map[string]map[string]uint64),
+	}
+}
+
+// observe records the duration of one probe run
+func (m *probeMetrics) observe(probe string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.durations[probe]
+	if h == nil {
+		h = &Histogram{Counts: make([]uint64, len(DurationBuckets))}
+		m.durations[probe] = h
+	}
+	secs := d.Seconds()
+	for i := sort.SearchFloat64s(DurationBuckets, secs); i < len(DurationBuckets); i++ {
+		h.Counts[i]++
+	}
+	h.Count++
+	h.Sum += secs
+}
+
+// fail records one failed probe run
+func (m *probeMetrics) fail(probe, class string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures[probe] == nil {
+		m.failures[probe] = make(map[string]uint64)
+	}
+	m.failures[probe][class]++
+}
+
+func (m *probeMetrics) snapshot() ProbeStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := ProbeStats{
+		Durations: make(map[string]Histogram, len(m.durations)),
+		Failures:  make(map[string]map[string]uint64, len(m.failures)),
+	}
+	for probe, h := range m.durations {
+		st.Durations[probe] = Histogram{Counts: append([]uint64(nil), h.Counts...), Count: h.Count, Sum: h.Sum}
+	}
+	for probe, classes := range m.failures {
+		st.Failures[probe] = make(map[string]uint64, len(classes))
+		for class, n := range classes {
+			st.Failures[probe][class] = n
+		}
+	}
+	return st
+}
+
+// ProbeStats returns a snapshot of the probe durations and failures
+func (s *Service) ProbeStats() ProbeStats {
+	return s.metrics.snapshot()
+}
+
+// SetPusher forwards every record saved from now on to p. Call it before
+// Start.
+func (s *Service) SetPusher(p *push.Pusher) {
+	s.pusher = p
+}
+
+// PushStats returns a snapshot of the push sinks, if any
+func (s *Service) PushStats() []push.SinkStats {
+	return s.pusher.Stats()
+}
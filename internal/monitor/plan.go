@@ -0,0 +1,182 @@
+package monitor
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/logging"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+// Intervals are the probe intervals of a target. The global Intervals apply
+// to targets that don't set their own.
+type Intervals struct {
+	Ping  time.Duration
+	Trace time.Duration // 0 = trace on every ping
+	Speed time.Duration
+}
+
+// planTick is how often the planner looks for due probes
+const planTick = time.Second
+
+// targetPlan tracks when each probe of a target is next due
+type targetPlan struct {
+	every     Intervals // Effective intervals of the target
+	nextPing  time.Time
+	nextTrace time.Time // Traces run with the first ping at or after this time
+	nextSpeed time.Time
+}
+
+// defaultIntervals returns the global intervals used until settings change them
+func defaultIntervals() Intervals {
+	return Intervals{
+		Ping:  time.Duration(envInt("RS_PROBE_INTERVAL", 30)) * time.Second,
+		Speed: 5 * time.Minute,
+	}
+}
+
+// effectiveIntervals resolves t's own intervals against the global ones
+func effectiveIntervals(t storage.Target, global Intervals) Intervals {
+	every := global
+	if t.PingIntervalSec > 0 {
+		every.Ping = time.Duration(t.PingIntervalSec) * time.Second
+	}
+	if t.TraceIntervalSec > 0 {
+		every.Trace = time.Duration(t.TraceIntervalSec) * time.Second
+	}
+	if t.SpeedIntervalSec > 0 {
+		every.Speed = time.Duration(t.SpeedIntervalSec) * time.Second
+	}
+	if every.Trace < every.Ping {
+		every.Trace = every.Ping // Traces ride along with pings
+	}
+	return every
+}
+
+// jitter returns a random offset in [0, d) so that targets sharing an
+// interval don't all fire in the same second
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// advance moves a due time forward by whole intervals until it is after now,
+// skipping runs missed while the process was busy or suspended
+func advance(next time.Time, every time.Duration, now time.Time) time.Time {
+	if every <= 0 || next.After(now) {
+		return next
+	}
+	missed := now.Sub(next) / every
+	return next.Add((missed + 1) * every)
+}
+
+// Intervals returns the global probe intervals
+func (s *Service) Intervals() Intervals {
+	s.targetsMu.RLock()
+	defer s.targetsMu.RUnlock()
+	return s.intervals
+}
+
+// SetIntervals changes the global probe intervals. Targets without their own
+// intervals are re-planned right away.
+func (s *Service) SetIntervals(iv Intervals) {
+	s.targetsMu.Lock()
+	s.intervals = iv
+	s.replanLocked(time.Now())
+	s.targetsMu.Unlock()
+	logging.Info("monitor", "Probe intervals updated: ping=%v trace=%v speed=%v", iv.Ping, iv.Trace, iv.Speed)
+}
+
+// ApplySettings adopts the probe intervals of the system settings
+func (s *Service) ApplySettings(st storage.SystemSettings) {
+	s.SetIntervals(Intervals{
+		Ping:  time.Duration(st.PingInterval) * time.Second,
+		Trace: time.Duration(st.TraceInterval) * time.Second,
+		Speed: time.Duration(st.SpeedTestInterval) * time.Minute,
+	})
+}
+
+// DefaultSettings returns the settings a fresh database starts with, using
+// the intervals the service was created with
+func (s *Service) DefaultSettings() storage.SystemSettings {
+	iv := s.Intervals()
+	return storage.SystemSettings{
+		RetentionDays:     30,
+		SpeedTestInterval: int(iv.Speed / time.Minute),
+		PingInterval:      int(iv.Ping / time.Second),
+		TraceInterval:     int(iv.Trace / time.Second),
+	}
+}
+
+// replanLocked updates the plans after targets or intervals changed. Probes
+// whose interval is unchanged keep their due time; new ones start at a random
+// offset within their interval. The caller must hold targetsMu.
+func (s *Service) replanLocked(now time.Time) {
+	plans := make(map[string]*targetPlan, len(s.targets))
+	for _, t := range s.targets {
+		if !t.Enabled {
+			continue
+		}
+		every := effectiveIntervals(t, s.intervals)
+		p, ok := s.plans[t.Address]
+		if !ok {
+			p = &targetPlan{nextTrace: now} // First ping of a new target traces
+		}
+		if p.every.Ping != every.Ping {
+			p.nextPing = now.Add(jitter(every.Ping))
+		}
+		if ok && p.every.Trace != every.Trace {
+			p.nextTrace = now
+		}
+		if p.every.Speed != every.Speed {
+			p.nextSpeed = now.Add(jitter(every.Speed))
+		}
+		p.every = every
+		plans[t.Address] = p
+	}
+	s.plans = plans
+}
+
+// runDue queues every probe that is due at now
+func (s *Service) runDue(now time.Time) {
+	type pingRun struct {
+		target storage.Target
+		trace  bool
+	}
+	var pings []pingRun
+	var speeds []storage.Target
+
+	s.targetsMu.Lock()
+	for _, t := range s.targets {
+		p := s.plans[t.Address]
+		if p == nil {
+			continue // Disabled
+		}
+		if !now.Before(p.nextPing) {
+			trace := !now.Before(p.nextTrace)
+			p.nextPing = advance(p.nextPing, p.every.Ping, now)
+			if trace {
+				p.nextTrace = advance(p.nextTrace, p.every.Trace, now)
+			}
+			pings = append(pings, pingRun{t, trace})
+		}
+		if isSpeedTarget(t) && !now.Before(p.nextSpeed) {
+			p.nextSpeed = advance(p.nextSpeed, p.every.Speed, now)
+			speeds = append(speeds, t)
+		}
+	}
+	s.targetsMu.Unlock()
+
+	if len(pings) > 0 {
+		logging.Debug("monitor", "%d ping/trace probes due", len(pings))
+	}
+	for _, r := range pings {
+		s.schedulePingTrace(r.target, r.trace)
+	}
+	for _, t := range speeds {
+		logging.Info("speedtest", "Queuing speed test: %s (%s) [%s]", t.Name, t.Address, t.ProbeType)
+		s.scheduleSpeed(t)
+	}
+}
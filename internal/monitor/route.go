@@ -0,0 +1,82 @@
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/logging"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+// routeOf reduces a trace to its path: the ordered hop IPs and ASNs, without
+// the unanswered hops at the end (which vary with how long the trace waited),
+// and a fingerprint identifying it. The fingerprint leaves the ASNs out, as
+// only the mtr binary reports them and switching engines is no reroute.
+// Unanswered hops in between stay in as "*"; storage.ObserveRoute matches
+// them against any hop. ok is false if no hop answered.
+func routeOf(trace *tracePayload) (fingerprint string, hops []storage.RouteHop, ok bool) {
+	if trace == nil {
+		return "", nil, false
+	}
+	for _, h := range trace.Hops {
+		hop := storage.RouteHop{TTL: h.Hop, IP: h.IP, ASN: h.ASN}
+		if hop.IP == "*" {
+			hop.IP = ""
+		}
+		hops = append(hops, hop)
+	}
+	for len(hops) > 0 && hops[len(hops)-1].IP == "" {
+		hops = hops[:len(hops)-1]
+	}
+	if len(hops) == 0 {
+		return "", nil, false
+	}
+
+	var b strings.Builder
+	for _, h := range hops {
+		ip := h.IP
+		if ip == "" {
+			ip = "*"
+		}
+		fmt.Fprintf(&b, "%d:%s;", h.TTL, ip)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:]), hops, true
+}
+
+// trackRoute records the path a trace of t took and reports reroutes
+func (s *Service) trackRoute(t storage.Target, trace *tracePayload, at time.Time) {
+	fingerprint, hops, ok := routeOf(trace)
+	if !ok {
+		return
+	}
+	change, err := s.db.ObserveRoute(t, fingerprint, hops, at)
+	if err != nil {
+		logging.Error("route", "Failed to record path for %s: %v", t.Name, err)
+		return
+	}
+	if change == nil {
+		return
+	}
+
+	logging.Warn("route", "Route changed for %s (%s): %d hop(s) differ", t.Name, t.Address, len(change.Diff))
+	for _, d := range change.Diff {
+		logging.Info("route", "  hop %d: %s -> %s", d.TTL, describeHop(d.From), describeHop(d.To))
+	}
+}
+
+func describeHop(h storage.RouteHop) string {
+	switch {
+	case h.TTL == 0:
+		return "(none)"
+	case h.IP == "":
+		return "*"
+	case h.ASN != "":
+		return h.IP + " (" + h.ASN + ")"
+	default:
+		return h.IP
+	}
+}
@@ -0,0 +1,150 @@
+package monitor
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/yuanweize/RouteLens/pkg/logging"
+)
+
+// Default pool sizes, overridden by RS_PROBE_WORKERS and RS_SPEED_WORKERS.
+// Speed tests saturate the link, so few of them should run side by side.
+const (
+	defaultProbeWorkers = 16
+	defaultSpeedWorkers = 2
+)
+
+// probePool bounds how many probes run at once and never runs two probes of
+// the same target at the same time: a tick that finds the previous run of a
+// target still queued or running skips it.
+type probePool struct {
+	name    string
+	workers int
+	sem     chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]bool   // Targets queued or running, by address
+	skipped map[string]uint64 // Skipped runs per target address
+	active  int
+	total   uint64 // Skipped runs across all targets
+}
+
+// PoolStats is a snapshot of a probe pool
+type PoolStats struct {
+	Name    string            `json:"name"`
+	Workers int               `json:"workers"`
+	Active  int               `json:"active"`  // Probes running
+	Queued  int               `json:"queued"`  // Probes waiting for a worker
+	Skipped uint64            `json:"skipped"` // Runs skipped because the previous one had not finished
+	Targets map[string]uint64 `json:"skipped_by_target,omitempty"`
+}
+
+func newProbePool(name string, workers int) *probePool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &probePool{
+		name:    name,
+		workers: workers,
+		sem:     make(chan struct{}, workers),
+		pending: make(map[string]bool),
+		skipped: make(map[string]uint64),
+	}
+}
+
+// claim reserves a slot in the queue for key. It returns false, counting a
+// skipped run, when a probe for key is already queued or running.
+func (p *probePool) claim(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending[key] {
+		p.skipped[key]++
+		p.total++
+		return false
+	}
+	p.pending[key] = true
+	return true
+}
+
+// release frees the queue slot reserved by claim
+func (p *probePool) release(key string) {
+	p.mu.Lock()
+	delete(p.pending, key)
+	p.mu.Unlock()
+}
+
+// run waits for a free worker and runs fn on it. It gives up without running
+// fn when ctx is done first.
+func (p *probePool) run(ctx context.Context, fn func()) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	p.mu.Lock()
+	p.active++
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+		<-p.sem
+	}()
+	fn()
+}
+
+func (p *probePool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := PoolStats{
+		Name:    p.name,
+		Workers: p.workers,
+		Active:  p.active,
+		Queued:  len(p.pending) - p.active,
+		Skipped: p.total,
+	}
+	if len(p.skipped) > 0 {
+		st.Targets = make(map[string]uint64, len(p.skipped))
+		for k, v := range p.skipped {
+			st.Targets[k] = v
+		}
+	}
+	return st
+}
+
+// schedule queues fn on pool for target address key, unless a run for that
+// target is still queued or running there
+func (s *Service) schedule(pool *probePool, key string, fn func()) {
+	if !pool.claim(key) {
+		logging.Warn("monitor", "[%s] Previous run for %s still in progress, skipping", pool.name, key)
+		return
+	}
+	started := s.goProbe(func() {
+		defer pool.release(key)
+		pool.run(s.ctx, fn)
+	})
+	if !started {
+		pool.release(key)
+	}
+}
+
+// SchedulerStats returns a snapshot of the probe pools
+func (s *Service) SchedulerStats() []PoolStats {
+	return []PoolStats{s.pingPool.stats(), s.speedPool.stats()}
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		logging.Warn("monitor", "Invalid %s=%q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
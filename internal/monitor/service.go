@@ -1,7 +1,9 @@
 package monitor
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,27 +18,54 @@ import (
 	"github.com/yuanweize/RouteLens/pkg/geoip"
 	"github.com/yuanweize/RouteLens/pkg/logging"
 	"github.com/yuanweize/RouteLens/pkg/prober"
+	"github.com/yuanweize/RouteLens/pkg/push"
+	"github.com/yuanweize/RouteLens/pkg/secrets"
 	"github.com/yuanweize/RouteLens/pkg/storage"
 )
 
 type Service struct {
 	db              *storage.DB
 	targets         []storage.Target
-	targetsMu       sync.RWMutex // Protects targets slice
-	pingTicker      *time.Ticker
-	speedTicker     *time.Ticker
+	targetsMu       sync.RWMutex // Protects targets, intervals and plans
+	intervals       Intervals    // Global probe intervals
+	plans           map[string]*targetPlan
+	planTicker      *time.Ticker
 	refreshTicker   *time.Ticker
 	heartbeatTicker *time.Ticker
 	stopChan        chan struct{}
 	geoProvider     *geoip.Provider
+
+	// ctx is cancelled by Stop so that in-flight probes return promptly
+	ctx    context.Context
+	cancel context.CancelFunc
+	probes sync.WaitGroup // In-flight probe goroutines
+
+	pingPool  *probePool // Ping/trace and other lightweight probes
+	speedPool *probePool // Bandwidth tests
+	metrics   *probeMetrics
+	pusher    *push.Pusher // Forwards saved records to external backends; nil when none are configured
 }
 
+// Default deadlines for one probe run, overridden per target by Target.TimeoutSec
+const (
+	defaultPingTraceTimeout = 90 * time.Second
+	defaultSpeedTimeout     = 3 * time.Minute
+	stopTimeout             = 10 * time.Second // How long Stop waits for probes to return
+)
+
 func NewService(db *storage.DB) *Service {
 	geoProvider := initGeoProvider()
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Service{
 		db:          db,
 		stopChan:    make(chan struct{}),
 		geoProvider: geoProvider,
+		ctx:         ctx,
+		cancel:      cancel,
+		intervals:   defaultIntervals(),
+		pingPool:    newProbePool("ping", envInt("RS_PROBE_WORKERS", defaultProbeWorkers)),
+		speedPool:   newProbePool("speed", envInt("RS_SPEED_WORKERS", defaultSpeedWorkers)),
+		metrics:     newProbeMetrics(),
 	}
 	s.refreshTargets() // Initial load
 	return s
@@ -50,31 +79,100 @@ func (s *Service) refreshTargets() {
 	}
 	s.targetsMu.Lock()
 	s.targets = targets
+	s.replanLocked(time.Now())
 	s.targetsMu.Unlock()
 }
 
+// Reload re-reads the targets so that changes take effect without waiting
+// for the next periodic refresh
+func (s *Service) Reload() {
+	s.refreshTargets()
+}
+
 func (s *Service) Start() {
-	s.pingTicker = time.NewTicker(30 * time.Second)
-	s.speedTicker = time.NewTicker(5 * time.Minute) // Speed tests every 5 minutes
+	s.planTicker = time.NewTicker(planTick)
 	s.refreshTicker = time.NewTicker(1 * time.Minute)
 	s.heartbeatTicker = time.NewTicker(60 * time.Second) // Heartbeat every 60s
 
-	// Run initial cycles immediately on startup
-	go func() {
-		time.Sleep(2 * time.Second) // Wait for service to fully initialize
-		logging.Info("monitor", "Running initial probe cycle on startup...")
-		s.runPingTraceCycle()
-		s.runSpeedCycle()
-	}()
+	// First runs are spread over each target's interval by the planner
+	iv := s.Intervals()
+	logging.Info("monitor", "Probe intervals: ping=%v trace=%v speed=%v", iv.Ping, iv.Trace, iv.Speed)
 
 	go s.runLoop()
 }
 
 func (s *Service) Stop() {
+	s.cancel()
+	close(s.stopChan)
+
+	done := make(chan struct{})
+	go func() {
+		s.probes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		logging.Warn("monitor", "Probes still running %v after stop, giving up waiting", stopTimeout)
+	}
+
+	// Close after probes are done, as traces still resolve hop locations
 	if s.geoProvider != nil {
 		s.geoProvider.Close()
 	}
-	close(s.stopChan)
+}
+
+// goProbe runs fn in a tracked goroutine unless the service is stopping.
+// It reports whether fn was started.
+func (s *Service) goProbe(fn func()) bool {
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.probes.Add(1)
+	go func() {
+		defer s.probes.Done()
+		fn()
+	}()
+	return true
+}
+
+// schedulePingTrace queues a ping run of t on the ping pool, tracing the
+// route too when trace is set
+func (s *Service) schedulePingTrace(t storage.Target, trace bool) {
+	s.schedule(s.pingPool, t.Address, func() { s.runPingTraceForTarget(t, trace) })
+}
+
+// scheduleSpeed queues a speed test of t on the speed pool
+func (s *Service) scheduleSpeed(t storage.Target) {
+	s.schedule(s.speedPool, t.Address, func() { s.runSpeedForTarget(t) })
+}
+
+// probeContext derives the deadline for one probe run of t: its own
+// TimeoutSec when set, def otherwise
+func (s *Service) probeContext(t storage.Target, def time.Duration) (context.Context, context.CancelFunc, time.Duration) {
+	timeout := def
+	if t.TimeoutSec > 0 {
+		timeout = time.Duration(t.TimeoutSec) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	return ctx, cancel, timeout
+}
+
+// reportProbeError stores msg on the target, or a timeout when err is one,
+// and counts the failure of the probe run. Probes cancelled by Stop leave
+// the target untouched.
+func (s *Service) reportProbeError(t storage.Target, probe string, timeout time.Duration, err error, msg string) {
+	switch {
+	case prober.IsTimeout(err):
+		logging.Warn("probe", "[%s] Probe for %s timed out after %v", t.ProbeType, t.Name, timeout)
+		s.db.UpdateTargetTimeout(t.ID, fmt.Sprintf("Timed out after %v", timeout))
+	case errors.Is(err, context.Canceled):
+		logging.Debug("probe", "[%s] Probe for %s cancelled", t.ProbeType, t.Name)
+		return
+	default:
+		s.db.UpdateTargetError(t.ID, msg)
+	}
+	s.metrics.fail(probe, failureClass(err))
 }
 
 func (s *Service) runLoop() {
@@ -82,10 +180,8 @@ func (s *Service) runLoop() {
 	logging.Info("monitor", "Monitor Service Started")
 	for {
 		select {
-		case <-s.pingTicker.C:
-			s.runPingTraceCycle()
-		case <-s.speedTicker.C:
-			s.runSpeedCycle()
+		case now := <-s.planTicker.C:
+			s.runDue(now)
 		case <-s.refreshTicker.C:
 			s.refreshTargets()
 		case <-s.heartbeatTicker.C:
@@ -101,151 +197,189 @@ func (s *Service) runLoop() {
 	}
 }
 
-func (s *Service) runPingTraceCycle() {
-	// Ping/Trace is common for almost all modes except maybe pure HTTP?
-	// User said "Mode A: ICMP/MTR Only (默认)": 仅监控延迟和丢包。
-	// So we keep ICMP/Trace as a baseline.
-	s.targetsMu.RLock()
-	targetsCopy := make([]storage.Target, len(s.targets))
-	copy(targetsCopy, s.targets)
-	s.targetsMu.RUnlock()
-
-	enabledTargets := 0
-	for _, target := range targetsCopy {
-		if !target.Enabled {
-			continue // Skip disabled targets
-		}
-		enabledTargets++
-		go s.runPingTraceForTarget(target)
-	}
-	logging.Info("monitor", "Starting ping/trace cycle for %d targets (total: %d)", enabledTargets, len(targetsCopy))
-}
-
-func (s *Service) runSpeedCycle() {
-	s.targetsMu.RLock()
-	targetsCopy := make([]storage.Target, len(s.targets))
-	copy(targetsCopy, s.targets)
-	s.targetsMu.RUnlock()
+func (s *Service) runPingTraceForTarget(t storage.Target, trace bool) {
+	logging.Debug("probe", "[MTR] Starting probe for %s (%s)", t.Name, t.Address)
 
-	speedTargets := []storage.Target{}
-	for _, target := range targetsCopy {
-		if !target.Enabled {
-			continue // Skip disabled targets
-		}
-		if target.ProbeType == storage.ProbeModeICMP || target.ProbeType == "" {
-			continue // No speed test for ICMP only mode
-		}
-		speedTargets = append(speedTargets, target)
-	}
+	ctx, cancel, timeout := s.probeContext(t, defaultPingTraceTimeout)
+	defer cancel()
 
-	if len(speedTargets) == 0 {
-		logging.Debug("speedtest", "No speed test targets configured (all targets are ICMP-only)")
-		return
+	probe := probePing
+	if trace {
+		probe = probeTrace
 	}
-
-	logging.Info("speedtest", "=== Starting speed test cycle for %d targets ===", len(speedTargets))
-	for _, target := range speedTargets {
-		logging.Info("speedtest", "Queuing speed test: %s (%s) [%s]", target.Name, target.Address, target.ProbeType)
-		go s.runSpeedForTarget(target)
+	defer func(start time.Time) {
+		if s.ctx.Err() == nil {
+			s.metrics.observe(probe, time.Since(start))
+		}
+	}(time.Now())
+
+	family := targetFamily(t)
+	// Independent of reachability over ICMP, so run them before the ping can
+	// bail out, and before a slow trace can use up the deadline
+	var timing *prober.HTTPTimingResult
+	switch probeKind(t) {
+	case prober.KindDNS:
+		s.runDNSForTarget(ctx, t, timeout)
+	case prober.KindTiming:
+		timing = s.runTimingForTarget(ctx, t, timeout)
+	}
+	traceOpts, err := prober.ParseTraceOptions(t.ProbeConfig)
+	if err != nil {
+		logging.Warn("probe", "[MTR] Invalid trace options for %s, using ICMP: %v", t.Name, err)
+		traceOpts = prober.TraceOptions{Method: prober.TraceICMP}
 	}
-}
-
-func (s *Service) runPingTraceForTarget(t storage.Target) {
-	logging.Debug("probe", "[MTR] Starting probe for %s (%s)", t.Name, t.Address)
 
 	// 1. Ping (fallback latency)
-	pinger := prober.NewICMPPinger(t.Address, 5)
-	pingRes, err := pinger.Run()
+	pingRes, latencySource, err := s.measureLatency(ctx, t, family)
+	if timing != nil && ctx.Err() == nil && (err != nil || pingRes.PacketsRecv == 0) {
+		// The host drops ICMP but served the request: the TCP handshake stands in
+		logging.Debug("probe", "[%s] ICMP unavailable for %s, using the request's connect time: %v", t.ProbeType, t.Name, err)
+		pingRes, latencySource, err = timingLatency(timing), t.ProbeType, nil
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			s.reportProbeError(t, probe, timeout, ctx.Err(), "")
+			return
+		}
+		s.metrics.fail(probe, failureClass(err))
 		log.Printf("Ping failed for %s: %v", t.Name, err)
 		logging.Error("probe", "[ICMP] Ping failed for %s (%s): %v", t.Name, t.Address, err)
 		return
 	}
-	logging.Info("probe", "[ICMP] Ping OK for %s: latency=%.1fms, loss=%.1f%%", t.Name, float64(pingRes.AvgRtt.Microseconds())/1000.0, pingRes.LossRate)
+	logging.Info("probe", "[%s] Ping OK for %s (%s %s): latency=%.1fms, loss=%.1f%%", latencySource, t.Name, pingRes.Family, pingRes.Addr, float64(pingRes.AvgRtt.Microseconds())/1000.0, pingRes.LossRate)
 
-	// 2. MTR (preferred) or Traceroute
+	// 2. MTR (preferred) or Traceroute, unless only a ping is due
+	var route *tracePayload
 	var traceBytes []byte
 	latencyMs := float64(pingRes.AvgRtt.Microseconds()) / 1000.0 // Use Microseconds for sub-ms precision
 	packetLoss := pingRes.LossRate
 
-	if mtrRes, mtrErr := prober.NewMTRRunner(t.Address).Run(); mtrErr == nil && mtrRes != nil && len(mtrRes.Hops) > 0 {
-		selectedLatency, truncated := selectTargetLatency(mtrRes, latencyMs)
-		traceBytes = s.serializeTraceFromMTR(mtrRes, truncated)
-		latencyMs = selectedLatency
-		packetLoss = selectTargetLoss(mtrRes, packetLoss)
-		logging.Info("probe", "[MTR] Trace complete for %s: %d hops, latency=%.1fms", t.Name, len(mtrRes.Hops), latencyMs)
+	if trace {
+		spec := traceSpec(t, family, traceOpts)
+		if mtrRes, mtrErr := runMTR(ctx, spec, traceOpts); mtrErr == nil && mtrRes != nil && len(mtrRes.Hops) > 0 {
+			selectedLatency, truncated := selectTargetLatency(mtrRes, latencyMs)
+			route = s.traceFromMTR(mtrRes, truncated)
+			// A fallback probe (e.g. TCP) answered where ICMP did not: keep its
+			// numbers instead of the hops of a trace that never reached the target
+			if latencySource == prober.ModeICMP {
+				latencyMs = selectedLatency
+				packetLoss = selectTargetLoss(mtrRes, packetLoss)
+			}
+			logging.Info("probe", "[MTR] Trace complete for %s: %d hops, latency=%.1fms", t.Name, len(mtrRes.Hops), latencyMs)
+		} else {
+			if mtrErr != nil {
+				log.Printf("MTR unavailable for %s: %v", t.Name, mtrErr)
+				logging.Warn("probe", "[MTR] Fallback to traceroute for %s: %v", t.Name, mtrErr)
+			}
+			var traceRes *prober.TraceResult
+			if res, err := runTracer(ctx, prober.TracerTraceroute, spec); err == nil {
+				traceRes = res.Trace
+			}
+			route = s.traceFromTraceroute(traceRes)
+		}
+		traceBytes = marshalTrace(route)
+	}
+	if err := ctx.Err(); err != nil {
+		s.reportProbeError(t, probe, timeout, err, "") // Partial traces are not worth a record
+		return
+	}
+
+	now := time.Now()
+	rec := &storage.LatencyRecord{
+		TargetID:      t.ID,
+		Target:        t.Address,
+		CreatedAt:     now,
+		LatencyMs:     latencyMs,
+		PacketLoss:    packetLoss,
+		IPFamily:      string(pingRes.Family),
+		LatencySource: latencySource,
+	}
+	if timing != nil {
+		rec.HTTPStatus = timing.StatusCode
+		rec.HTTPDNSMs = durationMs(timing.DNS)
+		rec.HTTPConnectMs = durationMs(timing.Connect)
+		rec.HTTPTLSMs = durationMs(timing.TLS)
+		rec.HTTPTTFBMs = durationMs(timing.TTFB)
+		rec.HTTPTotalMs = durationMs(timing.Total)
+	}
+	if err := s.db.SaveLatency(rec); err != nil {
+		log.Printf("Failed to save record for %s: %v", t.Name, err)
 	} else {
-		if mtrErr != nil {
-			log.Printf("MTR unavailable for %s: %v", t.Name, mtrErr)
-			logging.Warn("probe", "[MTR] Fallback to traceroute for %s: %v", t.Name, mtrErr)
+		s.pusher.Publish(push.Record{TargetName: t.Name, ProbeType: t.ProbeType, Latency: rec})
+	}
+	if len(traceBytes) > 0 {
+		if err := s.db.SaveTrace(&storage.TraceRecord{TargetID: t.ID, Target: t.Address, CreatedAt: now, TraceJson: traceBytes}); err != nil {
+			log.Printf("Failed to save trace for %s: %v", t.Name, err)
 		}
-		traceRunner := prober.NewTracerouteRunner(t.Address)
-		traceRes, _ := traceRunner.Run()
-		traceBytes = s.serializeTraceFromTraceroute(traceRes)
+		s.trackRoute(t, route, now)
 	}
+}
 
-	rec := &storage.MonitorRecord{
-		Target:     t.Address,
-		CreatedAt:  time.Now(),
-		LatencyMs:  latencyMs,
-		PacketLoss: packetLoss,
-		TraceJson:  traceBytes,
-		SpeedUp:    0,
-		SpeedDown:  0,
+// runTimingForTarget runs the target's request timing probe and returns the
+// phases, or nil on failure. Failures are reported on the target like speed
+// test errors.
+func (s *Service) runTimingForTarget(ctx context.Context, t storage.Target, timeout time.Duration) *prober.HTTPTimingResult {
+	var res *prober.Result
+	p, err := s.newProber(t)
+	if err == nil {
+		res, err = p.Run(ctx)
 	}
-	if err := s.db.SaveRecord(rec); err != nil {
-		log.Printf("Failed to save record for %s: %v", t.Name, err)
+	if err == nil && res.HTTP == nil {
+		err = errors.New("no timing result")
+	}
+	if err != nil {
+		log.Printf("HTTP timing failed for %s: %v", t.Name, err)
+		logging.Error("probe", "[%s] HTTP timing failed for %s: %v", t.ProbeType, t.Name, err)
+		s.reportProbeError(t, probeHTTP, timeout, err, fmt.Sprintf("HTTP: %v", err))
+		return nil
+	}
+	s.db.ClearTargetError(t.ID)
+
+	h := res.HTTP
+	logging.Info("probe", "[%s] %s %d: dns=%.1fms connect=%.1fms tls=%.1fms ttfb=%.1fms total=%.1fms",
+		t.ProbeType, t.Name, h.StatusCode, durationMs(h.DNS), durationMs(h.Connect), durationMs(h.TLS), durationMs(h.TTFB), durationMs(h.Total))
+	return h
+}
+
+// timingLatency turns a request's TCP handshake into a one-packet ping, for
+// hosts that serve requests but drop ICMP
+func timingLatency(h *prober.HTTPTimingResult) *prober.PingResult {
+	return &prober.PingResult{
+		PacketsSent: 1,
+		PacketsRecv: 1,
+		MinRtt:      h.Connect,
+		MaxRtt:      h.Connect,
+		AvgRtt:      h.Connect,
+		Timestamp:   h.Timestamp,
+		Family:      h.Family,
+		Addr:        h.Addr,
 	}
 }
 
 func (s *Service) runSpeedForTarget(t storage.Target) {
 	var speedRes *prober.SpeedResult
-	var err error
-	var configErr error
 
 	logging.Info("speedtest", "[%s] >>> Starting speed test for %s (%s)", t.ProbeType, t.Name, t.Address)
 
-	switch t.ProbeType {
-	case storage.ProbeModeSSH:
-		logging.Info("speedtest", "[SSH] Parsing SSH config for %s...", t.Name)
-		sshCfg, cfgErr := parseSSHConfig(t.ProbeConfig)
-		if cfgErr != nil {
-			configErr = cfgErr
-			log.Printf("Invalid SSH config for %s: %v", t.Name, cfgErr)
-			logging.Error("speedtest", "[SSH] Invalid config for %s: %v", t.Name, cfgErr)
-			s.db.UpdateTargetError(t.Address, fmt.Sprintf("Config error: %v", cfgErr))
-			return
-		}
-		sshCfg.Host = t.Address
-		logging.Info("speedtest", "[SSH] Connecting to %s@%s:%d...", sshCfg.User, sshCfg.Host, sshCfg.Port)
-		runner := prober.NewSSHSpeedTester(sshCfg)
-		speedRes, err = runner.Run()
-
-	case storage.ProbeModeHTTP:
-		url, cfgErr := parseHTTPConfig(t.ProbeConfig)
-		if cfgErr != nil {
-			configErr = cfgErr
-			log.Printf("Invalid HTTP config for %s: %v", t.Name, cfgErr)
-			s.db.UpdateTargetError(t.Address, fmt.Sprintf("Config error: %v", cfgErr))
-			return
-		}
-		runner := prober.NewHTTPSpeedTester(url)
-		speedRes, err = runner.Run()
-
-	case storage.ProbeModeIPERF:
-		port := 5201
-		cfgPort, cfgErr := parseIperfConfig(t.ProbeConfig)
-		if cfgErr != nil {
-			configErr = cfgErr
-			log.Printf("Invalid IPERF config for %s: %v", t.Name, cfgErr)
-			s.db.UpdateTargetError(t.Address, fmt.Sprintf("Config error: %v", cfgErr))
-			return
-		}
-		if cfgPort != 0 {
-			port = cfgPort
+	ctx, cancel, timeout := s.probeContext(t, defaultSpeedTimeout)
+	defer cancel()
+	defer func(start time.Time) {
+		if s.ctx.Err() == nil {
+			s.metrics.observe(probeSpeed, time.Since(start))
 		}
-		runner := prober.NewIperfProber(t.Address, port)
-		speedRes, err = runner.Run()
+	}(time.Now())
+
+	p, cfgErr := s.newProber(t)
+	if cfgErr != nil {
+		log.Printf("Invalid %s config for %s: %v", t.ProbeType, t.Name, cfgErr)
+		logging.Error("speedtest", "[%s] Invalid config for %s: %v", t.ProbeType, t.Name, cfgErr)
+		s.db.UpdateTargetError(t.ID, fmt.Sprintf("Config error: %v", cfgErr))
+		s.metrics.fail(probeSpeed, failConfig)
+		return
+	}
+	res, err := p.Run(ctx)
+	if err == nil && res != nil {
+		speedRes = res.Speed
 	}
 
 	// Handle probe errors - store them for UI display
@@ -263,29 +397,29 @@ func (s *Service) runSpeedForTarget(t storage.Target) {
 		}
 		log.Printf("Speed test failed for %s (%s): %v", t.Name, t.ProbeType, err)
 		logging.Error("speedtest", "Speed test failed for %s (%s): %v", t.Name, t.ProbeType, err)
-		s.db.UpdateTargetError(t.Address, errMsg)
+		s.reportProbeError(t, probeSpeed, timeout, err, errMsg)
 		return
 	}
 
 	// Clear error on success and log
-	if configErr == nil && err == nil {
-		s.db.ClearTargetError(t.Address)
-		if speedRes != nil {
-			logging.Info("speedtest", "Speed test completed for %s: Down=%.1f Mbps, Up=%.1f Mbps", t.Name, speedRes.DownloadSpeed, speedRes.UploadSpeed)
-		}
+	s.db.ClearTargetError(t.ID)
+	if speedRes != nil {
+		logging.Info("speedtest", "Speed test completed for %s: Down=%.1f Mbps, Up=%.1f Mbps", t.Name, speedRes.DownloadSpeed, speedRes.UploadSpeed)
 	}
 
 	if speedRes != nil {
-		rec := &storage.MonitorRecord{
-			Target:     t.Address,
-			CreatedAt:  time.Now(),
-			LatencyMs:  0,
-			PacketLoss: 0,
-			SpeedUp:    speedRes.UploadSpeed,
-			SpeedDown:  speedRes.DownloadSpeed,
-		}
-		if err := s.db.SaveRecord(rec); err != nil {
+		rec := &storage.SpeedRecord{
+			TargetID:  t.ID,
+			Target:    t.Address,
+			CreatedAt: time.Now(),
+			ProbeType: t.ProbeType,
+			SpeedUp:   speedRes.UploadSpeed,
+			SpeedDown: speedRes.DownloadSpeed,
+		}
+		if err := s.db.SaveSpeed(rec); err != nil {
 			log.Printf("Failed to save speed record for %s: %v", t.Name, err)
+		} else {
+			s.pusher.Publish(push.Record{TargetName: t.Name, ProbeType: t.ProbeType, Speed: rec})
 		}
 	}
 }
@@ -298,9 +432,9 @@ func (s *Service) TriggerProbe(target string) {
 
 	if target == "" {
 		for _, t := range targetsCopy {
-			go s.runPingTraceForTarget(t)
-			if t.ProbeType != storage.ProbeModeICMP && t.ProbeType != "" {
-				go s.runSpeedForTarget(t)
+			s.schedulePingTrace(t, true)
+			if isSpeedTarget(t) {
+				s.scheduleSpeed(t)
 			}
 		}
 		return
@@ -308,77 +442,204 @@ func (s *Service) TriggerProbe(target string) {
 
 	for _, t := range targetsCopy {
 		if t.Address == target {
-			go s.runPingTraceForTarget(t)
-			if t.ProbeType != storage.ProbeModeICMP && t.ProbeType != "" {
-				go s.runSpeedForTarget(t)
+			s.schedulePingTrace(t, true)
+			if isSpeedTarget(t) {
+				s.scheduleSpeed(t)
 			}
 			return
 		}
 	}
 }
 
-type sshProbeConfig struct {
-	User      string `json:"user"`
-	Password  string `json:"password"`
-	KeyPath   string `json:"key_path"`
-	KeyText   string `json:"key_text"`
-	Port      int    `json:"port"`
-	TestBytes int64  `json:"test_bytes"`
-}
+// runDNSForTarget queries the target's resolvers and stores one record per
+// resolver, flagging answers that differ from that resolver's previous answer
+func (s *Service) runDNSForTarget(ctx context.Context, t storage.Target, timeout time.Duration) {
+	var res *prober.Result
+	p, err := s.newProber(t)
+	if err == nil {
+		res, err = p.Run(ctx)
+	}
+	if err == nil && res.DNS == nil {
+		err = errors.New("no DNS result")
+	}
+	if err != nil {
+		log.Printf("DNS probe failed for %s: %v", t.Name, err)
+		logging.Error("probe", "[%s] DNS probe failed for %s: %v", t.ProbeType, t.Name, err)
+		s.reportProbeError(t, probeDNS, timeout, err, fmt.Sprintf("DNS: %v", err))
+		return
+	}
 
-type httpProbeConfig struct {
-	URL string `json:"url"`
-}
+	d := res.DNS
+	records := make([]storage.DNSRecord, 0, len(d.Answers))
+	var failed []string
+	for _, a := range d.Answers {
+		rec := storage.DNSRecord{
+			CreatedAt: d.Timestamp,
+			TargetID:  t.ID,
+			Target:    t.Address,
+			Resolver:  a.Resolver,
+			Name:      d.Name,
+			QType:     d.Type,
+			Rcode:     a.Rcode,
+			QueryMs:   durationMs(a.QueryTime),
+			Answers:   a.Answers,
+			Error:     a.Err,
+		}
+		if a.Err != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", a.Resolver, a.Err))
+		} else if prev, err := s.db.GetLatestDNSRecord(t.ID, a.Resolver, d.Name, d.Type); err == nil && prev.Error == "" {
+			prevAnswer := prober.DNSAnswer{Rcode: prev.Rcode, Answers: prev.Answers}
+			if prevAnswer.AnswerSet() != a.AnswerSet() {
+				rec.Changed = true
+				logging.Warn("probe", "[DNS] Answer changed for %s %s via %s: %s -> %s",
+					d.Name, d.Type, a.Resolver, prevAnswer.AnswerSet(), a.AnswerSet())
+			}
+		}
+		logging.Debug("probe", "[DNS] %s %s via %s: %s in %.1fms", d.Name, d.Type, a.Resolver, a.Rcode, rec.QueryMs)
+		records = append(records, rec)
+	}
+	if err := s.db.SaveDNSRecords(records); err != nil {
+		log.Printf("Failed to save DNS records for %s: %v", t.Name, err)
+	} else {
+		for i := range records {
+			s.pusher.Publish(push.Record{TargetName: t.Name, ProbeType: t.ProbeType, DNS: &records[i]})
+		}
+	}
 
-type iperfProbeConfig struct {
-	Port int `json:"port"`
+	if len(failed) > 0 {
+		s.db.UpdateTargetError(t.ID, "DNS: "+strings.Join(failed, "; "))
+	} else {
+		s.db.ClearTargetError(t.ID)
+	}
 }
 
-func parseSSHConfig(raw string) (prober.SSHConfig, error) {
-	if raw == "" {
-		return prober.SSHConfig{}, fmt.Errorf("ssh config is required")
+// measureLatency pings the target over ICMP. When ICMP fails or every echo is
+// lost and the target's own probe mode is a latency probe (e.g. MODE_TCP),
+// that probe supplies the result instead. source is the probe mode used.
+func (s *Service) measureLatency(ctx context.Context, t storage.Target, family prober.AddressFamily) (res *prober.PingResult, source string, err error) {
+	var pingRes *prober.PingResult
+	pinger, pingErr := prober.New(prober.ModeICMP, prober.Spec{Address: t.Address, Family: family})
+	if pingErr == nil {
+		var out *prober.Result
+		if out, pingErr = pinger.Run(ctx); pingErr == nil {
+			pingRes = out.Ping
+		}
 	}
-	var cfg sshProbeConfig
-	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
-		return prober.SSHConfig{}, err
+	if pingErr == nil && pingRes.PacketsRecv > 0 {
+		return pingRes, prober.ModeICMP, nil
 	}
-	sshCfg := prober.SSHConfig{
-		User:      cfg.User,
-		Password:  cfg.Password,
-		KeyPath:   cfg.KeyPath,
-		KeyText:   cfg.KeyText,
-		Port:      cfg.Port,
-		TestBytes: cfg.TestBytes,
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
 	}
-	if sshCfg.Port == 0 {
-		sshCfg.Port = 22
+
+	d, ok := prober.Lookup(t.ProbeType)
+	if !ok || d.Kind != prober.KindLatency || d.Type == prober.ModeICMP {
+		return pingRes, prober.ModeICMP, pingErr
 	}
-	if sshCfg.TestBytes == 0 {
-		sshCfg.TestBytes = 20 * 1024 * 1024
+	fallback, err := s.newProber(t)
+	if err == nil {
+		var out *prober.Result
+		if out, err = fallback.Run(ctx); err == nil && out.Ping != nil {
+			if pingErr != nil {
+				logging.Debug("probe", "[%s] ICMP unavailable for %s: %v", d.Type, t.Name, pingErr)
+			}
+			return out.Ping, d.Type, nil
+		}
+	}
+	if pingErr != nil {
+		return nil, "", fmt.Errorf("%v; %s: %v", pingErr, d.Type, err)
 	}
-	return sshCfg, nil
+	return pingRes, prober.ModeICMP, nil // Report the ICMP loss rather than nothing
+}
+
+// traceSpec is the spec the trace engines are built from: the target's
+// address and family, and only its trace options as config
+func traceSpec(t storage.Target, family prober.AddressFamily, opts prober.TraceOptions) prober.Spec {
+	config, _ := json.Marshal(opts)
+	return prober.Spec{Address: t.Address, Family: family, Config: string(config)}
 }
 
-func parseHTTPConfig(raw string) (string, error) {
-	if raw == "" {
-		return "", fmt.Errorf("http url is required")
+// runTracer runs one of the registered trace engines
+func runTracer(ctx context.Context, tracer string, spec prober.Spec) (*prober.Result, error) {
+	p, err := prober.New(tracer, spec)
+	if err != nil {
+		return nil, err
 	}
-	var cfg httpProbeConfig
-	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
-		return "", err
+	return p.Run(ctx)
+}
+
+// runMTR collects per-hop statistics with the engine selected by RS_MTR_ENGINE:
+// "native" (default) uses the built-in Go prober and falls back to the mtr binary,
+// "binary" prefers the mtr binary and falls back to the native prober.
+// UDP and TCP traces always use the native prober, as only it keeps the flow stable.
+func runMTR(ctx context.Context, spec prober.Spec, opts prober.TraceOptions) (*prober.MTRResult, error) {
+	engines := []string{prober.TracerNative, prober.TracerBinary}
+	switch {
+	case opts.Method != prober.TraceICMP:
+		engines = engines[:1]
+	case strings.EqualFold(os.Getenv("RS_MTR_ENGINE"), "binary"):
+		engines[0], engines[1] = engines[1], engines[0]
+	}
+	var errs []string
+	for _, tracer := range engines {
+		res, err := runTracer(ctx, tracer, spec)
+		if err == nil {
+			return res.MTR, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, errors.New(strings.Join(errs, "; fallback: "))
+}
+
+// targetFamily returns the target's configured address family (auto if unset or invalid)
+func targetFamily(t storage.Target) prober.AddressFamily {
+	family, err := prober.ParseFamily(t.AddressFamily)
+	if err != nil {
+		return prober.FamilyAuto
 	}
-	return cfg.URL, nil
+	return family
 }
 
-func parseIperfConfig(raw string) (int, error) {
-	if raw == "" {
-		return 0, nil
+// newProber builds the target's prober. The secrets in its config are
+// decrypted and their references resolved here and nowhere else, on every
+// run, so a rotated secret file or store entry is picked up without a reload.
+// They only live as long as the prober.
+func (s *Service) newProber(t storage.Target) (prober.Prober, error) {
+	keys := prober.SecretKeys(t.ProbeType)
+	config, err := secrets.OpenFields(s.db.SecretBox(), t.ProbeConfig, keys)
+	if err != nil {
+		return nil, configError{err}
+	}
+	if config, err = secrets.ResolveConfig(config, keys, s.db); err != nil {
+		return nil, configError{err}
 	}
-	var cfg iperfProbeConfig
-	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
-		return 0, err
+	p, err := prober.New(t.ProbeType, prober.Spec{Address: t.Address, Family: targetFamily(t), Config: config})
+	if err != nil {
+		return nil, configError{err}
 	}
-	return cfg.Port, nil
+	return p, nil
+}
+
+// probeKind returns the kind of the target's probe mode (empty if unknown)
+func probeKind(t storage.Target) prober.Kind {
+	d, ok := prober.Lookup(t.ProbeType)
+	if !ok {
+		return ""
+	}
+	return d.Kind
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
+
+// isSpeedTarget reports whether the target's probe mode is a bandwidth test
+func isSpeedTarget(t storage.Target) bool {
+	return probeKind(t) == prober.KindBandwidth
 }
 
 type traceHop struct {
@@ -408,14 +669,29 @@ type traceHop struct {
 
 type tracePayload struct {
 	Target    string     `json:"target"`
+	Method    string     `json:"method,omitempty"` // icmp, udp or tcp
+	Port      int        `json:"port,omitempty"`   // Destination port of udp/tcp probes
 	Hops      []traceHop `json:"hops"`
 	Truncated bool       `json:"truncated,omitempty"`
 }
 
-func (s *Service) serializeTraceFromTraceroute(res *prober.TraceResult) []byte {
-	if res == nil {
+// marshalTrace encodes a trace for storage; failed traces are stored as an
+// empty array
+func marshalTrace(payload *tracePayload) []byte {
+	if payload == nil {
+		return []byte("[]")
+	}
+	bytes, err := json.Marshal(payload)
+	if err != nil {
 		return []byte("[]")
 	}
+	return bytes
+}
+
+func (s *Service) traceFromTraceroute(res *prober.TraceResult) *tracePayload {
+	if res == nil {
+		return nil
+	}
 
 	hops := make([]traceHop, 0, len(res.Hops))
 	for _, h := range res.Hops {
@@ -429,22 +705,17 @@ func (s *Service) serializeTraceFromTraceroute(res *prober.TraceResult) []byte {
 		hops = append(hops, th)
 	}
 
-	payload := tracePayload{Target: res.Target, Hops: hops}
-	bytes, err := json.Marshal(payload)
-	if err != nil {
-		return []byte("[]")
-	}
-	return bytes
+	return &tracePayload{Target: res.Target, Method: string(res.Method), Port: res.Port, Hops: hops}
 }
 
-func (s *Service) serializeTraceFromMTR(res *prober.MTRResult, truncated bool) []byte {
+func (s *Service) traceFromMTR(res *prober.MTRResult, truncated bool) *tracePayload {
 	if res == nil {
-		return []byte("[]")
+		return nil
 	}
 
 	hops := make([]traceHop, 0, len(res.Hops))
 	for _, h := range res.Hops {
-		ip := resolveIP(h.Host)
+		ip := resolveIP(h.Host, res.Family)
 		th := traceHop{
 			Hop:            h.Hop,
 			Host:           h.Host,
@@ -460,12 +731,7 @@ func (s *Service) serializeTraceFromMTR(res *prober.MTRResult, truncated bool) [
 		hops = append(hops, th)
 	}
 
-	payload := tracePayload{Target: res.Target, Hops: hops, Truncated: truncated}
-	bytes, err := json.Marshal(payload)
-	if err != nil {
-		return []byte("[]")
-	}
-	return bytes
+	return &tracePayload{Target: res.Target, Method: string(res.Method), Port: res.Port, Hops: hops, Truncated: truncated}
 }
 
 func (s *Service) enrichHopGeo(th *traceHop) {
@@ -492,7 +758,8 @@ func (s *Service) enrichHopGeo(th *traceHop) {
 	}
 }
 
-func resolveIP(host string) string {
+// resolveIP maps an MTR hop hostname to an address of the traced family
+func resolveIP(host string, family prober.AddressFamily) string {
 	if host == "" || host == "*" {
 		return host
 	}
@@ -501,7 +768,11 @@ func resolveIP(host string) string {
 	}
 	if ips, err := net.LookupIP(host); err == nil {
 		for _, ip := range ips {
-			if v4 := ip.To4(); v4 != nil {
+			if family == prober.FamilyV6 {
+				if ip.To4() == nil {
+					return ip.String()
+				}
+			} else if v4 := ip.To4(); v4 != nil {
 				return v4.String()
 			}
 		}
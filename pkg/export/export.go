@@ -0,0 +1,376 @@
+// Package export streams stored measurements as CSV, JSON Lines or InfluxDB
+// line protocol
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+// Export formats
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+	FormatInflux = "influx"
+)
+
+// Record kinds, as written in the kind column / field or measurement name
+const (
+	KindLatency = "latency"
+	KindSpeed   = "speed"
+	KindHop     = "hop"
+	KindDNS     = "dns" // Pushed only, see push.Record
+)
+
+// ParseFormat validates an export format; empty means CSV
+func ParseFormat(s string) (string, error) {
+	switch s {
+	case "":
+		return FormatCSV, nil
+	case FormatCSV, FormatNDJSON, FormatInflux:
+		return s, nil
+	case "jsonl":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("invalid format %q: must be csv, ndjson or influx", s)
+}
+
+// ContentType is the MIME type of a format
+func ContentType(format string) string {
+	switch format {
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatInflux:
+		return "text/plain; charset=utf-8"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+// Extension is the file extension of a format
+func Extension(format string) string {
+	switch format {
+	case FormatNDJSON:
+		return "ndjson"
+	case FormatInflux:
+		return "lp"
+	default:
+		return "csv"
+	}
+}
+
+// Options select what to export
+type Options struct {
+	storage.RecordFilter
+	Hops bool // Also export trace hops
+}
+
+// encoder writes records in one format
+type encoder interface {
+	latency(r *storage.LatencyRecord) error
+	speed(r *storage.SpeedRecord) error
+	hop(r *storage.HopRecord) error
+	flush() error
+}
+
+// Export writes the latency and speed records, and the trace hops if
+// requested, matching opts to w in the given format. Records are streamed
+// kind by kind, each oldest first, so memory use does not grow with the range.
+func Export(db *storage.DB, w io.Writer, format string, opts Options) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	var enc encoder
+	switch format {
+	case FormatCSV:
+		enc = newCSVEncoder(bw)
+	case FormatNDJSON:
+		enc = &jsonEncoder{enc: json.NewEncoder(bw)}
+	case FormatInflux:
+		enc = &influxEncoder{w: bw}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	if err := db.EachLatency(opts.RecordFilter, enc.latency); err != nil {
+		return fmt.Errorf("latency records: %w", err)
+	}
+	if err := db.EachSpeed(opts.RecordFilter, enc.speed); err != nil {
+		return fmt.Errorf("speed records: %w", err)
+	}
+	if opts.Hops {
+		if err := db.EachHop(opts.RecordFilter, enc.hop); err != nil {
+			return fmt.Errorf("trace hops: %w", err)
+		}
+	}
+	if err := enc.flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// csvColumns is the CSV header: one set of columns shared by all kinds,
+// with the ones that don't apply to a row left empty
+var csvColumns = []string{
+	"kind", "time", "target_id", "target",
+	"latency_ms", "packet_loss", "ip_family", "latency_source",
+	"http_status", "http_dns_ms", "http_connect_ms", "http_tls_ms", "http_ttfb_ms", "http_total_ms",
+	"speed_down_mbps", "speed_up_mbps", "probe_type",
+	"trace_id", "ttl", "hop_ip", "hop_asn", "hop_loss", "hop_best_ms", "hop_worst_ms",
+}
+
+type csvEncoder struct {
+	w      *csv.Writer
+	header bool
+	row    []string
+}
+
+func newCSVEncoder(w io.Writer) *csvEncoder {
+	return &csvEncoder{w: csv.NewWriter(w), row: make([]string, len(csvColumns))}
+}
+
+// write emits a row from column values by name
+func (e *csvEncoder) write(values map[string]string) error {
+	if !e.header {
+		e.header = true
+		if err := e.w.Write(csvColumns); err != nil {
+			return err
+		}
+	}
+	for i, col := range csvColumns {
+		e.row[i] = values[col]
+	}
+	return e.w.Write(e.row)
+}
+
+func (e *csvEncoder) latency(r *storage.LatencyRecord) error {
+	v := map[string]string{
+		"kind": KindLatency, "time": formatTime(r.CreatedAt), "target_id": formatUint(r.TargetID), "target": r.Target,
+		"latency_ms": formatFloat(r.LatencyMs), "packet_loss": formatFloat(r.PacketLoss),
+		"ip_family": r.IPFamily, "latency_source": r.LatencySource,
+	}
+	if r.HTTPStatus != 0 {
+		v["http_status"] = strconv.Itoa(r.HTTPStatus)
+		v["http_dns_ms"] = formatFloat(r.HTTPDNSMs)
+		v["http_connect_ms"] = formatFloat(r.HTTPConnectMs)
+		v["http_tls_ms"] = formatFloat(r.HTTPTLSMs)
+		v["http_ttfb_ms"] = formatFloat(r.HTTPTTFBMs)
+		v["http_total_ms"] = formatFloat(r.HTTPTotalMs)
+	}
+	return e.write(v)
+}
+
+func (e *csvEncoder) speed(r *storage.SpeedRecord) error {
+	return e.write(map[string]string{
+		"kind": KindSpeed, "time": formatTime(r.CreatedAt), "target_id": formatUint(r.TargetID), "target": r.Target,
+		"speed_down_mbps": formatFloat(r.SpeedDown), "speed_up_mbps": formatFloat(r.SpeedUp), "probe_type": r.ProbeType,
+	})
+}
+
+func (e *csvEncoder) hop(r *storage.HopRecord) error {
+	return e.write(map[string]string{
+		"kind": KindHop, "time": formatTime(r.CreatedAt), "target_id": formatUint(r.TargetID), "target": r.Target,
+		"latency_ms": formatFloat(r.LatencyMs), "trace_id": formatUint(r.TraceID), "ttl": strconv.Itoa(r.TTL),
+		"hop_ip": r.IP, "hop_asn": r.ASN, "hop_loss": formatFloat(r.Loss),
+		"hop_best_ms": formatFloat(r.BestMs), "hop_worst_ms": formatFloat(r.WorstMs),
+	})
+}
+
+func (e *csvEncoder) flush() error {
+	if !e.header { // Header only, for an empty export
+		e.header = true
+		if err := e.w.Write(csvColumns); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonEncoder writes one JSON object per line: the record as the API returns
+// it, plus its kind
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) latency(r *storage.LatencyRecord) error {
+	return e.enc.Encode(struct {
+		Kind string `json:"kind"`
+		*storage.LatencyRecord
+	}{KindLatency, r})
+}
+
+func (e *jsonEncoder) speed(r *storage.SpeedRecord) error {
+	return e.enc.Encode(struct {
+		Kind string `json:"kind"`
+		*storage.SpeedRecord
+	}{KindSpeed, r})
+}
+
+func (e *jsonEncoder) hop(r *storage.HopRecord) error {
+	return e.enc.Encode(struct {
+		Kind string `json:"kind"`
+		*storage.HopRecord
+	}{KindHop, r})
+}
+
+func (e *jsonEncoder) flush() error { return nil }
+
+// influxEncoder writes InfluxDB line protocol with nanosecond timestamps to
+// the measurements routelens_latency, routelens_speed and routelens_hop
+type influxEncoder struct {
+	w *bufio.Writer
+}
+
+// point builds one line of line protocol. Tags with empty values are left out,
+// as line protocol does not allow them.
+type point struct {
+	b      strings.Builder
+	fields int
+}
+
+func newPoint(measurement string) *point {
+	p := &point{}
+	p.b.WriteString(measurement)
+	return p
+}
+
+func (p *point) tag(key, value string) *point {
+	if value != "" {
+		p.b.WriteByte(',')
+		p.b.WriteString(key)
+		p.b.WriteByte('=')
+		p.b.WriteString(escapeTag(value))
+	}
+	return p
+}
+
+func (p *point) field(key, value string) *point {
+	if p.fields == 0 {
+		p.b.WriteByte(' ')
+	} else {
+		p.b.WriteByte(',')
+	}
+	p.fields++
+	p.b.WriteString(key)
+	p.b.WriteByte('=')
+	p.b.WriteString(value)
+	return p
+}
+
+func (p *point) float(key string, v float64) *point {
+	return p.field(key, formatFloat(v))
+}
+
+func (p *point) integer(key string, v int64) *point {
+	return p.field(key, strconv.FormatInt(v, 10)+"i")
+}
+
+func (p *point) boolean(key string, v bool) *point {
+	return p.field(key, strconv.FormatBool(v))
+}
+
+func (p *point) str(key, v string) *point {
+	return p.field(key, `"`+fieldEscaper.Replace(v)+`"`)
+}
+
+// line terminates the point with its timestamp
+func (p *point) line(at time.Time) string {
+	p.b.WriteByte(' ')
+	p.b.WriteString(strconv.FormatInt(at.UnixNano(), 10))
+	p.b.WriteByte('\n')
+	return p.b.String()
+}
+
+// LatencyLine is a latency record in line protocol, newline included, as
+// written by influx exports
+func LatencyLine(r *storage.LatencyRecord) string {
+	p := newPoint("routelens_latency").
+		tag("target", r.Target).tag("target_id", formatUint(r.TargetID)).
+		tag("ip_family", r.IPFamily).tag("source", r.LatencySource).
+		float("latency_ms", r.LatencyMs).float("packet_loss", r.PacketLoss)
+	if r.HTTPStatus != 0 {
+		p.integer("http_status", int64(r.HTTPStatus)).
+			float("http_dns_ms", r.HTTPDNSMs).float("http_connect_ms", r.HTTPConnectMs).
+			float("http_tls_ms", r.HTTPTLSMs).float("http_ttfb_ms", r.HTTPTTFBMs).
+			float("http_total_ms", r.HTTPTotalMs)
+	}
+	return p.line(r.CreatedAt)
+}
+
+// SpeedLine is a speed record in line protocol, newline included
+func SpeedLine(r *storage.SpeedRecord) string {
+	return newPoint("routelens_speed").
+		tag("target", r.Target).tag("target_id", formatUint(r.TargetID)).tag("probe_type", r.ProbeType).
+		float("speed_down_mbps", r.SpeedDown).float("speed_up_mbps", r.SpeedUp).
+		line(r.CreatedAt)
+}
+
+// HopLine is a trace hop in line protocol, newline included
+func HopLine(r *storage.HopRecord) string {
+	return newPoint("routelens_hop").
+		tag("target", r.Target).tag("target_id", formatUint(r.TargetID)).
+		tag("ttl", strconv.Itoa(r.TTL)).tag("ip", r.IP).tag("asn", r.ASN).
+		float("loss", r.Loss).float("latency_ms", r.LatencyMs).
+		float("best_ms", r.BestMs).float("worst_ms", r.WorstMs).
+		integer("trace_id", int64(r.TraceID)).
+		line(r.CreatedAt)
+}
+
+// DNSLine is the answer of one resolver to a MODE_DNS probe in line
+// protocol, newline included. Answers are joined with commas.
+func DNSLine(r *storage.DNSRecord) string {
+	p := newPoint("routelens_dns").
+		tag("target", r.Target).tag("target_id", formatUint(r.TargetID)).
+		tag("resolver", r.Resolver).tag("name", r.Name).tag("qtype", r.QType).tag("rcode", r.Rcode).
+		float("query_ms", r.QueryMs).boolean("changed", r.Changed).
+		str("answers", strings.Join(r.Answers, ","))
+	if r.Error != "" {
+		p.str("error", r.Error)
+	}
+	return p.line(r.CreatedAt)
+}
+
+func (e *influxEncoder) latency(r *storage.LatencyRecord) error {
+	_, err := e.w.WriteString(LatencyLine(r))
+	return err
+}
+
+func (e *influxEncoder) speed(r *storage.SpeedRecord) error {
+	_, err := e.w.WriteString(SpeedLine(r))
+	return err
+}
+
+func (e *influxEncoder) hop(r *storage.HopRecord) error {
+	_, err := e.w.WriteString(HopLine(r))
+	return err
+}
+
+func (e *influxEncoder) flush() error { return nil }
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// fieldEscaper escapes string field values, which are quoted
+var fieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatUint(n uint) string {
+	return strconv.FormatUint(uint64(n), 10)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -2,6 +2,7 @@ package logging
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"time"
 )
@@ -31,6 +32,7 @@ type RingBuffer struct {
 	size    int
 	head    int
 	count   int
+	totals  map[LogLevel]uint64 // Entries ever added, by level
 }
 
 // NewRingBuffer creates a new ring buffer with the specified capacity
@@ -38,6 +40,7 @@ func NewRingBuffer(size int) *RingBuffer {
 	return &RingBuffer{
 		entries: make([]LogEntry, size),
 		size:    size,
+		totals:  make(map[LogLevel]uint64),
 	}
 }
 
@@ -50,6 +53,7 @@ func (rb *RingBuffer) Add(entry LogEntry) {
 	if rb.count < rb.size {
 		rb.count++
 	}
+	rb.totals[entry.Level]++
 }
 
 // AddLog is a convenience method to add a log with level and message
@@ -62,8 +66,9 @@ func (rb *RingBuffer) AddLog(level LogLevel, source, format string, args ...inte
 		Source:    source,
 	}
 	rb.Add(entry)
-	// Also print to stdout for journalctl visibility
-	fmt.Printf("[%s] %s: %s\n", level, source, msg)
+	// Also print to stderr (like the log package) for journalctl visibility,
+	// keeping stdout clean for command output such as exports
+	fmt.Fprintf(os.Stderr, "[%s] %s: %s\n", level, source, msg)
 }
 
 // Info logs an info message
@@ -130,6 +135,25 @@ func (rb *RingBuffer) GetByLevel(levels ...LogLevel) []LogEntry {
 	return result
 }
 
+// Len returns the number of entries held and the capacity of the buffer
+func (rb *RingBuffer) Len() (count, size int) {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return rb.count, rb.size
+}
+
+// Totals returns the number of entries ever added by level, including those
+// since overwritten or cleared
+func (rb *RingBuffer) Totals() map[LogLevel]uint64 {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	totals := make(map[LogLevel]uint64, len(rb.totals))
+	for level, n := range rb.totals {
+		totals[level] = n
+	}
+	return totals
+}
+
 // Clear removes all entries from the buffer
 func (rb *RingBuffer) Clear() {
 	rb.mu.Lock()
@@ -0,0 +1,442 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS transports a resolver can be queried over
+const (
+	DNSOverUDP   = "udp"
+	DNSOverTCP   = "tcp"
+	DNSOverTLS   = "tls"
+	DNSOverHTTPS = "https"
+)
+
+// dnsMaxMessage is the largest DNS message we accept over stream transports
+const dnsMaxMessage = 65535
+
+// dnsTypes maps the record types a DNS probe can ask for
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"TXT":   dnsmessage.TypeTXT,
+	"PTR":   dnsmessage.TypePTR,
+	"SRV":   dnsmessage.TypeSRV,
+	"SOA":   dnsmessage.TypeSOA,
+}
+
+// DNSResolver is a parsed resolver address
+type DNSResolver struct {
+	Transport string // udp, tcp, tls or https
+	Addr      string // host:port, or the URL for https
+}
+
+func (r DNSResolver) String() string {
+	if r.Transport == DNSOverHTTPS {
+		return r.Addr
+	}
+	return r.Transport + "://" + r.Addr
+}
+
+// ParseDNSResolver accepts a bare host ("8.8.8.8" or "2001:4860:4860::8888",
+// UDP port 53), udp://host[:port], tcp://host[:port], tls://host[:port]
+// (port 853) or an https:// DoH URL. IPv6 hosts with a port are bracketed,
+// as in udp://[2001:4860:4860::8888]:53.
+func ParseDNSResolver(s string) (DNSResolver, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DNSResolver{}, errors.New("empty resolver")
+	}
+	transport, host := DNSOverUDP, s
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		transport, host = strings.ToLower(scheme), rest
+	}
+
+	port := "53"
+	switch transport {
+	case DNSOverUDP, DNSOverTCP:
+	case DNSOverTLS:
+		port = "853"
+	case DNSOverHTTPS:
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return DNSResolver{}, fmt.Errorf("invalid resolver %q", s)
+		}
+		return DNSResolver{Transport: DNSOverHTTPS, Addr: u.String()}, nil
+	default:
+		return DNSResolver{}, fmt.Errorf("invalid resolver %q: scheme must be udp, tcp, tls or https", s)
+	}
+
+	// A bare IPv6 address is full of colons but has no port
+	host = strings.TrimSuffix(host, "/")
+	if net.ParseIP(host) == nil {
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return DNSResolver{}, fmt.Errorf("invalid resolver %q: bad port %q", s, port)
+	}
+	if host == "" || strings.ContainsAny(host, "/[]@?#") || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		return DNSResolver{}, fmt.Errorf("invalid resolver %q", s)
+	}
+	return DNSResolver{Transport: transport, Addr: net.JoinHostPort(host, port)}, nil
+}
+
+// DNSProber queries one name against one or more resolvers in parallel
+type DNSProber struct {
+	Name      string
+	Type      string // A, AAAA, CNAME, MX, NS, TXT, PTR, SRV or SOA
+	Resolvers []DNSResolver
+	Timeout   time.Duration
+	Insecure  bool          // Skip certificate verification for tls/https resolvers
+	Family    AddressFamily // auto (default), v4 or v6: how resolvers are reached
+}
+
+// DNSAnswer is the outcome of the query against one resolver
+type DNSAnswer struct {
+	Resolver  string
+	Rcode     string        // NOERROR, NXDOMAIN, SERVFAIL, ... (empty when the query failed)
+	Answers   []string      // Answer records in presentation form, sorted
+	QueryTime time.Duration // Includes connection setup for tcp, tls and https
+	Err       string        // Transport error, if any
+}
+
+// AnswerSet is a canonical form of the answer used to detect changes
+func (a DNSAnswer) AnswerSet() string {
+	return a.Rcode + "|" + strings.Join(a.Answers, ",")
+}
+
+// DNSResult holds the answers of every resolver for one query
+type DNSResult struct {
+	Name      string
+	Type      string
+	Answers   []DNSAnswer // In resolver order
+	Timestamp time.Time
+}
+
+type dnsProbeConfig struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Resolvers []string `json:"resolvers"`
+	Insecure  bool     `json:"insecure"`
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeDNS,
+		Label: "DNS",
+		Kind:  KindDNS,
+		Config: []ConfigField{
+			{Key: "name", Type: "string", Required: true, Description: "Name to resolve"},
+			{Key: "type", Type: "string", Default: "A", Description: "Record type: A, AAAA, CNAME, MX, NS, TXT, PTR, SRV or SOA"},
+			{Key: "resolvers", Type: "list", Default: []string{"udp://<address>:53"}, Description: "Resolvers to compare: host, udp://, tcp://, tls:// or https:// URLs"},
+			{Key: "insecure", Type: "bool", Default: false, Description: "Skip certificate verification for tls/https resolvers"},
+		},
+		New: func(spec Spec) (Prober, error) {
+			var cfg dnsProbeConfig
+			if err := decodeConfig(spec.Config, &cfg); err != nil {
+				return nil, err
+			}
+			if len(cfg.Resolvers) == 0 {
+				cfg.Resolvers = []string{spec.Address} // The target itself is the resolver
+			}
+			p, err := NewDNSProber(cfg.Name, cfg.Type, cfg.Resolvers)
+			if err != nil {
+				return nil, err
+			}
+			p.Insecure = cfg.Insecure
+			p.Family = spec.Family
+			return dnsProber(p.Run), nil
+		},
+	})
+}
+
+func NewDNSProber(name, qtype string, resolvers []string) (*DNSProber, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("dns name is required")
+	}
+	if _, err := dnsmessage.NewName(fqdn(name)); err != nil {
+		return nil, fmt.Errorf("invalid dns name %q: %w", name, err)
+	}
+	qtype = strings.ToUpper(strings.TrimSpace(qtype))
+	if qtype == "" {
+		qtype = "A"
+	}
+	if _, ok := dnsTypes[qtype]; !ok {
+		return nil, fmt.Errorf("unsupported dns record type %q", qtype)
+	}
+	if len(resolvers) == 0 {
+		return nil, errors.New("at least one resolver is required")
+	}
+
+	p := &DNSProber{Name: name, Type: qtype, Timeout: 5 * time.Second, Family: FamilyAuto}
+	for _, s := range resolvers {
+		r, err := ParseDNSResolver(s)
+		if err != nil {
+			return nil, err
+		}
+		p.Resolvers = append(p.Resolvers, r)
+	}
+	return p, nil
+}
+
+func (p *DNSProber) Run(ctx context.Context) (*DNSResult, error) {
+	query, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &DNSResult{Name: p.Name, Type: p.Type, Answers: make([]DNSAnswer, len(p.Resolvers))}
+	var wg sync.WaitGroup
+	for i, r := range p.Resolvers {
+		wg.Add(1)
+		go func(i int, r DNSResolver) {
+			defer wg.Done()
+			res.Answers[i] = p.ask(ctx, r, query)
+		}(i, r)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res.Timestamp = time.Now()
+	return res, nil
+}
+
+// query builds the question with a random ID; every resolver gets the same one
+func (p *DNSProber) query() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(fqdn(p.Name)),
+		Type:  dnsTypes[p.Type],
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// ask sends the query to one resolver and decodes its response
+func (p *DNSProber) ask(ctx context.Context, r DNSResolver, query []byte) DNSAnswer {
+	ans := DNSAnswer{Resolver: r.String()}
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := p.exchange(ctx, r, query)
+	ans.QueryTime = time.Since(start)
+	if err != nil {
+		ans.Err = err.Error()
+		return ans
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		ans.Err = fmt.Sprintf("invalid response: %v", err)
+		return ans
+	}
+	if msg.Header.ID != binary.BigEndian.Uint16(query[0:2]) {
+		ans.Err = "response id mismatch"
+		return ans
+	}
+	ans.Rcode = rcodeName(msg.Header.RCode)
+	for _, rr := range msg.Answers {
+		ans.Answers = append(ans.Answers, formatRR(rr))
+	}
+	sort.Strings(ans.Answers)
+	return ans
+}
+
+func (p *DNSProber) exchange(ctx context.Context, r DNSResolver, query []byte) ([]byte, error) {
+	suffix := ""
+	switch p.Family {
+	case FamilyV4:
+		suffix = "4"
+	case FamilyV6:
+		suffix = "6"
+	}
+	dialer := &net.Dialer{}
+
+	switch r.Transport {
+	case DNSOverUDP:
+		resp, err := exchangeUDP(ctx, dialer, "udp"+suffix, r.Addr, query)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) > 2 && resp[2]&0x02 != 0 { // TC: retry over TCP like stub resolvers do
+			return exchangeStream(ctx, func() (net.Conn, error) { return dialer.DialContext(ctx, "tcp"+suffix, r.Addr) }, query)
+		}
+		return resp, nil
+	case DNSOverTCP:
+		return exchangeStream(ctx, func() (net.Conn, error) { return dialer.DialContext(ctx, "tcp"+suffix, r.Addr) }, query)
+	case DNSOverTLS:
+		host, _, _ := net.SplitHostPort(r.Addr)
+		td := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, InsecureSkipVerify: p.Insecure}}
+		return exchangeStream(ctx, func() (net.Conn, error) { return td.DialContext(ctx, "tcp"+suffix, r.Addr) }, query)
+	case DNSOverHTTPS:
+		return p.exchangeHTTPS(ctx, dialer, "tcp"+suffix, r.Addr, query)
+	}
+	return nil, fmt.Errorf("unsupported transport %q", r.Transport)
+}
+
+func exchangeUDP(ctx context.Context, dialer *net.Dialer, network, addr string, query []byte) ([]byte, error) {
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessage)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams that do not answer our query
+		if n >= 2 && bytes.Equal(buf[0:2], query[0:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends a length-prefixed query over TCP or TLS (RFC 1035 4.2.2)
+func exchangeStream(ctx context.Context, dial func() (net.Conn, error), query []byte) ([]byte, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := c.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeHTTPS posts the query as application/dns-message (RFC 8484)
+func (p *DNSProber) exchangeHTTPS(ctx context.Context, dialer *net.Dialer, network, endpoint string, query []byte) ([]byte, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: p.Insecure},
+		DisableKeepAlives: true,
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh returned status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessage))
+}
+
+// fqdn appends the root label dnsmessage requires
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func rcodeName(rc dnsmessage.RCode) string {
+	switch rc {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(int(rc))
+}
+
+// formatRR renders an answer record as "TYPE value", without the TTL
+// (which changes on every query and would defeat change detection)
+func formatRR(rr dnsmessage.Resource) string {
+	var value string
+	switch b := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		value = net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		value = net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		value = b.CNAME.String()
+	case *dnsmessage.NSResource:
+		value = b.NS.String()
+	case *dnsmessage.PTRResource:
+		value = b.PTR.String()
+	case *dnsmessage.MXResource:
+		value = fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.SRVResource:
+		value = fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.TXTResource:
+		value = strconv.Quote(strings.Join(b.TXT, ""))
+	case *dnsmessage.SOAResource:
+		value = fmt.Sprintf("%s %s %d", b.NS, b.MBox, b.Serial)
+	default:
+		value = rr.Body.GoString()
+	}
+	return strings.TrimPrefix(rr.Header.Type.String(), "Type") + " " + value
+}
@@ -0,0 +1,175 @@
+package prober
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localDNSServer is a tiny authoritative server for the A records of one
+// name, reachable over UDP, TCP, TLS and HTTPS on loopback. It lets the DNS
+// prober be exercised without touching the network.
+type localDNSServer struct {
+	name dnsmessage.Name
+
+	mu sync.Mutex
+	a  [][4]byte // Served in this order
+
+	udp   net.PacketConn
+	tcp   net.Listener
+	tls   net.Listener
+	https *httptest.Server
+}
+
+func startLocalDNSServer(name string, a ...net.IP) (*localDNSServer, error) {
+	n, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	s := &localDNSServer{name: n}
+	s.setA(a...)
+
+	if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	if s.tcp, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	s.https = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTPS))
+	tlsInner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.tls = tls.NewListener(tlsInner, s.https.TLS) // Reuse the test certificate for DoT
+
+	go s.serveUDP()
+	go s.serveStream(s.tcp)
+	go s.serveStream(s.tls)
+	return s, nil
+}
+
+func (s *localDNSServer) setA(ips ...net.IP) {
+	a := make([][4]byte, len(ips))
+	for i, ip := range ips {
+		copy(a[i][:], ip.To4())
+	}
+	s.mu.Lock()
+	s.a = a
+	s.mu.Unlock()
+}
+
+// resolvers returns the server's address for every transport
+func (s *localDNSServer) resolvers() []string {
+	return []string{
+		"udp://" + s.udp.LocalAddr().String(),
+		"tcp://" + s.tcp.Addr().String(),
+		"tls://" + s.tls.Addr().String(),
+		s.https.URL + "/dns-query",
+	}
+}
+
+func (s *localDNSServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.tls.Close()
+	s.https.Close()
+}
+
+// answer builds the response to a packed query
+func (s *localDNSServer) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true, RecursionDesired: hdr.RecursionDesired}
+	known := q.Name.String() == s.name.String()
+	if !known {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, resp)
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if known && q.Type == dnsmessage.TypeA {
+		if err := b.StartAnswers(); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		records := s.a
+		s.mu.Unlock()
+		for _, a := range records {
+			if err := b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: a}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+func (s *localDNSServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp, err := s.answer(buf[:n]); err == nil {
+			s.udp.WriteTo(resp, from)
+		}
+	}
+}
+
+func (s *localDNSServer) serveStream(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var size [2]byte
+			if _, err := io.ReadFull(c, size[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(c, query); err != nil {
+				return
+			}
+			resp, err := s.answer(query)
+			if err != nil {
+				return
+			}
+			c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+	}
+}
+
+func (s *localDNSServer) serveHTTPS(w http.ResponseWriter, r *http.Request) {
+	query, err := io.ReadAll(io.LimitReader(r.Body, 65535))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.answer(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
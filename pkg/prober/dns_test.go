@@ -0,0 +1,111 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseDNSResolver(t *testing.T) {
+	tests := []struct {
+		in   string
+		want DNSResolver
+	}{
+		{"8.8.8.8", DNSResolver{DNSOverUDP, "8.8.8.8:53"}},
+		{" 8.8.8.8 ", DNSResolver{DNSOverUDP, "8.8.8.8:53"}},
+		{"8.8.8.8:5353", DNSResolver{DNSOverUDP, "8.8.8.8:5353"}},
+		{"dns.google", DNSResolver{DNSOverUDP, "dns.google:53"}},
+		{"2001:4860:4860::8888", DNSResolver{DNSOverUDP, "[2001:4860:4860::8888]:53"}},
+		{"::1", DNSResolver{DNSOverUDP, "[::1]:53"}},
+		{"[2001:4860:4860::8888]", DNSResolver{DNSOverUDP, "[2001:4860:4860::8888]:53"}},
+		{"[2001:4860:4860::8888]:5353", DNSResolver{DNSOverUDP, "[2001:4860:4860::8888]:5353"}},
+		{"udp://1.1.1.1", DNSResolver{DNSOverUDP, "1.1.1.1:53"}},
+		{"udp://2606:4700:4700::1111", DNSResolver{DNSOverUDP, "[2606:4700:4700::1111]:53"}},
+		{"tcp://[2606:4700:4700::1111]:5353", DNSResolver{DNSOverTCP, "[2606:4700:4700::1111]:5353"}},
+		{"TCP://1.1.1.1/", DNSResolver{DNSOverTCP, "1.1.1.1:53"}},
+		{"tls://dns.google", DNSResolver{DNSOverTLS, "dns.google:853"}},
+		{"tls://2001:4860:4860::8888", DNSResolver{DNSOverTLS, "[2001:4860:4860::8888]:853"}},
+		{"tls://[2001:4860:4860::8888]:8853", DNSResolver{DNSOverTLS, "[2001:4860:4860::8888]:8853"}},
+		{"https://dns.google/dns-query", DNSResolver{DNSOverHTTPS, "https://dns.google/dns-query"}},
+		{"https://[2001:4860:4860::8888]/dns-query", DNSResolver{DNSOverHTTPS, "https://[2001:4860:4860::8888]/dns-query"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseDNSResolver(tt.in)
+		if err != nil {
+			t.Errorf("ParseDNSResolver(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDNSResolver(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseDNSResolverInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"ftp://1.1.1.1",
+		"udp://",
+		"udp://1.1.1.1:0",
+		"udp://1.1.1.1:http",
+		"2001:db8::zz",
+		"udp://user@1.1.1.1",
+		"https://",
+	} {
+		if r, err := ParseDNSResolver(in); err == nil {
+			t.Errorf("ParseDNSResolver(%q) = %+v, want an error", in, r)
+		}
+	}
+}
+
+// TestDNSProber queries a local server over every transport and checks that
+// a changed record changes the answer set
+func TestDNSProber(t *testing.T) {
+	const name = "probe.routelens.test"
+	srv, err := startLocalDNSServer(name, net.IPv4(192, 0, 2, 20), net.IPv4(192, 0, 2, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	p, err := NewDNSProber(name, "A", srv.resolvers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Insecure = true // httptest certificate
+
+	run := func(want ...string) *DNSResult {
+		t.Helper()
+		res, err := p.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Answers) != len(srv.resolvers()) {
+			t.Fatalf("%d answers, want one per resolver", len(res.Answers))
+		}
+		for _, a := range res.Answers {
+			if a.Err != "" {
+				t.Errorf("%s: %s", a.Resolver, a.Err)
+				continue
+			}
+			if a.Rcode != want[0] || strings.Join(a.Answers, ",") != strings.Join(want[1:], ",") {
+				t.Errorf("%s: %s %v, want %s %v", a.Resolver, a.Rcode, a.Answers, want[0], want[1:])
+			}
+		}
+		return res
+	}
+
+	// Answers are sorted whatever order the server sends them in
+	first := run("NOERROR", "A 192.0.2.10", "A 192.0.2.20")
+	srv.setA(net.IPv4(192, 0, 2, 30))
+	second := run("NOERROR", "A 192.0.2.30")
+	for i := range second.Answers {
+		if first.Answers[i].AnswerSet() == second.Answers[i].AnswerSet() {
+			t.Errorf("%s: changed record not detected", second.Answers[i].Resolver)
+		}
+	}
+
+	p.Name = "missing.routelens.test"
+	run("NXDOMAIN")
+}
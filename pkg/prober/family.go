@@ -0,0 +1,233 @@
+package prober
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// AddressFamily selects which IP version is used to reach a target
+type AddressFamily string
+
+const (
+	FamilyAuto AddressFamily = "auto" // Prefer IPv4, fall back to IPv6
+	FamilyV4   AddressFamily = "v4"
+	FamilyV6   AddressFamily = "v6"
+)
+
+// ParseFamily normalizes an address family option. Empty input means auto.
+func ParseFamily(s string) (AddressFamily, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto":
+		return FamilyAuto, nil
+	case "v4", "ipv4", "4", "ip4":
+		return FamilyV4, nil
+	case "v6", "ipv6", "6", "ip6":
+		return FamilyV6, nil
+	}
+	return "", fmt.Errorf("invalid address family %q: must be auto, v4 or v6", s)
+}
+
+// FamilyOf reports the concrete family (v4 or v6) of a resolved IP
+func FamilyOf(ip net.IP) AddressFamily {
+	if ip.To4() != nil {
+		return FamilyV4
+	}
+	return FamilyV6
+}
+
+// resolveTarget resolves host restricted to the requested family.
+// In auto mode IPv4 is preferred when the host has both A and AAAA records.
+func resolveTarget(ctx context.Context, host string, family AddressFamily) (*net.IPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s (%s): %w", host, family, ctxError(ctx, err))
+	}
+	var fallback *net.IPAddr
+	for i := range addrs {
+		a := &addrs[i]
+		switch FamilyOf(a.IP) {
+		case FamilyV4:
+			if family != FamilyV6 {
+				return a, nil
+			}
+		case FamilyV6:
+			if family == FamilyV6 {
+				return a, nil
+			}
+			if family != FamilyV4 && fallback == nil {
+				fallback = a
+			}
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, fmt.Errorf("resolve %s (%s): no suitable address", host, family)
+}
+
+// icmpFamily bundles the per-IP-version details of ICMP probing
+type icmpFamily struct {
+	family       AddressFamily
+	proto        int // Protocol number passed to icmp.ParseMessage
+	echoRequest  icmp.Type
+	echoReply    icmp.Type
+	timeExceeded icmp.Type
+	unreachable  icmp.Type
+	echoType     int // Wire value of echoRequest, for matching quoted datagrams
+}
+
+var (
+	icmpV4 = icmpFamily{
+		family:       FamilyV4,
+		proto:        1,
+		echoRequest:  ipv4.ICMPTypeEcho,
+		echoReply:    ipv4.ICMPTypeEchoReply,
+		timeExceeded: ipv4.ICMPTypeTimeExceeded,
+		unreachable:  ipv4.ICMPTypeDestinationUnreachable,
+		echoType:     int(ipv4.ICMPTypeEcho),
+	}
+	icmpV6 = icmpFamily{
+		family:       FamilyV6,
+		proto:        58,
+		echoRequest:  ipv6.ICMPTypeEchoRequest,
+		echoReply:    ipv6.ICMPTypeEchoReply,
+		timeExceeded: ipv6.ICMPTypeTimeExceeded,
+		unreachable:  ipv6.ICMPTypeDestinationUnreachable,
+		echoType:     int(ipv6.ICMPTypeEchoRequest),
+	}
+)
+
+// echoIDs hands out ICMP echo IDs. Every raw ICMP socket receives every ICMP
+// message of the host, so concurrent runs must not share an ID.
+var echoIDs = struct {
+	sync.Mutex
+	next  uint16
+	inUse map[uint16]bool
+}{next: uint16(os.Getpid()), inUse: make(map[uint16]bool)}
+
+// acquireEchoID returns an echo ID no other run holds, to be released with
+// releaseEchoID when the run is over
+func acquireEchoID() int {
+	echoIDs.Lock()
+	defer echoIDs.Unlock()
+	for echoIDs.inUse[echoIDs.next] {
+		echoIDs.next++
+	}
+	id := echoIDs.next
+	echoIDs.inUse[id] = true
+	echoIDs.next++
+	return int(id)
+}
+
+func releaseEchoID(id int) {
+	echoIDs.Lock()
+	delete(echoIDs.inUse, uint16(id))
+	echoIDs.Unlock()
+}
+
+func icmpFamilyFor(ip net.IP) icmpFamily {
+	if FamilyOf(ip) == FamilyV4 {
+		return icmpV4
+	}
+	return icmpV6
+}
+
+// listen opens an ICMP endpoint: a raw socket when privileged, otherwise an
+// unprivileged datagram socket (Linux ping_group_range / macOS).
+func (f icmpFamily) listen(privileged bool) (*icmp.PacketConn, error) {
+	network, addr := "udp4", "0.0.0.0"
+	if f.family == FamilyV6 {
+		network, addr = "udp6", "::"
+	}
+	if privileged {
+		network = "ip4:icmp"
+		if f.family == FamilyV6 {
+			network = "ip6:ipv6-icmp"
+		}
+	}
+	return icmp.ListenPacket(network, addr)
+}
+
+// setTTL sets the IPv4 TTL or IPv6 hop limit for subsequent writes
+func (f icmpFamily) setTTL(c *icmp.PacketConn, ttl int) error {
+	if f.family == FamilyV6 {
+		if p := c.IPv6PacketConn(); p != nil {
+			return p.SetHopLimit(ttl)
+		}
+		return fmt.Errorf("hop limit not supported on this endpoint")
+	}
+	if p := c.IPv4PacketConn(); p != nil {
+		return p.SetTTL(ttl)
+	}
+	return fmt.Errorf("ttl not supported on this endpoint")
+}
+
+// dstAddr returns the address type WriteTo expects for the endpoint kind
+func (f icmpFamily) dstAddr(dst *net.IPAddr, privileged bool) net.Addr {
+	if privileged {
+		return dst
+	}
+	return &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+}
+
+// echoMessage builds an echo request for this family
+func (f icmpFamily) echoMessage(id, seq int, payload []byte) ([]byte, error) {
+	wm := icmp.Message{
+		Type: f.echoRequest, Code: 0,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+	}
+	// ICMPv6 checksums are filled in by the kernel
+	return wm.Marshal(nil)
+}
+
+// quotedTransport strips the IP header of a datagram quoted inside an ICMP
+// error and returns its transport protocol and the transport header bytes
+func (f icmpFamily) quotedTransport(data []byte) (proto int, transport []byte, ok bool) {
+	if f.family == FamilyV4 {
+		if len(data) < ipv4.HeaderLen {
+			return 0, nil, false
+		}
+		hl := int(data[0]&0x0f) << 2
+		if len(data) < hl+8 {
+			return 0, nil, false
+		}
+		return int(data[9]), data[hl:], true
+	}
+	if len(data) < ipv6.HeaderLen+8 {
+		return 0, nil, false
+	}
+	return int(data[6]), data[ipv6.HeaderLen:], true
+}
+
+// quotedDst returns the destination of a datagram quoted inside an ICMP error
+func (f icmpFamily) quotedDst(data []byte) net.IP {
+	if f.family == FamilyV4 {
+		if len(data) < ipv4.HeaderLen {
+			return nil
+		}
+		return net.IP(data[16:20])
+	}
+	if len(data) < ipv6.HeaderLen {
+		return nil
+	}
+	return net.IP(data[24:40])
+}
+
+// quotedEcho extracts the ID/Seq of our echo request quoted inside an ICMP
+// error (time exceeded, unreachable). data starts at the quoted IP header.
+func (f icmpFamily) quotedEcho(data []byte) (id, seq int, ok bool) {
+	proto, echo, ok := f.quotedTransport(data)
+	if !ok || proto != f.proto || int(echo[0]) != f.echoType {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(echo[4:6])), int(binary.BigEndian.Uint16(echo[6:8])), true
+}
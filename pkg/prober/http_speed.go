@@ -1,6 +1,7 @@
 package prober
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,16 +12,49 @@ type HTTPSpeedTester struct {
 	URL string
 }
 
+type httpProbeConfig struct {
+	URL string `json:"url"`
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeHTTP,
+		Label: "HTTP",
+		Kind:  KindBandwidth,
+		Config: []ConfigField{
+			{Key: "url", Type: "string", Required: true, Description: "File URL to download"},
+		},
+		New: func(spec Spec) (Prober, error) {
+			if spec.Config == "" {
+				return nil, fmt.Errorf("http url is required")
+			}
+			var cfg httpProbeConfig
+			if err := decodeConfig(spec.Config, &cfg); err != nil {
+				return nil, err
+			}
+			if cfg.URL == "" {
+				return nil, fmt.Errorf("http url is required")
+			}
+			return speedProber(NewHTTPSpeedTester(cfg.URL).Run), nil
+		},
+	})
+}
+
 func NewHTTPSpeedTester(url string) *HTTPSpeedTester {
 	return &HTTPSpeedTester{URL: url}
 }
 
-func (h *HTTPSpeedTester) Run() (*SpeedResult, error) {
+func (h *HTTPSpeedTester) Run(ctx context.Context) (*SpeedResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+
 	start := time.Now()
 
-	resp, err := http.Get(h.URL)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("http get failed: %w", err)
+		return nil, fmt.Errorf("http get failed: %w", ctxError(ctx, err))
 	}
 	defer resp.Body.Close()
 
@@ -32,7 +66,7 @@ func (h *HTTPSpeedTester) Run() (*SpeedResult, error) {
 	// We use io.Discard to avoid memory overhead
 	n, err := io.Copy(io.Discard, resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read body: %w", err)
+		return nil, fmt.Errorf("failed to read body: %w", ctxError(ctx, err))
 	}
 
 	duration := time.Since(start)
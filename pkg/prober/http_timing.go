@@ -0,0 +1,171 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpTimingBodyLimit caps how much of the response body is read per request
+const httpTimingBodyLimit = 1 << 20
+
+// HTTPTimingProber times the phases of a single HTTP(S) request over a fresh
+// connection, so it can tell slow networks from slow TLS or slow servers.
+type HTTPTimingProber struct {
+	URL      string
+	Timeout  time.Duration
+	Insecure bool          // Skip TLS certificate verification
+	Family   AddressFamily // auto (default), v4 or v6
+}
+
+// HTTPTimingResult holds the phase durations of one request. Phases that did
+// not happen (DNS for an IP literal, TLS for plain HTTP) are zero.
+type HTTPTimingResult struct {
+	URL        string
+	StatusCode int
+	DNS        time.Duration // Name resolution
+	Connect    time.Duration // TCP handshake
+	TLS        time.Duration // TLS handshake
+	TTFB       time.Duration // Request written -> first response byte (server time + one RTT)
+	Total      time.Duration // Start -> body read
+	Family     AddressFamily
+	Addr       string // Remote address that served the request
+	Timestamp  time.Time
+}
+
+type httpTimingProbeConfig struct {
+	URL      string `json:"url"`
+	Insecure bool   `json:"insecure"`
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeHTTPTiming,
+		Label: "HTTP Timing",
+		Kind:  KindTiming,
+		Config: []ConfigField{
+			{Key: "url", Type: "string", Default: "https://<address>/", Description: "URL to request"},
+			{Key: "insecure", Type: "bool", Default: false, Description: "Skip TLS certificate verification"},
+		},
+		New: func(spec Spec) (Prober, error) {
+			var cfg httpTimingProbeConfig
+			if err := decodeConfig(spec.Config, &cfg); err != nil {
+				return nil, err
+			}
+			if cfg.URL == "" {
+				host := spec.Address
+				if strings.Contains(host, ":") {
+					host = "[" + host + "]" // IPv6 literal
+				}
+				cfg.URL = "https://" + host + "/"
+			}
+			u, err := url.Parse(cfg.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid url %q: must be an http(s) URL", cfg.URL)
+			}
+			p := NewHTTPTimingProber(cfg.URL)
+			p.Insecure = cfg.Insecure
+			p.Family = spec.Family
+			return timingProber(p.Run), nil
+		},
+	})
+}
+
+func NewHTTPTimingProber(rawURL string) *HTTPTimingProber {
+	return &HTTPTimingProber{URL: rawURL, Timeout: 10 * time.Second, Family: FamilyAuto}
+}
+
+func (h *HTTPTimingProber) Run(ctx context.Context) (*HTTPTimingResult, error) {
+	network := "tcp"
+	switch h.Family {
+	case FamilyV4:
+		network = "tcp4"
+	case FamilyV6:
+		network = "tcp6"
+	}
+	dialer := &net.Dialer{Timeout: h.Timeout}
+
+	// A dedicated transport without keep-alives: every run pays for DNS,
+	// TCP and TLS again, which is exactly what we want to measure
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: h.Insecure},
+		TLSHandshakeTimeout: h.Timeout,
+		DisableKeepAlives:   true,
+		ForceAttemptHTTP2:   true,
+	}
+	defer transport.CloseIdleConnections()
+	// Redirects are not followed: a second request would mix its phases into
+	// this one's, so the first response is the one that gets timed
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   h.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var dnsStart, tlsStart, wrote time.Time
+	res := &HTTPTimingResult{URL: h.URL}
+
+	// Dual-stack dials race several connects in parallel (Happy Eyeballs), so
+	// each one is timed on its own and only the one that succeeded is kept
+	var connectMu sync.Mutex
+	connectStarts := make(map[string]time.Time)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { res.DNS = time.Since(dnsStart) },
+		ConnectStart: func(network, addr string) {
+			connectMu.Lock()
+			connectStarts[network+" "+addr] = time.Now()
+			connectMu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			connectMu.Lock()
+			defer connectMu.Unlock()
+			if err == nil {
+				res.Connect = time.Since(connectStarts[network+" "+addr])
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { res.TLS = time.Since(tlsStart) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				res.Addr = addr.IP.String()
+				res.Family = FamilyOf(addr.IP)
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { res.TTFB = time.Since(wrote) },
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.Header.Set("User-Agent", "RouteLens")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", ctxError(ctx, err))
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, httpTimingBodyLimit)); err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", ctxError(ctx, err))
+	}
+	res.Total = time.Since(start)
+	res.StatusCode = resp.StatusCode
+	res.Timestamp = time.Now()
+	return res, nil
+}
@@ -1,13 +1,13 @@
 package prober
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"time"
 
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
 type ICMPPinger struct {
@@ -15,7 +15,21 @@ type ICMPPinger struct {
 	Count      int
 	Interval   time.Duration
 	Timeout    time.Duration
-	Privileged bool // Set to true if running as root/sudo
+	Privileged bool          // Set to true if running as root/sudo
+	Family     AddressFamily // auto (default), v4 or v6
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeICMP,
+		Label: "ICMP",
+		Kind:  KindLatency,
+		New: func(spec Spec) (Prober, error) {
+			p := NewICMPPinger(spec.Address, 5)
+			p.Family = spec.Family
+			return pingProber(p.Run), nil
+		},
+	})
 }
 
 func NewICMPPinger(target string, count int) *ICMPPinger {
@@ -25,26 +39,31 @@ func NewICMPPinger(target string, count int) *ICMPPinger {
 		Interval:   time.Second,
 		Timeout:    2 * time.Second,
 		Privileged: os.Geteuid() == 0,
+		Family:     FamilyAuto,
 	}
 }
 
-func (p *ICMPPinger) Run() (*PingResult, error) {
-	dst, err := net.ResolveIPAddr("ip4", p.Target)
+func (p *ICMPPinger) Run(ctx context.Context) (*PingResult, error) {
+	dst, err := resolveTarget(ctx, p.Target, p.Family)
 	if err != nil {
 		return nil, err
 	}
+	fam := icmpFamilyFor(dst.IP)
 
-	network := "udp4"
-	if p.Privileged {
-		network = "ip4:icmp"
-	}
-
-	c, err := icmp.ListenPacket(network, "0.0.0.0")
+	c, err := fam.listen(p.Privileged)
 	if err != nil {
 		// Fallback suggestion in error
-		return nil, fmt.Errorf("listen packet failed (privileged=%v): %w", p.Privileged, err)
+		return nil, fmt.Errorf("listen packet failed (family=%s, privileged=%v): %w", fam.family, p.Privileged, err)
 	}
 	defer c.Close()
+	// Unblock a pending read as soon as the probe is cancelled
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	// Raw sockets see the replies of every concurrent ping, so each run uses
+	// its own echo ID
+	id := acquireEchoID()
+	defer releaseEchoID(id)
 
 	var rtts []time.Duration
 	var sent, recv int
@@ -52,7 +71,7 @@ func (p *ICMPPinger) Run() (*PingResult, error) {
 	// Loop for Count
 	for i := 0; i < p.Count; i++ {
 		sent++
-		rtt, err := p.sendPing(c, dst, i+1)
+		rtt, err := p.sendPing(c, fam, dst, id, i+1)
 
 		if err == nil {
 			recv++
@@ -61,72 +80,66 @@ func (p *ICMPPinger) Run() (*PingResult, error) {
 			// fmt.Printf("Ping error: %v\n", err) // Debug logging
 		}
 
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if i < p.Count-1 {
-			time.Sleep(p.Interval)
+			if err := sleepCtx(ctx, p.Interval); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return p.calculateStats(sent, recv, rtts), nil
+	res := calculateStats(sent, recv, rtts)
+	res.Family = fam.family
+	res.Addr = dst.IP.String()
+	return res, nil
 }
 
-func (p *ICMPPinger) sendPing(c *icmp.PacketConn, dst *net.IPAddr, seq int) (time.Duration, error) {
-	wm := icmp.Message{
-		Type: ipv4.ICMPTypeEcho, Code: 0,
-		Body: &icmp.Echo{
-			ID: os.Getpid() & 0xffff, Seq: seq,
-			Data: []byte("RouteLens-Ping"),
-		},
-	}
-	wb, err := wm.Marshal(nil)
+func (p *ICMPPinger) sendPing(c *icmp.PacketConn, fam icmpFamily, dst *net.IPAddr, id, seq int) (time.Duration, error) {
+	wb, err := fam.echoMessage(id, seq, []byte("RouteLens-Ping"))
 	if err != nil {
 		return 0, err
 	}
 
 	start := time.Now()
 
-	// Send
-	if p.Privileged {
-		if _, err := c.WriteTo(wb, dst); err != nil {
-			return 0, err
-		}
-	} else {
-		// For unprivileged usage (UDP), dst must be UDP address
-		udpDst := &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
-		if _, err := c.WriteTo(wb, udpDst); err != nil {
-			return 0, err
-		}
-	}
-
-	// Wait for reply
-	reply := make([]byte, 1500)
-	err = c.SetReadDeadline(time.Now().Add(p.Timeout))
-	if err != nil {
+	// Send (unprivileged datagram sockets expect a UDP address)
+	if _, err := c.WriteTo(wb, fam.dstAddr(dst, p.Privileged)); err != nil {
 		return 0, err
 	}
 
-	n, _, err := c.ReadFrom(reply)
-	if err != nil {
-		return 0, err
-	}
-
-	duration := time.Since(start)
-
-	// Parse reply
-	rm, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), reply[:n])
-	if err != nil {
+	// Wait for our reply; raw sockets also see unrelated ICMP traffic
+	// (other pings, ICMPv6 neighbor discovery), so keep reading until the deadline.
+	if err := c.SetReadDeadline(time.Now().Add(p.Timeout)); err != nil {
 		return 0, err
 	}
+	reply := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(reply)
+		if err != nil {
+			return 0, err
+		}
+		duration := time.Since(start)
 
-	switch rm.Type {
-	case ipv4.ICMPTypeEchoReply:
-		// Check ID/Seq if needed for strict matching, but for simple ping it's okay
+		rm, err := icmp.ParseMessage(fam.proto, reply[:n])
+		if err != nil || rm.Type != fam.echoReply {
+			continue
+		}
+		echo, ok := rm.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq {
+			continue
+		}
+		// The kernel rewrites the ID of unprivileged echo requests
+		if p.Privileged && (echo.ID != id || !addrIP(peer).Equal(dst.IP)) {
+			continue
+		}
 		return duration, nil
-	default:
-		return 0, fmt.Errorf("got non-echo reply: %+v", rm)
 	}
 }
 
-func (p *ICMPPinger) calculateStats(sent, recv int, rtts []time.Duration) *PingResult {
+// calculateStats summarizes a series of round trips; shared by all ping-style probes
+func calculateStats(sent, recv int, rtts []time.Duration) *PingResult {
 	res := &PingResult{
 		PacketsSent: sent,
 		PacketsRecv: recv,
@@ -1,6 +1,7 @@
 package prober
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os/exec"
@@ -12,6 +13,28 @@ type IperfProber struct {
 	Port   int
 }
 
+type iperfProbeConfig struct {
+	Port int `json:"port"`
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeIPERF,
+		Label: "IPERF",
+		Kind:  KindBandwidth,
+		Config: []ConfigField{
+			{Key: "port", Type: "int", Default: 5201, Description: "iperf3 server port"},
+		},
+		New: func(spec Spec) (Prober, error) {
+			var cfg iperfProbeConfig
+			if err := decodeConfig(spec.Config, &cfg); err != nil {
+				return nil, err
+			}
+			return speedProber(NewIperfProber(spec.Address, cfg.Port).Run), nil
+		},
+	})
+}
+
 func NewIperfProber(target string, port int) *IperfProber {
 	if port == 0 {
 		port = 5201
@@ -19,7 +42,7 @@ func NewIperfProber(target string, port int) *IperfProber {
 	return &IperfProber{Target: target, Port: port}
 }
 
-func (p *IperfProber) Run() (*SpeedResult, error) {
+func (p *IperfProber) Run(ctx context.Context) (*SpeedResult, error) {
 	// SECURITY: Validate target before passing to exec.Command
 	if err := ValidateTarget(p.Target); err != nil {
 		return nil, fmt.Errorf("invalid target: %w", err)
@@ -33,10 +56,10 @@ func (p *IperfProber) Run() (*SpeedResult, error) {
 	// SECURITY: Using argument separation (not shell string concatenation)
 	// Execute: iperf3 -c <target> -p <port> -J -t 5
 	// -J is for JSON output
-	cmd := exec.Command("iperf3", "-c", p.Target, "-p", fmt.Sprintf("%d", p.Port), "-J", "-t", "5")
+	cmd := exec.CommandContext(ctx, "iperf3", "-c", p.Target, "-p", fmt.Sprintf("%d", p.Port), "-J", "-t", "5")
 	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("iperf3 execution failed: %w", err)
+		return nil, fmt.Errorf("iperf3 execution failed: %w", ctxError(ctx, err))
 	}
 
 	var data struct {
@@ -1,6 +1,7 @@
 package prober
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os/exec"
@@ -20,6 +21,9 @@ type MTRHop struct {
 
 type MTRResult struct {
 	Target    string
+	Family    AddressFamily
+	Method    TraceMethod // Probe packets (the mtr binary always uses icmp)
+	Port      int         // Destination port of udp/tcp probes
 	Hops      []MTRHop
 	Timestamp time.Time
 }
@@ -45,13 +49,34 @@ type mtrReport struct {
 type MTRRunner struct {
 	Target string
 	Count  int
+	Family AddressFamily // auto (default), v4 or v6
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  TracerBinary,
+		Label: "MTR (binary)",
+		Kind:  KindTrace,
+		New: func(spec Spec) (Prober, error) {
+			opts, err := ParseTraceOptions(spec.Config)
+			if err != nil {
+				return nil, err
+			}
+			if opts.Method != TraceICMP {
+				return nil, fmt.Errorf("the mtr binary only traces with icmp, not %s", opts.Method)
+			}
+			r := NewMTRRunner(spec.Address)
+			r.Family = spec.Family
+			return mtrProber(r.Run), nil
+		},
+	})
 }
 
 func NewMTRRunner(target string) *MTRRunner {
-	return &MTRRunner{Target: target, Count: 10}
+	return &MTRRunner{Target: target, Count: 10, Family: FamilyAuto}
 }
 
-func (r *MTRRunner) Run() (*MTRResult, error) {
+func (r *MTRRunner) Run(ctx context.Context) (*MTRResult, error) {
 	// SECURITY: Validate target before passing to exec.Command
 	if err := ValidateTarget(r.Target); err != nil {
 		return nil, fmt.Errorf("invalid target: %w", err)
@@ -67,11 +92,22 @@ func (r *MTRRunner) Run() (*MTRResult, error) {
 		count = 10
 	}
 
+	// Pin the family the same way the pinger resolves it, so both agree on dual-stack hosts
+	dst, err := resolveTarget(ctx, r.Target, r.Family)
+	if err != nil {
+		return nil, err
+	}
+	family := FamilyOf(dst.IP)
+	familyFlag := "-4"
+	if family == FamilyV6 {
+		familyFlag = "-6"
+	}
+
 	// SECURITY: Using argument separation (not shell string concatenation)
-	cmd := exec.Command("mtr", "--json", "-c", fmt.Sprintf("%d", count), r.Target)
+	cmd := exec.CommandContext(ctx, "mtr", "--json", familyFlag, "-c", fmt.Sprintf("%d", count), r.Target)
 	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("mtr execution failed: %w", err)
+		return nil, fmt.Errorf("mtr execution failed: %w", ctxError(ctx, err))
 	}
 
 	var data mtrReport
@@ -81,6 +117,8 @@ func (r *MTRRunner) Run() (*MTRResult, error) {
 
 	res := &MTRResult{
 		Target:    data.Report.MTR.Dst,
+		Method:    TraceICMP,
+		Family:    family,
 		Timestamp: time.Now(),
 	}
 
@@ -0,0 +1,244 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NativeMTRRunner is a pure-Go MTR built on the traceroute sockets.
+// Each round sends one probe per TTL without waiting for answers, so
+// every hop is probed concurrently; Count rounds are aggregated per hop into
+// the same MTRResult the mtr binary produces.
+type NativeMTRRunner struct {
+	Target   string
+	Count    int           // Rounds, i.e. probes per hop
+	MaxHops  int           // Highest TTL probed
+	Interval time.Duration // Delay between rounds
+	Timeout  time.Duration // How long a probe may stay unanswered
+	Family   AddressFamily // auto (default), v4 or v6
+	Method   TraceMethod   // icmp (default), udp or tcp
+	Port     int           // Destination port of udp/tcp probes (0: method default)
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  TracerNative,
+		Label: "MTR (built-in)",
+		Kind:  KindTrace,
+		New: func(spec Spec) (Prober, error) {
+			opts, err := ParseTraceOptions(spec.Config)
+			if err != nil {
+				return nil, err
+			}
+			r := NewNativeMTRRunner(spec.Address)
+			r.Family = spec.Family
+			r.Method = opts.Method
+			r.Port = opts.Port
+			return mtrProber(r.Run), nil
+		},
+	})
+}
+
+func NewNativeMTRRunner(target string) *NativeMTRRunner {
+	return &NativeMTRRunner{
+		Target:   target,
+		Count:    10,
+		MaxHops:  30,
+		Interval: time.Second,
+		Timeout:  2 * time.Second,
+		Family:   FamilyAuto,
+		Method:   TraceICMP,
+	}
+}
+
+// mtrProbe is one in-flight probe
+type mtrProbe struct {
+	ttl  int
+	sent time.Time
+}
+
+// mtrHopStats accumulates the answers seen for one TTL
+type mtrHopStats struct {
+	sent  int
+	rtts  []time.Duration
+	last  time.Duration
+	hosts map[string]int // Responder -> answer count (load-balanced hops vary)
+}
+
+func (r *NativeMTRRunner) Run(ctx context.Context) (*MTRResult, error) {
+	// Security: Validate target before use
+	if err := ValidateTarget(r.Target); err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	dst, err := resolveTarget(ctx, r.Target, r.Family)
+	if err != nil {
+		return nil, err
+	}
+	fam := icmpFamilyFor(dst.IP)
+
+	opts, err := TraceOptions{Method: r.Method, Port: r.Port}.normalize()
+	if err != nil {
+		return nil, err
+	}
+	c, err := openTraceConn(fam, dst, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	count, maxHops, timeout := r.Count, r.MaxHops, r.Timeout
+	if count <= 0 {
+		count = 10
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if maxHops <= 0 || maxHops > 64 {
+		maxHops = 30
+	}
+
+	var mu sync.Mutex
+	inflight := make(map[int]mtrProbe)
+	stats := make([]mtrHopStats, maxHops+1) // Indexed by TTL
+	destTTL := 0                            // Lowest TTL answered by the destination
+
+	// Receiver: match answers to in-flight probes until the socket is closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			reply, err := c.recv(time.Now().Add(time.Hour))
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			probe, ok := inflight[reply.seq]
+			if ok {
+				delete(inflight, reply.seq)
+			}
+			// Answers later than Timeout count as lost, as in mtr
+			if ok && reply.at.Sub(probe.sent) <= timeout {
+				st := &stats[probe.ttl]
+				rtt := reply.at.Sub(probe.sent)
+				st.rtts = append(st.rtts, rtt)
+				st.last = rtt
+				if reply.peer != nil {
+					if st.hosts == nil {
+						st.hosts = make(map[string]int)
+					}
+					st.hosts[reply.peer.String()]++
+				}
+				if reply.kind != replyTimeExceeded || reply.peer.Equal(dst.IP) {
+					if destTTL == 0 || probe.ttl < destTTL {
+						destTTL = probe.ttl
+					}
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	seq := 0
+	for round := 0; round < count; round++ {
+		mu.Lock()
+		limit := maxHops
+		if destTTL > 0 {
+			limit = destTTL
+		}
+		mu.Unlock()
+
+		for ttl := 1; ttl <= limit; ttl++ {
+			seq = seq%0xffff + 1
+			mu.Lock()
+			inflight[seq] = mtrProbe{ttl: ttl, sent: time.Now()}
+			stats[ttl].sent++
+			mu.Unlock()
+			if err := c.send(ttl, seq); err != nil {
+				mu.Lock()
+				delete(inflight, seq)
+				stats[ttl].sent--
+				mu.Unlock()
+			}
+		}
+
+		if round < count-1 {
+			if sleepCtx(ctx, r.Interval) != nil {
+				break
+			}
+		}
+	}
+
+	// Give the last round time to answer, then stop the receiver
+	sleepCtx(ctx, timeout)
+	c.Close()
+	<-done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res := r.buildResult(stats, destTTL, fam.family)
+	res.Method, res.Port = opts.Method, opts.Port
+	return res, nil
+}
+
+// buildResult converts per-TTL stats into MTR hops. Hops past the destination
+// are dropped; when the destination never answered, trailing silent hops are
+// collapsed into a single "???" hop so the last hop shows 100% loss like mtr.
+func (r *NativeMTRRunner) buildResult(stats []mtrHopStats, destTTL int, family AddressFamily) *MTRResult {
+	last := destTTL
+	if last == 0 {
+		for ttl := 1; ttl < len(stats); ttl++ {
+			if len(stats[ttl].rtts) > 0 {
+				last = ttl
+			}
+		}
+		if last+1 < len(stats) && stats[last+1].sent > 0 {
+			last++ // Keep one silent hop to mark the unreachable destination
+		}
+	}
+
+	res := &MTRResult{Target: r.Target, Family: family, Timestamp: time.Now()}
+
+	for ttl := 1; ttl <= last; ttl++ {
+		st := stats[ttl]
+		hop := MTRHop{Hop: ttl, Host: "???", Loss: 100}
+		if st.sent > 0 {
+			hop.Loss = float64(st.sent-len(st.rtts)) / float64(st.sent) * 100.0
+		}
+		if len(st.rtts) > 0 {
+			hop.Host = mostFrequent(st.hosts)
+			best, worst, total := st.rtts[0], st.rtts[0], time.Duration(0)
+			for _, rtt := range st.rtts {
+				if rtt < best {
+					best = rtt
+				}
+				if rtt > worst {
+					worst = rtt
+				}
+				total += rtt
+			}
+			hop.Last = durationMs(st.last)
+			hop.Avg = durationMs(total / time.Duration(len(st.rtts)))
+			hop.Best = durationMs(best)
+			hop.Worst = durationMs(worst)
+		}
+		res.Hops = append(res.Hops, hop)
+	}
+	return res
+}
+
+func mostFrequent(hosts map[string]int) string {
+	best, bestN := "???", 0
+	for h, n := range hosts {
+		if n > bestN || (n == bestN && h < best) {
+			best, bestN = h, n
+		}
+	}
+	return best
+}
+
+// durationMs converts a duration to fractional milliseconds, as mtr reports them
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
@@ -1,6 +1,8 @@
 package prober
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -40,6 +42,33 @@ func ValidateTarget(target string) error {
 	return nil
 }
 
+// IsTimeout reports whether a probe error means the probe ran out of time
+func IsTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// ctxError prefers the context's error once ctx is done, so that a probe
+// aborted by its deadline or by shutdown is not reported as a network failure
+// (a closed socket, a killed process, ...)
+func ctxError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return fmt.Errorf("%w (%v)", ctxErr, err)
+	}
+	return err
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // SpeedResult holds the result of a bandwidth test
 type SpeedResult struct {
 	UploadSpeed   float64 // Mbps
@@ -57,6 +86,8 @@ type PingResult struct {
 	AvgRtt      time.Duration
 	LossRate    float64 // Percentage 0.0 - 100.0
 	Timestamp   time.Time
+	Family      AddressFamily // Family actually used (v4 or v6)
+	Addr        string        // Resolved address that was probed
 }
 
 // HopInfo represents a single hop in a traceroute
@@ -73,6 +104,9 @@ type HopInfo struct {
 // TraceResult holds the result of a traceroute
 type TraceResult struct {
 	Target    string
+	Family    AddressFamily
+	Method    TraceMethod
+	Port      int // Destination port of udp/tcp probes
 	Hops      []HopInfo
 	Timestamp time.Time
 }
@@ -0,0 +1,245 @@
+package prober
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Probe mode identifiers as persisted in Target.ProbeType
+const (
+	ModeICMP       = "MODE_ICMP"
+	ModeHTTP       = "MODE_HTTP"
+	ModeSSH        = "MODE_SSH"
+	ModeIPERF      = "MODE_IPERF"
+	ModeTCP        = "MODE_TCP"
+	ModeHTTPTiming = "MODE_HTTP_TIMING"
+	ModeDNS        = "MODE_DNS"
+)
+
+// Trace engines, registered with KindTrace. They trace the route of every
+// target in the ping/trace cycle and cannot be picked as a target's mode.
+const (
+	TracerNative     = "TRACE_NATIVE"     // Built-in MTR, any trace method
+	TracerBinary     = "TRACE_MTR"        // The mtr binary, ICMP only
+	TracerTraceroute = "TRACE_TRACEROUTE" // Single-pass traceroute, the last resort
+)
+
+// Kind decides which monitor cycle a probe mode runs in
+type Kind string
+
+const (
+	// KindLatency probes run alongside the ping/trace cycle
+	KindLatency Kind = "latency"
+	// KindBandwidth probes run in the (less frequent) speed test cycle
+	KindBandwidth Kind = "bandwidth"
+	// KindTiming probes run alongside the ping/trace cycle and record
+	// request phase timings next to the ping latency
+	KindTiming Kind = "timing"
+	// KindDNS probes run alongside the ping/trace cycle and record resolver answers
+	KindDNS Kind = "dns"
+	// KindTrace probes are the trace engines of the ping/trace cycle
+	KindTrace Kind = "trace"
+)
+
+// Result is the outcome of a single Prober run.
+// Only the field matching the probe's Kind is populated.
+type Result struct {
+	Ping  *PingResult
+	Speed *SpeedResult
+	HTTP  *HTTPTimingResult
+	DNS   *DNSResult
+	MTR   *MTRResult   // Per-hop statistics of a native or binary MTR
+	Trace *TraceResult // Single-pass traceroute
+}
+
+// Prober is a probe bound to one target and its configuration.
+// Run must return promptly once ctx is done; a probe that ran out of time
+// returns an error wrapping ctx.Err() (see IsTimeout).
+type Prober interface {
+	Run(ctx context.Context) (*Result, error)
+}
+
+// ProberFunc adapts a plain function to the Prober interface
+type ProberFunc func(ctx context.Context) (*Result, error)
+
+func (f ProberFunc) Run(ctx context.Context) (*Result, error) {
+	return f(ctx)
+}
+
+// ConfigField documents one key of a probe mode's JSON config
+type ConfigField struct {
+	Key         string      `json:"key"`
+	Type        string      `json:"type"` // string, int, bool, secret, list (of strings)
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// Spec identifies the target a Prober is built for
+type Spec struct {
+	Address string
+	Family  AddressFamily // auto, v4 or v6
+	Config  string        // Raw ProbeConfig JSON
+}
+
+// Factory builds a Prober from a Spec.
+// Factories must not perform I/O: they are also used to validate configs.
+type Factory func(spec Spec) (Prober, error)
+
+// Descriptor describes a registered probe mode
+type Descriptor struct {
+	Type   string        `json:"type"`
+	Label  string        `json:"label"`
+	Kind   Kind          `json:"kind"`
+	Config []ConfigField `json:"config"`
+	New    Factory       `json:"-"`
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Descriptor)
+)
+
+// Register adds a probe mode to the registry. The trace options shared by all
+// modes are appended to its config schema.
+// It panics on an empty or duplicate type, as registration happens in init().
+func Register(d Descriptor) {
+	if d.Type == "" || d.New == nil {
+		panic("prober: Register requires a type and a factory")
+	}
+	d.Config = append(append([]ConfigField(nil), d.Config...), traceConfigFields...)
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[d.Type]; exists {
+		panic(fmt.Sprintf("prober: duplicate registration for %s", d.Type))
+	}
+	registry[d.Type] = d
+}
+
+// Lookup returns the descriptor registered for probeType
+func Lookup(probeType string) (Descriptor, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	d, ok := registry[probeType]
+	return d, ok
+}
+
+// Descriptors returns the probe modes a target can use sorted by type; the
+// trace engines are left out
+func Descriptors() []Descriptor {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	list := make([]Descriptor, 0, len(registry))
+	for _, d := range registry {
+		if d.Kind != KindTrace {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Type < list[j].Type })
+	return list
+}
+
+// SecretKeys returns the config keys of a probe type that hold secrets
+// (type "secret"), which are encrypted at rest and never sent back to clients
+func SecretKeys(probeType string) []string {
+	d, ok := Lookup(probeType)
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for _, f := range d.Config {
+		if f.Type == "secret" {
+			keys = append(keys, f.Key)
+		}
+	}
+	return keys
+}
+
+// New builds a Prober of the given probe type
+func New(probeType string, spec Spec) (Prober, error) {
+	d, ok := Lookup(probeType)
+	if !ok {
+		return nil, fmt.Errorf("unknown probe type: %s", probeType)
+	}
+	return d.New(spec)
+}
+
+// decodeConfig unmarshals a raw ProbeConfig into v. An empty config leaves v untouched.
+func decodeConfig(raw string, v interface{}) error {
+	if raw == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(raw), v); err != nil {
+		return fmt.Errorf("invalid probe config: %w", err)
+	}
+	return nil
+}
+
+// pingProber wraps a ping-style runner as a latency Prober
+func pingProber(run func(context.Context) (*PingResult, error)) Prober {
+	return ProberFunc(func(ctx context.Context) (*Result, error) {
+		res, err := run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Ping: res}, nil
+	})
+}
+
+// speedProber wraps a bandwidth runner as a bandwidth Prober
+func speedProber(run func(context.Context) (*SpeedResult, error)) Prober {
+	return ProberFunc(func(ctx context.Context) (*Result, error) {
+		res, err := run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Speed: res}, nil
+	})
+}
+
+// timingProber wraps an HTTP timing runner as a timing Prober
+func timingProber(run func(context.Context) (*HTTPTimingResult, error)) Prober {
+	return ProberFunc(func(ctx context.Context) (*Result, error) {
+		res, err := run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{HTTP: res}, nil
+	})
+}
+
+// dnsProber wraps a DNS runner as a DNS Prober
+func dnsProber(run func(context.Context) (*DNSResult, error)) Prober {
+	return ProberFunc(func(ctx context.Context) (*Result, error) {
+		res, err := run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{DNS: res}, nil
+	})
+}
+
+// mtrProber wraps an MTR runner as a trace Prober
+func mtrProber(run func(context.Context) (*MTRResult, error)) Prober {
+	return ProberFunc(func(ctx context.Context) (*Result, error) {
+		res, err := run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{MTR: res}, nil
+	})
+}
+
+// traceProber wraps a traceroute runner as a trace Prober
+func traceProber(run func(context.Context) (*TraceResult, error)) Prober {
+	return ProberFunc(func(ctx context.Context) (*Result, error) {
+		res, err := run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Trace: res}, nil
+	})
+}
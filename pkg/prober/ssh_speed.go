@@ -1,8 +1,10 @@
 package prober
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -25,6 +27,65 @@ type SSHConfig struct {
 	TestBytes int64 // How many bytes to test. If 0, uses DefaultTestSize
 }
 
+type sshProbeConfig struct {
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	KeyPath   string `json:"key_path"`
+	KeyText   string `json:"key_text"`
+	Port      int    `json:"port"`
+	TestBytes int64  `json:"test_bytes"`
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeSSH,
+		Label: "SSH",
+		Kind:  KindBandwidth,
+		Config: []ConfigField{
+			{Key: "user", Type: "string", Required: true, Description: "SSH login user"},
+			{Key: "password", Type: "secret", Description: "SSH password"},
+			{Key: "key_path", Type: "string", Description: "Path to a private key on the server"},
+			{Key: "key_text", Type: "secret", Description: "Inline private key (PEM)"},
+			{Key: "port", Type: "int", Default: 22},
+			{Key: "test_bytes", Type: "int", Default: 20 * 1024 * 1024, Description: "Bytes transferred per direction"},
+		},
+		New: func(spec Spec) (Prober, error) {
+			cfg, err := ParseSSHConfig(spec.Config)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Host = spec.Address
+			return speedProber(NewSSHSpeedTester(cfg).Run), nil
+		},
+	})
+}
+
+// ParseSSHConfig converts a target's raw ProbeConfig into an SSHConfig (Host is left empty)
+func ParseSSHConfig(raw string) (SSHConfig, error) {
+	if raw == "" {
+		return SSHConfig{}, fmt.Errorf("ssh config is required")
+	}
+	var cfg sshProbeConfig
+	if err := decodeConfig(raw, &cfg); err != nil {
+		return SSHConfig{}, err
+	}
+	sshCfg := SSHConfig{
+		User:      cfg.User,
+		Password:  cfg.Password,
+		KeyPath:   cfg.KeyPath,
+		KeyText:   cfg.KeyText,
+		Port:      cfg.Port,
+		TestBytes: cfg.TestBytes,
+	}
+	if sshCfg.Port == 0 {
+		sshCfg.Port = 22
+	}
+	if sshCfg.TestBytes == 0 {
+		sshCfg.TestBytes = 20 * 1024 * 1024
+	}
+	return sshCfg, nil
+}
+
 // SSHSpeedTester handles the SSH connection and speed measurement
 type SSHSpeedTester struct {
 	config SSHConfig
@@ -40,12 +101,15 @@ func NewSSHSpeedTester(cfg SSHConfig) *SSHSpeedTester {
 	return &SSHSpeedTester{config: cfg}
 }
 
-func (s *SSHSpeedTester) Run() (*SpeedResult, error) {
+func (s *SSHSpeedTester) Run(ctx context.Context) (*SpeedResult, error) {
 	target := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
 	logging.Info("ssh", "[SSH] Starting speed test for %s@%s", s.config.User, target)
 
-	client, err := s.connect()
+	client, err := s.connect(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ssh connection failed: %w", ctxError(ctx, err))
+		}
 		// Categorize SSH connection errors for better diagnostics
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "unable to authenticate") || strings.Contains(errMsg, "no supported methods") {
@@ -62,6 +126,9 @@ func (s *SSHSpeedTester) Run() (*SpeedResult, error) {
 		return nil, fmt.Errorf("ssh connection failed: %w", err)
 	}
 	defer client.Close()
+	// Closing the client aborts running sessions, so cancellation cannot hang on a stalled transfer
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
 	logging.Info("ssh", "[SSH] Connected to %s successfully", target)
 
 	result := &SpeedResult{
@@ -72,7 +139,11 @@ func (s *SSHSpeedTester) Run() (*SpeedResult, error) {
 	// Command: cat /dev/zero | head -c <TestBytes>
 	logging.Debug("ssh", "[SSH] Starting download test for %s (%d bytes)", target, s.config.TestBytes)
 	downSpeed, err := s.measureDownload(client)
+	if err == nil {
+		err = ctx.Err() // A cancelled session ends like a short transfer
+	}
 	if err != nil {
+		err = ctxError(ctx, err)
 		logging.Error("ssh", "[SSH] Download test failed for %s: %v", target, err)
 		return nil, fmt.Errorf("download test failed: %w", err)
 	}
@@ -83,7 +154,11 @@ func (s *SSHSpeedTester) Run() (*SpeedResult, error) {
 	// Command: cat > /dev/null
 	logging.Debug("ssh", "[SSH] Starting upload test for %s (%d bytes)", target, s.config.TestBytes)
 	upSpeed, err := s.measureUpload(client)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
+		err = ctxError(ctx, err)
 		logging.Error("ssh", "[SSH] Upload test failed for %s: %v", target, err)
 		return nil, fmt.Errorf("upload test failed: %w", err)
 	}
@@ -93,7 +168,7 @@ func (s *SSHSpeedTester) Run() (*SpeedResult, error) {
 	return result, nil
 }
 
-func (s *SSHSpeedTester) connect() (*ssh.Client, error) {
+func (s *SSHSpeedTester) connect(ctx context.Context) (*ssh.Client, error) {
 	auths := []ssh.AuthMethod{}
 	if s.config.Password != "" {
 		auths = append(auths, ssh.Password(s.config.Password))
@@ -122,7 +197,23 @@ func (s *SSHSpeedTester) connect() (*ssh.Client, error) {
 	}
 
 	target := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
-	return ssh.Dial("tcp", target, config)
+	conn, err := (&net.Dialer{Timeout: s.config.Timeout}).DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	// ssh.NewClientConn has no context: bound the handshake by closing the conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if s.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, target, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
 func (s *SSHSpeedTester) measureDownload(client *ssh.Client) (float64, error) {
@@ -0,0 +1,115 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TCPPinger measures TCP handshake time to a port, for targets that drop ICMP.
+// Each attempt opens and immediately closes a connection; attempts that are
+// refused or time out count as lost.
+type TCPPinger struct {
+	Target   string
+	Port     int
+	Count    int
+	Interval time.Duration
+	Timeout  time.Duration
+	Family   AddressFamily // auto (default), v4 or v6
+}
+
+type tcpProbeConfig struct {
+	Port  int `json:"port"`
+	Count int `json:"count"`
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  ModeTCP,
+		Label: "TCP",
+		Kind:  KindLatency,
+		Config: []ConfigField{
+			{Key: "port", Type: "int", Default: 443, Description: "TCP port to connect to"},
+			{Key: "count", Type: "int", Default: 5, Description: "Connections per probe"},
+		},
+		New: func(spec Spec) (Prober, error) {
+			var cfg tcpProbeConfig
+			if err := decodeConfig(spec.Config, &cfg); err != nil {
+				return nil, err
+			}
+			if cfg.Port < 0 || cfg.Port > 65535 {
+				return nil, fmt.Errorf("invalid port: must be 0 (default) or between 1 and 65535")
+			}
+			if cfg.Count < 0 || cfg.Count > 100 {
+				return nil, fmt.Errorf("invalid count: must be 0 (default) or between 1 and 100")
+			}
+			p := NewTCPPinger(spec.Address, cfg.Port, cfg.Count)
+			p.Family = spec.Family
+			return pingProber(p.Run), nil
+		},
+	})
+}
+
+func NewTCPPinger(target string, port, count int) *TCPPinger {
+	if port == 0 {
+		port = 443
+	}
+	if count == 0 {
+		count = 5
+	}
+	return &TCPPinger{
+		Target:   target,
+		Port:     port,
+		Count:    count,
+		Interval: time.Second,
+		Timeout:  2 * time.Second,
+		Family:   FamilyAuto,
+	}
+}
+
+func (p *TCPPinger) Run(ctx context.Context) (*PingResult, error) {
+	// Security: Validate target before use
+	if err := ValidateTarget(p.Target); err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	dst, err := resolveTarget(ctx, p.Target, p.Family)
+	if err != nil {
+		return nil, err
+	}
+	network := "tcp4"
+	if FamilyOf(dst.IP) == FamilyV6 {
+		network = "tcp6"
+	}
+	addr := net.JoinHostPort(dst.String(), strconv.Itoa(p.Port))
+
+	var rtts []time.Duration
+	var sent, recv int
+	dialer := &net.Dialer{Timeout: p.Timeout}
+
+	for i := 0; i < p.Count; i++ {
+		sent++
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			recv++
+			rtts = append(rtts, time.Since(start))
+			conn.Close()
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if i < p.Count-1 {
+			if err := sleepCtx(ctx, p.Interval); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	res := calculateStats(sent, recv, rtts)
+	res.Family = FamilyOf(dst.IP)
+	res.Addr = dst.IP.String()
+	return res, nil
+}
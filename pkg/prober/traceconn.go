@@ -0,0 +1,183 @@
+package prober
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// replyKind classifies an ICMP answer to a TTL-limited probe
+type replyKind int
+
+const (
+	replyTimeExceeded replyKind = iota // Intermediate router
+	replyEcho                          // Destination answered
+	replyUnreachable                   // Destination (or a router) rejected the probe
+)
+
+// traceReply is an answer matched to one of our probes
+type traceReply struct {
+	peer net.IP
+	seq  int
+	kind replyKind
+	at   time.Time
+}
+
+// traceConn sends TTL-limited probes and reports who answered them
+type traceConn interface {
+	send(ttl, seq int) error
+	recv(deadline time.Time) (*traceReply, error)
+	Close() error
+}
+
+// openTraceConn opens the sockets for the given trace method. ICMP prefers a
+// raw socket and falls back to an unprivileged datagram socket with kernel
+// error reporting where the platform supports it; UDP and TCP need raw sockets.
+func openTraceConn(fam icmpFamily, dst *net.IPAddr, opts TraceOptions) (traceConn, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Method {
+	case TraceUDP:
+		return newUDPTraceConn(fam, dst, opts.Port)
+	case TraceTCP:
+		return newTCPTraceConn(fam, dst, opts.Port)
+	}
+
+	rc, rawErr := newRawTraceConn(fam, dst)
+	if rawErr == nil {
+		return rc, nil
+	}
+	dc, err := newDgramTraceConn(fam, dst)
+	if err != nil {
+		return nil, fmt.Errorf("traceroute requires root privileges (%v) or unprivileged ICMP sockets (%v)", rawErr, err)
+	}
+	return dc, nil
+}
+
+// rawTraceConn uses a privileged raw ICMP socket, which receives the
+// time-exceeded messages directly. The socket also sees the ICMP traffic of
+// every other run, so answers must carry our echo ID and concern our target.
+type rawTraceConn struct {
+	c   *icmp.PacketConn
+	fam icmpFamily
+	dst *net.IPAddr
+	id  int
+	buf []byte
+
+	releaseID sync.Once
+}
+
+func newRawTraceConn(fam icmpFamily, dst *net.IPAddr) (*rawTraceConn, error) {
+	c, err := fam.listen(true)
+	if err != nil {
+		return nil, err
+	}
+	return &rawTraceConn{c: c, fam: fam, dst: dst, id: acquireEchoID(), buf: make([]byte, 1500)}, nil
+}
+
+func (r *rawTraceConn) send(ttl, seq int) error {
+	wb, err := r.fam.echoMessage(r.id, seq, parisPayload(seq))
+	if err != nil {
+		return err
+	}
+	if err := r.fam.setTTL(r.c, ttl); err != nil {
+		return err
+	}
+	_, err = r.c.WriteTo(wb, r.dst)
+	return err
+}
+
+func (r *rawTraceConn) recv(deadline time.Time) (*traceReply, error) {
+	if err := r.c.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for {
+		n, peer, err := r.c.ReadFrom(r.buf)
+		if err != nil {
+			return nil, err
+		}
+		at := time.Now()
+		rm, err := icmp.ParseMessage(r.fam.proto, r.buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if rm.Type == r.fam.echoReply {
+			echo, ok := rm.Body.(*icmp.Echo)
+			if !ok || echo.ID != r.id || !addrIP(peer).Equal(r.dst.IP) {
+				continue
+			}
+			return &traceReply{peer: addrIP(peer), seq: echo.Seq, kind: replyEcho, at: at}, nil
+		}
+
+		ie := r.fam.parseError(rm, peer, at)
+		if ie == nil {
+			continue
+		}
+		id, seq, ok := r.fam.quotedEcho(ie.quoted)
+		if !ok || id != r.id || !r.fam.quotedDst(ie.quoted).Equal(r.dst.IP) {
+			continue // Someone else's probe
+		}
+		return &traceReply{peer: ie.peer, seq: seq, kind: ie.kind, at: at}, nil
+	}
+}
+
+func (r *rawTraceConn) Close() error {
+	err := r.c.Close()
+	r.releaseID.Do(func() { releaseEchoID(r.id) })
+	return err
+}
+
+// addrIP extracts the IP from the address types returned by ICMP endpoints
+func addrIP(a net.Addr) net.IP {
+	switch v := a.(type) {
+	case *net.IPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	}
+	return nil
+}
+
+// parisPayload is the echo payload for probe seq. Its last word cancels seq
+// out of the ICMP checksum, so all probes of a trace carry the same checksum
+// and are hashed onto the same path by load balancers that look at it.
+func parisPayload(seq int) []byte {
+	b := append([]byte("RouteLens-Trace!"), 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], ^uint16(seq))
+	return b
+}
+
+// icmpError is a time-exceeded or unreachable message received on a raw ICMP socket
+type icmpError struct {
+	peer   net.IP
+	kind   replyKind
+	quoted []byte // The offending datagram, starting at its IP header
+	at     time.Time
+}
+
+// parseError returns the ICMP error carried by rm, or nil for other messages
+func (f icmpFamily) parseError(rm *icmp.Message, peer net.Addr, at time.Time) *icmpError {
+	ie := &icmpError{peer: addrIP(peer), at: at}
+	switch rm.Type {
+	case f.timeExceeded:
+		ie.kind = replyTimeExceeded
+		if b, ok := rm.Body.(*icmp.TimeExceeded); ok {
+			ie.quoted = b.Data
+		}
+	case f.unreachable:
+		ie.kind = replyUnreachable
+		if b, ok := rm.Body.(*icmp.DstUnreach); ok {
+			ie.quoted = b.Data
+		}
+	default:
+		return nil
+	}
+	return ie
+}
@@ -0,0 +1,335 @@
+package prober
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IP protocol numbers of the transport headers we send
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// udpPayloadSpan bounds the payload lengths used to tell UDP probes apart
+const udpPayloadSpan = 512
+
+// replyQueue hands answers from background socket readers to recv.
+// UDP and TCP traces listen on more than one socket, so they cannot simply
+// block on a single read like the ICMP connections do.
+type replyQueue struct {
+	ch        chan *traceReply
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplyQueue() *replyQueue {
+	return &replyQueue{ch: make(chan *traceReply, 64), closed: make(chan struct{})}
+}
+
+func (q *replyQueue) push(r *traceReply) {
+	select {
+	case q.ch <- r:
+	case <-q.closed:
+	}
+}
+
+func (q *replyQueue) recv(deadline time.Time) (*traceReply, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-q.ch:
+		return r, nil
+	case <-timer.C:
+		return nil, os.ErrDeadlineExceeded
+	case <-q.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *replyQueue) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// readICMPErrors feeds ICMP errors quoting our datagrams into q until c is
+// closed. match maps the quoted transport header to a probe sequence number.
+func readICMPErrors(c *icmp.PacketConn, fam icmpFamily, q *replyQueue, match func(proto int, transport []byte) (int, bool)) {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		rm, err := icmp.ParseMessage(fam.proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		ie := fam.parseError(rm, peer, at)
+		if ie == nil {
+			continue
+		}
+		proto, transport, ok := fam.quotedTransport(ie.quoted)
+		if !ok {
+			continue
+		}
+		seq, ok := match(proto, transport)
+		if !ok {
+			continue // Someone else's datagram
+		}
+		q.push(&traceReply{peer: ie.peer, seq: seq, kind: ie.kind, at: at})
+	}
+}
+
+// packetTTL returns a setter for the TTL (hop limit) of packets sent on c
+func packetTTL(c net.PacketConn, family AddressFamily) func(int) error {
+	if family == FamilyV6 {
+		return ipv6.NewPacketConn(c).SetHopLimit
+	}
+	return ipv4.NewPacketConn(c).SetTTL
+}
+
+// udpTraceConn sends UDP datagrams from one source port to one destination
+// port. Routers only have to quote the first 8 bytes of the transport header,
+// so probes are told apart by their length (the UDP length field) rather
+// than by ports, which would change the flow.
+type udpTraceConn struct {
+	udp    *net.UDPConn
+	icmp   *icmp.PacketConn
+	dst    *net.UDPAddr
+	local  int
+	setTTL func(int) error
+	q      *replyQueue
+
+	mu   sync.Mutex
+	seqs map[int]int // Payload length -> seq of the probe last sent with it
+}
+
+func newUDPTraceConn(fam icmpFamily, dst *net.IPAddr, port int) (traceConn, error) {
+	ic, err := fam.listen(true)
+	if err != nil {
+		return nil, fmt.Errorf("udp traceroute requires root privileges: %w", err)
+	}
+	network := "udp4"
+	if fam.family == FamilyV6 {
+		network = "udp6"
+	}
+	uc, err := net.ListenUDP(network, nil)
+	if err != nil {
+		ic.Close()
+		return nil, err
+	}
+
+	u := &udpTraceConn{
+		udp:    uc,
+		icmp:   ic,
+		dst:    &net.UDPAddr{IP: dst.IP, Port: port, Zone: dst.Zone},
+		local:  uc.LocalAddr().(*net.UDPAddr).Port,
+		setTTL: packetTTL(uc, fam.family),
+		q:      newReplyQueue(),
+		seqs:   make(map[int]int),
+	}
+	go readICMPErrors(ic, fam, u.q, u.match)
+	return u, nil
+}
+
+func (u *udpTraceConn) send(ttl, seq int) error {
+	size := seq % udpPayloadSpan
+	u.mu.Lock()
+	u.seqs[size] = seq
+	u.mu.Unlock()
+
+	if err := u.setTTL(ttl); err != nil {
+		return err
+	}
+	_, err := u.udp.WriteToUDP(make([]byte, size), u.dst)
+	return err
+}
+
+func (u *udpTraceConn) match(proto int, transport []byte) (int, bool) {
+	if proto != protoUDP ||
+		int(binary.BigEndian.Uint16(transport[0:2])) != u.local ||
+		int(binary.BigEndian.Uint16(transport[2:4])) != u.dst.Port {
+		return 0, false
+	}
+	size := int(binary.BigEndian.Uint16(transport[4:6])) - 8
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	seq, ok := u.seqs[size]
+	return seq, ok
+}
+
+func (u *udpTraceConn) recv(deadline time.Time) (*traceReply, error) {
+	return u.q.recv(deadline)
+}
+
+func (u *udpTraceConn) Close() error {
+	u.q.close()
+	u.icmp.Close()
+	return u.udp.Close()
+}
+
+// tcpTraceConn sends hand-built TCP SYNs over a raw socket from one source
+// port to one destination port. Probes are told apart by their sequence
+// number, which routers quote and the destination acknowledges (SYN-ACK or
+// RST); the kernel resets the half-open connections on its own.
+type tcpTraceConn struct {
+	raw      net.PacketConn
+	icmp     *icmp.PacketConn
+	src, dst net.IP
+	zone     string
+	srcPort  int
+	dstPort  int
+	isn      uint32 // Random base of the sequence numbers
+	setTTL   func(int) error
+	q        *replyQueue
+}
+
+func newTCPTraceConn(fam icmpFamily, dst *net.IPAddr, port int) (traceConn, error) {
+	src, err := localAddrFor(dst)
+	if err != nil {
+		return nil, err
+	}
+	ic, err := fam.listen(true)
+	if err != nil {
+		return nil, fmt.Errorf("tcp traceroute requires root privileges: %w", err)
+	}
+	network := "ip4:tcp"
+	if fam.family == FamilyV6 {
+		network = "ip6:tcp"
+	}
+	raw, err := net.ListenPacket(network, src.String())
+	if err != nil {
+		ic.Close()
+		return nil, fmt.Errorf("tcp traceroute requires root privileges: %w", err)
+	}
+
+	t := &tcpTraceConn{
+		raw:     raw,
+		icmp:    ic,
+		src:     src,
+		dst:     dst.IP,
+		zone:    dst.Zone,
+		srcPort: 32768 + rand.IntN(28000),
+		dstPort: port,
+		isn:     rand.Uint32(),
+		setTTL:  packetTTL(raw, fam.family),
+		q:       newReplyQueue(),
+	}
+	go readICMPErrors(ic, fam, t.q, t.match)
+	go t.readSegments()
+	return t, nil
+}
+
+func (t *tcpTraceConn) send(ttl, seq int) error {
+	if err := t.setTTL(ttl); err != nil {
+		return err
+	}
+	_, err := t.raw.WriteTo(t.syn(seq), &net.IPAddr{IP: t.dst, Zone: t.zone})
+	return err
+}
+
+// syn builds a SYN segment without options; only the sequence number varies
+func (t *tcpTraceConn) syn(seq int) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:2], uint16(t.srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(t.dstPort))
+	binary.BigEndian.PutUint32(b[4:8], t.isn+uint32(seq))
+	b[12] = 5 << 4 // Data offset: 5 words
+	b[13] = 0x02   // SYN
+	binary.BigEndian.PutUint16(b[14:16], 65535)
+	binary.BigEndian.PutUint16(b[16:18], tcpChecksum(t.src, t.dst, b))
+	return b
+}
+
+func (t *tcpTraceConn) match(proto int, transport []byte) (int, bool) {
+	if proto != protoTCP ||
+		int(binary.BigEndian.Uint16(transport[0:2])) != t.srcPort ||
+		int(binary.BigEndian.Uint16(transport[2:4])) != t.dstPort {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(transport[4:8]) - t.isn), true
+}
+
+// readSegments reports SYN-ACK and RST answers from the destination until
+// the raw socket is closed
+func (t *tcpTraceConn) readSegments() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := t.raw.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		seg := buf[:n]
+		if len(seg) < 20 || !addrIP(peer).Equal(t.dst) ||
+			int(binary.BigEndian.Uint16(seg[0:2])) != t.dstPort ||
+			int(binary.BigEndian.Uint16(seg[2:4])) != t.srcPort {
+			continue
+		}
+		flags := seg[13]
+		if flags&0x12 != 0x12 && flags&0x04 == 0 {
+			continue // Neither SYN-ACK nor RST
+		}
+		seq := int(binary.BigEndian.Uint32(seg[8:12]) - 1 - t.isn)
+		t.q.push(&traceReply{peer: t.dst, seq: seq, kind: replyEcho, at: at})
+	}
+}
+
+func (t *tcpTraceConn) recv(deadline time.Time) (*traceReply, error) {
+	return t.q.recv(deadline)
+}
+
+func (t *tcpTraceConn) Close() error {
+	t.q.close()
+	t.icmp.Close()
+	return t.raw.Close()
+}
+
+// localAddrFor returns the source address the kernel routes dst from.
+// Connecting a UDP socket sends nothing.
+func localAddrFor(dst *net.IPAddr) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst.IP, Port: 9, Zone: dst.Zone})
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %w", dst.IP, err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// tcpChecksum computes the TCP checksum over the IPv4 or IPv6 pseudo header
+// and the segment (with its checksum field zeroed)
+func tcpChecksum(src, dst net.IP, seg []byte) uint16 {
+	var pseudo []byte
+	if s4, d4 := src.To4(), dst.To4(); s4 != nil && d4 != nil {
+		pseudo = append(append(pseudo, s4...), d4...)
+		pseudo = append(pseudo, 0, protoTCP, byte(len(seg)>>8), byte(len(seg)))
+	} else {
+		pseudo = append(append(pseudo, src.To16()...), dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(seg)))
+		pseudo = append(pseudo, 0, 0, 0, protoTCP)
+	}
+
+	var sum uint32
+	for _, b := range [][]byte{pseudo, seg} {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,206 @@
+package prober
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// Offsets into struct sock_extended_err (linux/errqueue.h)
+const (
+	eeOriginOffset   = 4
+	eeTypeOffset     = 5
+	eeOffenderOffset = 16 // SO_EE_OFFENDER: sockaddr following the struct
+	eeOriginICMP     = 2
+	eeOriginICMP6    = 3
+)
+
+// dgramTraceConn uses an unprivileged ICMP datagram socket (ping_group_range).
+// Such sockets never see time-exceeded messages on the normal read path; with
+// IP_RECVERR/IPV6_RECVERR enabled the kernel queues them on the error queue.
+type dgramTraceConn struct {
+	c   net.PacketConn
+	rc  syscall.RawConn
+	fam icmpFamily
+	dst *net.IPAddr
+	buf []byte
+	oob []byte
+}
+
+func newDgramTraceConn(fam icmpFamily, dst *net.IPAddr) (traceConn, error) {
+	domain, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if fam.family == FamilyV6 {
+		domain, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		sa = &syscall.SockaddrInet6{}
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if fam.family == FamilyV6 {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+	}
+	if err == nil {
+		err = syscall.Bind(fd, sa)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt/bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "routelens-trace")
+	c, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("datagram icmp socket does not expose a raw conn")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &dgramTraceConn{c: c, rc: rc, fam: fam, dst: dst, buf: make([]byte, 1500), oob: make([]byte, 512)}, nil
+}
+
+func (d *dgramTraceConn) send(ttl, seq int) error {
+	var optErr error
+	err := d.rc.Control(func(fd uintptr) {
+		if d.fam.family == FamilyV6 {
+			optErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		} else {
+			optErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if optErr != nil {
+		return optErr
+	}
+	// The kernel owns the echo ID of datagram sockets, so only Seq identifies the probe
+	wb, err := d.fam.echoMessage(0, seq, parisPayload(seq))
+	if err != nil {
+		return err
+	}
+	_, err = d.c.WriteTo(wb, &net.UDPAddr{IP: d.dst.IP, Zone: d.dst.Zone})
+	return err
+}
+
+func (d *dgramTraceConn) recv(deadline time.Time) (*traceReply, error) {
+	if err := d.c.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	var reply *traceReply
+	err := d.rc.Read(func(fd uintptr) bool {
+		for {
+			// ICMP errors (time exceeded, unreachable) arrive on the error queue
+			n, oobn, _, _, err := syscall.Recvmsg(int(fd), d.buf, d.oob, syscall.MSG_ERRQUEUE)
+			if err == nil {
+				if r := d.parseErrQueue(d.buf[:n], d.oob[:oobn]); r != nil {
+					reply = r
+					return true
+				}
+				continue
+			}
+
+			n, from, err := syscall.Recvfrom(int(fd), d.buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+				return false // Wait for readability (also signalled by queued errors)
+			}
+			if err != nil {
+				continue // Pending socket error; the details are on the error queue
+			}
+			rm, perr := icmp.ParseMessage(d.fam.proto, d.buf[:n])
+			if perr != nil || rm.Type != d.fam.echoReply {
+				continue
+			}
+			if echo, ok := rm.Body.(*icmp.Echo); ok {
+				reply = &traceReply{peer: sockaddrIP(from), seq: echo.Seq, kind: replyEcho, at: time.Now()}
+				return true
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// parseErrQueue decodes a sock_extended_err control message. payload is the
+// echo request we originally sent, which carries our sequence number.
+func (d *dgramTraceConn) parseErrQueue(payload, oob []byte) *traceReply {
+	if len(payload) < 8 {
+		return nil
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		isV4 := m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR
+		isV6 := m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR
+		if (!isV4 && !isV6) || len(m.Data) < eeOffenderOffset+8 {
+			continue
+		}
+		origin, typ := m.Data[eeOriginOffset], int(m.Data[eeTypeOffset])
+		if origin != eeOriginICMP && origin != eeOriginICMP6 {
+			continue
+		}
+
+		reply := &traceReply{
+			seq:  int(binary.BigEndian.Uint16(payload[6:8])),
+			peer: offenderIP(m.Data[eeOffenderOffset:]),
+			at:   time.Now(),
+		}
+		switch {
+		case origin == eeOriginICMP && typ == 11, origin == eeOriginICMP6 && typ == 3:
+			reply.kind = replyTimeExceeded
+		case origin == eeOriginICMP && typ == 3, origin == eeOriginICMP6 && typ == 1:
+			reply.kind = replyUnreachable
+		default:
+			continue
+		}
+		return reply
+	}
+	return nil
+}
+
+func (d *dgramTraceConn) Close() error {
+	return d.c.Close()
+}
+
+// offenderIP decodes the raw sockaddr_in/sockaddr_in6 of SO_EE_OFFENDER
+func offenderIP(b []byte) net.IP {
+	family := binary.NativeEndian.Uint16(b[0:2]) // sa_family is in host byte order
+	switch {
+	case family == syscall.AF_INET && len(b) >= 8:
+		return net.IP(append([]byte(nil), b[4:8]...))
+	case family == syscall.AF_INET6 && len(b) >= 24:
+		return net.IP(append([]byte(nil), b[8:24]...))
+	}
+	return nil
+}
+
+func sockaddrIP(sa syscall.Sockaddr) net.IP {
+	switch v := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(v.Addr[:])
+	case *syscall.SockaddrInet6:
+		return net.IP(v.Addr[:])
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package prober
+
+import (
+	"errors"
+	"net"
+)
+
+// newDgramTraceConn is only implemented on Linux, where ICMP errors for
+// unprivileged sockets can be read from the socket error queue.
+func newDgramTraceConn(fam icmpFamily, dst *net.IPAddr) (traceConn, error) {
+	return nil, errors.New("unprivileged traceroute is not supported on this platform")
+}
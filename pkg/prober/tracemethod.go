@@ -0,0 +1,73 @@
+package prober
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TraceMethod selects the packets traceroute and the native MTR engine send
+type TraceMethod string
+
+const (
+	TraceICMP TraceMethod = "icmp" // ICMP echo requests (default)
+	TraceUDP  TraceMethod = "udp"  // UDP datagrams to a fixed port
+	TraceTCP  TraceMethod = "tcp"  // TCP SYNs to a fixed port
+)
+
+// Default destination ports per trace method
+const (
+	defaultTraceUDPPort = 33434
+	defaultTraceTCPPort = 443
+)
+
+// TraceOptions are the trace_* keys of a target's ProbeConfig. They apply to
+// every probe mode, since all targets are traced in the ping/trace cycle.
+//
+// All methods are Paris-style: every probe of a trace shares the same flow
+// identifier (addresses, protocol, ports, ICMP checksum), so per-flow load
+// balancers route them along one path instead of mixing several into one
+// trace. UDP and TCP probes additionally follow the path real traffic to
+// that port takes, e.g. trace_port 443 or 22.
+type TraceOptions struct {
+	Method TraceMethod `json:"trace_method"`
+	Port   int         `json:"trace_port"`
+}
+
+// traceConfigFields documents the trace options in every probe mode's schema
+var traceConfigFields = []ConfigField{
+	{Key: "trace_method", Type: "string", Default: string(TraceICMP), Description: "Traceroute probe packets: icmp, udp or tcp"},
+	{Key: "trace_port", Type: "int", Description: "Destination port for udp (default 33434) and tcp (default 443) traces"},
+}
+
+// ParseTraceOptions reads the trace options from a raw ProbeConfig,
+// filling in defaults. Keys of the probe mode itself are ignored.
+func ParseTraceOptions(rawConfig string) (TraceOptions, error) {
+	var o TraceOptions
+	if err := decodeConfig(rawConfig, &o); err != nil {
+		return TraceOptions{}, err
+	}
+	return o.normalize()
+}
+
+// normalize validates the method and port and applies the method's default port
+func (o TraceOptions) normalize() (TraceOptions, error) {
+	o.Method = TraceMethod(strings.ToLower(strings.TrimSpace(string(o.Method))))
+	switch o.Method {
+	case "", TraceICMP:
+		return TraceOptions{Method: TraceICMP}, nil
+	case TraceUDP:
+		if o.Port == 0 {
+			o.Port = defaultTraceUDPPort
+		}
+	case TraceTCP:
+		if o.Port == 0 {
+			o.Port = defaultTraceTCPPort
+		}
+	default:
+		return TraceOptions{}, fmt.Errorf("invalid trace_method %q: must be icmp, udp or tcp", o.Method)
+	}
+	if o.Port < 1 || o.Port > 65535 {
+		return TraceOptions{}, fmt.Errorf("invalid trace_port %d", o.Port)
+	}
+	return o, nil
+}
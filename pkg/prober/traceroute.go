@@ -1,13 +1,9 @@
 package prober
 
 import (
+	"context"
 	"fmt"
-	"net"
-	"os"
 	"time"
-
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
 type TracerouteRunner struct {
@@ -15,6 +11,28 @@ type TracerouteRunner struct {
 	MaxHops     int
 	CountPerHop int // Number of probes per hop (typically 3)
 	Timeout     time.Duration
+	Family      AddressFamily // auto (default), v4 or v6
+	Method      TraceMethod   // icmp (default), udp or tcp
+	Port        int           // Destination port of udp/tcp probes (0: method default)
+}
+
+func init() {
+	Register(Descriptor{
+		Type:  TracerTraceroute,
+		Label: "Traceroute",
+		Kind:  KindTrace,
+		New: func(spec Spec) (Prober, error) {
+			opts, err := ParseTraceOptions(spec.Config)
+			if err != nil {
+				return nil, err
+			}
+			r := NewTracerouteRunner(spec.Address)
+			r.Family = spec.Family
+			r.Method = opts.Method
+			r.Port = opts.Port
+			return traceProber(r.Run), nil
+		},
+	})
 }
 
 func NewTracerouteRunner(target string) *TracerouteRunner {
@@ -23,110 +41,107 @@ func NewTracerouteRunner(target string) *TracerouteRunner {
 		MaxHops:     30,
 		CountPerHop: 1, // Start simple
 		Timeout:     2 * time.Second,
+		Family:      FamilyAuto,
+		Method:      TraceICMP,
 	}
 }
 
 // Run executes a traceroute
-func (t *TracerouteRunner) Run() (*TraceResult, error) {
+func (t *TracerouteRunner) Run(ctx context.Context) (*TraceResult, error) {
 	// Security: Validate target before use
 	if err := ValidateTarget(t.Target); err != nil {
 		return nil, fmt.Errorf("invalid target: %w", err)
 	}
 
-	dstAddr, err := net.ResolveIPAddr("ip4", t.Target)
+	dstAddr, err := resolveTarget(ctx, t.Target, t.Family)
 	if err != nil {
 		return nil, err
 	}
+	fam := icmpFamilyFor(dstAddr.IP)
 
-	// Traceroute requires receiving TimeExceeded messages, which usually needs raw sockets
-	c, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	// Traceroute requires receiving TimeExceeded messages: a raw socket when
+	// privileged, otherwise (ICMP only) the error queue of a datagram ICMP socket
+	opts, err := TraceOptions{Method: t.Method, Port: t.Port}.normalize()
 	if err != nil {
-		return nil, fmt.Errorf("traceroute requires root privileges (ip4:icmp): %w", err)
+		return nil, err
 	}
-	defer c.Close()
-
-	// Set invalidation on the socket to ensure we can set TTL
-	pconn := c.IPv4PacketConn()
-	if pconn != nil {
-		pconn.SetControlMessage(ipv4.FlagTTL, true)
+	c, err := openTraceConn(fam, dstAddr, opts)
+	if err != nil {
+		return nil, err
 	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
 
 	res := &TraceResult{
 		Target:    t.Target,
+		Family:    fam.family,
+		Method:    opts.Method,
+		Port:      opts.Port,
 		Timestamp: time.Now(),
 		Hops:      []HopInfo{},
 	}
 
-	id := os.Getpid() & 0xffff
+	count := t.CountPerHop
+	if count <= 0 {
+		count = 1
+	}
 
+	seq := 0
 	for ttl := 1; ttl <= t.MaxHops; ttl++ {
-		// Prepare probe
-		// We use ICMP Echo as the probe (Windows style)
-		wm := icmp.Message{
-			Type: ipv4.ICMPTypeEcho, Code: 0,
-			Body: &icmp.Echo{
-				ID: id, Seq: ttl,
-				Data: []byte("RouteLens-Trace"),
-			},
+		hop := HopInfo{Hop: ttl, IP: "*"}
+		var total time.Duration
+		var recv int
+		reached := false
+
+		for i := 0; i < count; i++ {
+			seq++
+			start := time.Now()
+			if err := c.send(ttl, seq); err != nil {
+				continue
+			}
+
+			reply := t.awaitReply(c, seq, start.Add(t.Timeout))
+			if reply == nil {
+				continue
+			}
+			recv++
+			total += reply.at.Sub(start)
+			if reply.peer != nil {
+				hop.IP = reply.peer.String()
+			}
+			if reply.kind != replyTimeExceeded {
+				reached = true // Destination answered or unreachable: nothing lies beyond
+			}
 		}
-		wb, err := wm.Marshal(nil)
-		if err != nil {
+		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
 
-		// Set TTL
-		if pconn != nil {
-			pconn.SetTTL(ttl)
-		} else {
-			// Fallback for systems where IPv4PacketConn wrapper might fail, though unlikely with ip4:icmp
-			// Using syscall setsockopt would be the raw way, but pconn.SetTTL is standard x/net
+		if recv > 0 {
+			hop.Latency = total / time.Duration(recv)
 		}
+		hop.Loss = float64(count-recv) / float64(count) * 100.0
+		res.Hops = append(res.Hops, hop)
 
-		start := time.Now()
-		if _, err := c.WriteTo(wb, dstAddr); err != nil {
-			// If sending fails, maybe stop?
-			continue
+		if reached || hop.IP == dstAddr.IP.String() {
+			break
 		}
+	}
 
-		hop := HopInfo{Hop: ttl}
-
-		// Wait for reply
-		if err := c.SetReadDeadline(time.Now().Add(t.Timeout)); err != nil {
-			hop.IP = "*"
-			hop.Loss = 100.0
-			res.Hops = append(res.Hops, hop)
-			continue
-		}
-		reply := make([]byte, 1500)
-		n, peer, err := c.ReadFrom(reply)
+	return res, nil
+}
 
+// awaitReply reads until the answer for seq arrives or the deadline passes.
+// Late answers to earlier probes are discarded.
+func (t *TracerouteRunner) awaitReply(c traceConn, seq int, deadline time.Time) *traceReply {
+	for {
+		reply, err := c.recv(deadline)
 		if err != nil {
-			// Timeout
-			hop.IP = "*"
-			hop.Loss = 100.0
-		} else {
-			duration := time.Since(start)
-			hop.Latency = duration
-			hop.IP = peer.String()
-
-			// Parse message to see what we got
-			rm, _ := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), reply[:n])
-			if rm != nil {
-				switch rm.Type {
-				case ipv4.ICMPTypeTimeExceeded:
-					// Intermediate router
-				case ipv4.ICMPTypeEchoReply:
-					// Dest reached
-				}
-			}
+			return nil // Timeout
 		}
-
-		res.Hops = append(res.Hops, hop)
-
-		if hop.IP == dstAddr.String() {
-			break
+		if reply.seq == seq {
+			return reply
 		}
 	}
-
-	return res, nil
 }
@@ -0,0 +1,72 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/yuanweize/RouteLens/pkg/export"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+// HTTPSink posts each batch as a JSON array to a URL. Elements are the
+// records as the API returns them, plus their kind (as in NDJSON exports),
+// the target's name and its probe mode.
+type HTTPSink struct {
+	url   string
+	token string
+}
+
+// NewHTTPSink posts to url, with token as a bearer token if set
+func NewHTTPSink(url, token string) *HTTPSink {
+	return &HTTPSink{url: url, token: token}
+}
+
+func (s *HTTPSink) Name() string { return "http" }
+
+// latencyJSON, speedJSON and dnsJSON are the elements of a posted batch. The
+// record types are embedded one at a time, as all have ID, CreatedAt and
+// target fields; the fields added here take precedence over the record's own.
+type latencyJSON struct {
+	Kind       string `json:"kind"`
+	TargetName string `json:"target_name"`
+	ProbeType  string `json:"probe_type"`
+	*storage.LatencyRecord
+}
+
+type speedJSON struct {
+	Kind       string `json:"kind"`
+	TargetName string `json:"target_name"`
+	ProbeType  string `json:"probe_type"`
+	*storage.SpeedRecord
+}
+
+type dnsJSON struct {
+	Kind       string `json:"kind"`
+	TargetName string `json:"target_name"`
+	ProbeType  string `json:"probe_type"`
+	*storage.DNSRecord
+}
+
+func (s *HTTPSink) Write(ctx context.Context, batch []Record) error {
+	out := make([]any, 0, len(batch))
+	for _, r := range batch {
+		switch {
+		case r.Latency != nil:
+			out = append(out, latencyJSON{export.KindLatency, r.TargetName, r.ProbeType, r.Latency})
+		case r.Speed != nil:
+			out = append(out, speedJSON{export.KindSpeed, r.TargetName, r.ProbeType, r.Speed})
+		case r.DNS != nil:
+			out = append(out, dnsJSON{export.KindDNS, r.TargetName, r.ProbeType, r.DNS})
+		}
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		return &permanentError{err}
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if s.token != "" {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+	return post(ctx, httpClient, s.url, body, header)
+}
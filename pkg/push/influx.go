@@ -0,0 +1,45 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/yuanweize/RouteLens/pkg/export"
+)
+
+// InfluxSink writes line protocol, the same as influx exports, to the
+// InfluxDB v2 write API
+type InfluxSink struct {
+	url   string
+	token string
+}
+
+// NewInfluxSink writes to bucket in org on the server at baseURL, e.g.
+// http://influxdb:8086
+func NewInfluxSink(baseURL, org, bucket, token string) *InfluxSink {
+	q := url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ns"}}
+	return &InfluxSink{url: strings.TrimRight(baseURL, "/") + "/api/v2/write?" + q.Encode(), token: token}
+}
+
+func (s *InfluxSink) Name() string { return "influxdb" }
+
+func (s *InfluxSink) Write(ctx context.Context, batch []Record) error {
+	var b strings.Builder
+	for _, r := range batch {
+		switch {
+		case r.Latency != nil:
+			b.WriteString(export.LatencyLine(r.Latency))
+		case r.Speed != nil:
+			b.WriteString(export.SpeedLine(r.Speed))
+		case r.DNS != nil:
+			b.WriteString(export.DNSLine(r.DNS))
+		}
+	}
+	header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if s.token != "" {
+		header.Set("Authorization", "Token "+s.token)
+	}
+	return post(ctx, httpClient, s.url, []byte(b.String()), header)
+}
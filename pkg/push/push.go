@@ -0,0 +1,301 @@
+// Package push forwards the measurements the monitor saves to external
+// time-series backends: the InfluxDB v2 write API, Prometheus remote-write
+// and a generic HTTP JSON endpoint
+package push
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/logging"
+	"github.com/yuanweize/RouteLens/pkg/storage"
+)
+
+// Record is one saved measurement: exactly one of Latency, Speed and DNS is
+// set. A DNS probe yields a record per resolver. Traces are not pushed.
+type Record struct {
+	TargetName string
+	ProbeType  string // Probe mode of the target
+	Latency    *storage.LatencyRecord
+	Speed      *storage.SpeedRecord
+	DNS        *storage.DNSRecord
+}
+
+// Sink writes batches of records to one backend
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, batch []Record) error
+}
+
+// Queue tuning. Records wait in a bounded buffer per sink and are sent in
+// batches; when a sink is down its buffer keeps the newest records.
+const (
+	DefaultBufferSize = 10000
+	BatchSize         = 500
+	FlushInterval     = 5 * time.Second  // Longest a record waits for a batch to fill
+	WriteTimeout      = 30 * time.Second // Per batch
+	MinBackoff        = time.Second
+	MaxBackoff        = 5 * time.Minute
+	stopTimeout       = 5 * time.Second // How long Stop tries to flush
+)
+
+// Pusher fans records out to its sinks, each with its own buffer, so a slow
+// or unreachable backend holds up nothing else
+type Pusher struct {
+	queues []*queue
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a Pusher buffering up to bufferSize records per sink
+func New(bufferSize int, sinks ...Sink) *Pusher {
+	if bufferSize < BatchSize {
+		bufferSize = BatchSize
+	}
+	p := &Pusher{stop: make(chan struct{})}
+	for _, s := range sinks {
+		p.queues = append(p.queues, &queue{sink: s, size: bufferSize, full: make(chan struct{}, 1)})
+	}
+	return p
+}
+
+// Publish queues a record for every sink without blocking. A nil Pusher
+// drops it.
+func (p *Pusher) Publish(r Record) {
+	if p == nil {
+		return
+	}
+	for _, q := range p.queues {
+		q.add(r)
+	}
+}
+
+// Start sends the queued records until Stop
+func (p *Pusher) Start() {
+	for _, q := range p.queues {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			q.run(p.stop)
+		}()
+	}
+}
+
+// Stop makes one last attempt to send the queued records and returns once
+// every sink is done
+func (p *Pusher) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// SinkStats is a snapshot of one sink's queue
+type SinkStats struct {
+	Name        string     `json:"name"`
+	Queued      int        `json:"queued"`  // Records waiting, including a batch being retried
+	Sent        uint64     `json:"sent"`    // Records accepted by the backend
+	Dropped     uint64     `json:"dropped"` // Records lost to a full buffer or rejected by the backend
+	Failures    uint64     `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Stats returns a snapshot of every sink's queue. A nil Pusher has none.
+func (p *Pusher) Stats() []SinkStats {
+	if p == nil {
+		return nil
+	}
+	stats := make([]SinkStats, 0, len(p.queues))
+	for _, q := range p.queues {
+		stats = append(stats, q.stats())
+	}
+	return stats
+}
+
+// queue buffers the records of one sink. inflight is the batch being sent,
+// kept apart from buf so that dropping old records from a full buffer never
+// touches a batch that is about to be retried.
+type queue struct {
+	sink Sink
+	size int
+	full chan struct{} // Signalled when a batch is ready
+
+	mu       sync.Mutex
+	buf      []Record
+	inflight []Record
+	st       SinkStats
+}
+
+func (q *queue) add(r Record) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.buf) >= q.size {
+		q.buf = q.buf[1:]
+		q.st.Dropped++
+	}
+	q.buf = append(q.buf, r)
+	if len(q.buf) >= BatchSize {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *queue) stats() SinkStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := q.st
+	st.Name = q.sink.Name()
+	st.Queued = len(q.buf) + len(q.inflight)
+	return st
+}
+
+// run sends a batch whenever one is full or FlushInterval has passed, and
+// backs off exponentially while the sink fails
+func (q *queue) run(stop <-chan struct{}) {
+	var backoff time.Duration
+	for {
+		wait, full := FlushInterval, q.full
+		if backoff > 0 {
+			wait, full = backoff, nil // A full buffer does not cut a backoff short
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			q.drain()
+			return
+		case <-full:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		for {
+			more, err := q.send(context.Background())
+			if err != nil {
+				backoff = nextBackoff(backoff)
+				logging.Warn("push", "Push to %s failed, retrying in %s: %v", q.sink.Name(), backoff.Round(time.Second), err)
+				break
+			}
+			backoff = 0
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+// send writes the pending batch, or the next one from the buffer. It reports
+// whether another full batch is waiting. Batches the backend rejects for good
+// are dropped instead of retried.
+func (q *queue) send(ctx context.Context) (more bool, err error) {
+	q.mu.Lock()
+	if len(q.inflight) == 0 {
+		n := min(len(q.buf), BatchSize)
+		q.inflight = append([]Record(nil), q.buf[:n]...)
+		q.buf = q.buf[n:]
+	}
+	batch := q.inflight
+	q.mu.Unlock()
+	if len(batch) == 0 {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, WriteTimeout)
+	err = q.sink.Write(ctx, batch)
+	cancel()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var perm *permanentError
+	switch {
+	case err == nil:
+		q.st.Sent += uint64(len(batch))
+	case errors.As(err, &perm):
+		q.st.Dropped += uint64(len(batch))
+		logging.Error("push", "Push to %s rejected, dropping %d records: %v", q.sink.Name(), len(batch), err)
+	}
+	if err != nil {
+		now := time.Now()
+		q.st.Failures++
+		q.st.LastError = err.Error()
+		q.st.LastErrorAt = &now
+	}
+	if err != nil && perm == nil {
+		return false, err
+	}
+	q.inflight = nil
+	return len(q.buf) >= BatchSize, nil
+}
+
+// drain makes a last attempt to send everything queued when the pusher stops
+func (q *queue) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		q.mu.Lock()
+		empty := len(q.buf) == 0 && len(q.inflight) == 0
+		q.mu.Unlock()
+		if empty {
+			return
+		}
+		if _, err := q.send(ctx); err != nil {
+			break
+		}
+	}
+	if st := q.stats(); st.Queued > 0 {
+		logging.Warn("push", "Push to %s: %d records not sent before shutdown", q.sink.Name(), st.Queued)
+	}
+}
+
+// nextBackoff doubles the delay up to MaxBackoff, with jitter so that sinks
+// recovering together are not retried in lockstep
+func nextBackoff(d time.Duration) time.Duration {
+	d = min(max(2*d, MinBackoff), MaxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// permanentError is a response that retrying the same batch cannot fix
+type permanentError struct{ error }
+
+func (e *permanentError) Unwrap() error { return e.error }
+
+// post sends a batch body and maps the response to an error: 2xx is
+// success, other 4xx except 408 and 429 are permanent
+func post(ctx context.Context, client *http.Client, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = errors.New(resp.Status)
+	if msg = bytes.TrimSpace(msg); len(msg) > 0 {
+		err = fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &permanentError{err}
+	}
+	return err
+}
+
+// httpClient is shared by the sinks; deadlines come from the batch context
+var httpClient = &http.Client{}
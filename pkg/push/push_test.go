@@ -0,0 +1,149 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink fails its first fails writes, then accepts every batch
+type fakeSink struct {
+	mu      sync.Mutex
+	fails   int
+	err     error
+	batches [][]Record
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Write(ctx context.Context, batch []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return s.err
+	}
+	s.batches = append(s.batches, append([]Record(nil), batch...))
+	return nil
+}
+
+func (s *fakeSink) written() [][]Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func records(from, n int) []Record {
+	rs := make([]Record, n)
+	for i := range rs {
+		rs[i] = Record{TargetName: fmt.Sprint(from + i)}
+	}
+	return rs
+}
+
+func newQueue(s Sink) *queue {
+	return New(0, s).queues[0]
+}
+
+func TestQueueDropsOldest(t *testing.T) {
+	q := newQueue(&fakeSink{})
+	for _, r := range records(0, BatchSize+2) {
+		q.add(r)
+	}
+	if st := q.stats(); st.Queued != BatchSize || st.Dropped != 2 {
+		t.Errorf("stats %+v, want %d queued and 2 dropped", st, BatchSize)
+	}
+	if q.buf[0].TargetName != "2" {
+		t.Errorf("oldest queued record %q, want 2", q.buf[0].TargetName)
+	}
+}
+
+func TestQueueRetriesBatch(t *testing.T) {
+	sink := &fakeSink{fails: 2, err: errors.New("unavailable")}
+	q := newQueue(sink)
+	for _, r := range records(0, 3) {
+		q.add(r)
+	}
+
+	for i := range 2 {
+		if _, err := q.send(context.Background()); err == nil {
+			t.Fatalf("send %d succeeded, want the sink's error", i)
+		}
+		q.add(records(3+i, 1)[0]) // Queued behind the batch being retried
+	}
+	if st := q.stats(); st.Queued != 5 || st.Sent != 0 || st.Failures != 2 || st.LastError != "unavailable" {
+		t.Errorf("stats after failures %+v", st)
+	}
+
+	if _, err := q.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	batches := sink.written()
+	if len(batches) != 1 || len(batches[0]) != 3 || batches[0][0].TargetName != "0" || batches[0][2].TargetName != "2" {
+		t.Fatalf("written %v, want the first batch unchanged", batches)
+	}
+	if st := q.stats(); st.Queued != 2 || st.Sent != 3 || st.Dropped != 0 {
+		t.Errorf("stats after retry %+v", st)
+	}
+}
+
+func TestQueueDropsRejectedBatch(t *testing.T) {
+	sink := &fakeSink{fails: 1, err: &permanentError{errors.New("400 Bad Request")}}
+	q := newQueue(sink)
+	for _, r := range records(0, 3) {
+		q.add(r)
+	}
+	if _, err := q.send(context.Background()); err != nil {
+		t.Errorf("send of a rejected batch: %v, want it dropped", err)
+	}
+	if st := q.stats(); st.Queued != 0 || st.Dropped != 3 || st.Failures != 1 {
+		t.Errorf("stats %+v, want 3 dropped", st)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	var d time.Duration
+	for i := range 20 {
+		d = nextBackoff(d)
+		if d < MinBackoff/2 || d > MaxBackoff {
+			t.Fatalf("backoff %d is %s, want within [%s, %s]", i, d, MinBackoff/2, MaxBackoff)
+		}
+	}
+	if d < MaxBackoff/2 {
+		t.Errorf("backoff %s after 20 failures, want at least %s", d, MaxBackoff/2)
+	}
+}
+
+func TestPusherRetriesAndDrains(t *testing.T) {
+	sink := &fakeSink{fails: 1, err: errors.New("unavailable")}
+	p := New(0, sink)
+	p.Start()
+	for _, r := range records(0, BatchSize) {
+		p.Publish(r)
+	}
+
+	// The full batch is sent at once, fails, and is retried after a backoff
+	deadline := time.Now().Add(MinBackoff + 5*time.Second)
+	for p.Stats()[0].Sent < BatchSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch not sent after a failure: %+v", p.Stats()[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Less than a batch waits for FlushInterval, or Stop
+	for _, r := range records(BatchSize, 10) {
+		p.Publish(r)
+	}
+	p.Stop()
+	st := p.Stats()[0]
+	if st.Sent != BatchSize+10 || st.Queued != 0 || st.Dropped != 0 || st.Failures != 1 {
+		t.Errorf("stats after stop %+v", st)
+	}
+	if n := len(sink.written()); n != 2 {
+		t.Errorf("%d batches written, want 2", n)
+	}
+}
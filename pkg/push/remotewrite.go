@@ -0,0 +1,166 @@
+package push
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// RemoteWriteSink sends samples with the Prometheus remote-write protocol
+// (v1), under the names and labels /metrics exports. DNS answers, which
+// /metrics leaves out, go to routelens_dns_* series per resolver and question.
+type RemoteWriteSink struct {
+	url   string
+	token string
+}
+
+// NewRemoteWriteSink writes to url, with token as a bearer token if set.
+// Credentials in the URL are sent as basic auth.
+func NewRemoteWriteSink(url, token string) *RemoteWriteSink {
+	return &RemoteWriteSink{url: url, token: token}
+}
+
+func (s *RemoteWriteSink) Name() string { return "remote_write" }
+
+// series is one time series of a write request
+type series struct {
+	labels  []string // Name, value pairs sorted by name
+	samples []sample
+}
+
+type sample struct {
+	value float64
+	ms    int64
+}
+
+func (s *RemoteWriteSink) Write(ctx context.Context, batch []Record) error {
+	var all []*series
+	byKey := make(map[string]*series)
+	add := func(name string, value float64, ms int64, r Record, extra ...string) {
+		labels := sortLabels(append([]string{"__name__", name, "address", targetAddress(r), "name", r.TargetName, "probe_type", r.ProbeType}, extra...))
+		key := strings.Join(labels, "\xff")
+		ts := byKey[key]
+		if ts == nil {
+			ts = &series{labels: labels}
+			byKey[key] = ts
+			all = append(all, ts)
+		}
+		ts.samples = append(ts.samples, sample{value, ms})
+	}
+	for _, r := range batch {
+		switch {
+		case r.Latency != nil:
+			ms := r.Latency.CreatedAt.UnixMilli()
+			add("routelens_target_latency_seconds", r.Latency.LatencyMs/1000, ms, r)
+			add("routelens_target_packet_loss_ratio", r.Latency.PacketLoss/100, ms, r)
+		case r.Speed != nil:
+			ms := r.Speed.CreatedAt.UnixMilli()
+			add("routelens_target_bandwidth_bits_per_second", r.Speed.SpeedDown*1e6, ms, r, "direction", "down")
+			add("routelens_target_bandwidth_bits_per_second", r.Speed.SpeedUp*1e6, ms, r, "direction", "up")
+		case r.DNS != nil:
+			ms := r.DNS.CreatedAt.UnixMilli()
+			question := []string{"resolver", r.DNS.Resolver, "qname", r.DNS.Name, "qtype", r.DNS.QType}
+			success, changed := 0.0, 0.0
+			if r.DNS.Error == "" {
+				success = 1
+				add("routelens_dns_query_seconds", r.DNS.QueryMs/1000, ms, r, question...)
+			}
+			if r.DNS.Changed {
+				changed = 1
+			}
+			add("routelens_dns_query_success", success, ms, r, question...)
+			add("routelens_dns_answer_changed", changed, ms, r, question...)
+		}
+	}
+	for _, ts := range all {
+		slices.SortFunc(ts.samples, func(a, b sample) int { return int(a.ms - b.ms) })
+	}
+
+	header := http.Header{
+		"Content-Type":                      {"application/x-protobuf"},
+		"Content-Encoding":                  {"snappy"},
+		"X-Prometheus-Remote-Write-Version": {"0.1.0"},
+	}
+	if s.token != "" {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+	return post(ctx, httpClient, s.url, snappyBlock(encodeWriteRequest(all)), header)
+}
+
+// sortLabels sorts name, value pairs by name, as remote-write requires
+func sortLabels(labels []string) []string {
+	pairs := make([][2]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, [2]string{labels[i], labels[i+1]})
+	}
+	slices.SortFunc(pairs, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+	sorted := make([]string, 0, len(labels))
+	for _, p := range pairs {
+		sorted = append(sorted, p[0], p[1])
+	}
+	return sorted
+}
+
+func targetAddress(r Record) string {
+	switch {
+	case r.Latency != nil:
+		return r.Latency.Target
+	case r.Speed != nil:
+		return r.Speed.Target
+	}
+	return r.DNS.Target
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(all []*series) []byte {
+	var req, ts, msg []byte
+	for _, s := range all {
+		ts = ts[:0]
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			msg = appendString(msg[:0], 1, s.labels[i])
+			msg = appendString(msg, 2, s.labels[i+1])
+			ts = appendBytes(ts, 1, msg)
+		}
+		for _, smp := range s.samples {
+			msg = binary.AppendUvarint(msg[:0], 1<<3|1) // Fixed64
+			msg = binary.LittleEndian.AppendUint64(msg, math.Float64bits(smp.value))
+			msg = binary.AppendUvarint(msg, 2<<3|0) // Varint
+			msg = binary.AppendUvarint(msg, uint64(smp.ms))
+			ts = appendBytes(ts, 2, msg)
+		}
+		req = appendBytes(req, 1, ts)
+	}
+	return req
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2) // Length-delimited
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	return appendBytes(b, field, []byte(s))
+}
+
+// snappyBlock frames data in the snappy block format that remote-write
+// requires, as literals only: write requests are small, and any snappy
+// decoder reads them
+func snappyBlock(data []byte) []byte {
+	out := binary.AppendUvarint(make([]byte, 0, len(data)+len(data)/65536*3+13), uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 65536)
+		out = append(out, 61<<2, byte(n-1), byte((n-1)>>8)) // Literal, 2-byte length
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,245 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The secret fields of a probe config may hold a reference instead of the
+// secret itself, resolved by the monitor when it builds a prober:
+//
+//	${env:NAME}        environment variable NAME, which must start with EnvPrefix
+//	${file:/path}      contents of a file in RS_SECRETS_DIR, e.g. a Docker or Kubernetes secret mount
+//	${secret:name}     entry of the local secrets store (see Store)
+//
+// References are neither encrypted nor redacted, so target definitions can be
+// shared without the credentials they use.
+const (
+	RefEnv    = "env"
+	RefFile   = "file"
+	RefSecret = "secret"
+)
+
+// EnvPrefix is the prefix of the environment variables ${env:} references may
+// read, so that a config cannot pull in unrelated variables or RouteLens settings
+const EnvPrefix = "RS_SECRET_"
+
+// DefaultFileDir is where ${file:} references may read from when
+// RS_SECRETS_DIR is unset: the mount point of Docker secrets
+const DefaultFileDir = "/run/secrets"
+
+var (
+	refPattern  = regexp.MustCompile(`^\$\{([a-z]+):([^}]+)\}$`)
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+)
+
+// CheckName validates the name of a secrets store entry
+func CheckName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q: use up to 64 letters, digits, '_', '.' or '-'", name)
+	}
+	return nil
+}
+
+// Store looks up entries of the local secrets store
+type Store interface {
+	LookupSecret(name string) (string, error)
+}
+
+// ParseRef splits a reference into its kind and target; ok is false for
+// values that are not a reference
+func ParseRef(value string) (kind, ref string, ok bool) {
+	m := refPattern.FindStringSubmatch(value)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// IsRef reports whether a value is a reference
+func IsRef(value string) bool {
+	_, _, ok := ParseRef(value)
+	return ok
+}
+
+// CheckRef validates a reference without resolving it
+func CheckRef(kind, ref string) error {
+	switch kind {
+	case RefEnv:
+		if !strings.HasPrefix(ref, EnvPrefix) || ref == EnvPrefix {
+			return fmt.Errorf("${env:%s}: only %s* variables can be referenced", ref, EnvPrefix)
+		}
+	case RefFile:
+		if !filepath.IsAbs(ref) {
+			return fmt.Errorf("${file:%s}: path must be absolute", ref)
+		}
+		if err := checkFile(filepath.Clean(ref), FileDirs(), masterKeyFile()); err != nil {
+			return fmt.Errorf("${file:%s}: %w", ref, err)
+		}
+	case RefSecret:
+		return CheckName(ref)
+	default:
+		return fmt.Errorf("unknown secret reference ${%s:...}: must be env, file or secret", kind)
+	}
+	return nil
+}
+
+// Resolve returns the secret a value references, or the value itself if it is
+// not a reference
+func Resolve(value string, store Store) (string, error) {
+	kind, ref, ok := ParseRef(value)
+	if !ok {
+		return value, nil
+	}
+	if err := CheckRef(kind, ref); err != nil {
+		return "", err
+	}
+	switch kind {
+	case RefEnv:
+		v, set := os.LookupEnv(ref)
+		if !set {
+			return "", fmt.Errorf("${env:%s}: variable is not set", ref)
+		}
+		return v, nil
+	case RefFile:
+		data, err := readFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("${file:%s}: %w", ref, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		if store == nil {
+			return "", fmt.Errorf("${secret:%s}: no secrets store", ref)
+		}
+		v, err := store.LookupSecret(ref)
+		if err != nil {
+			return "", fmt.Errorf("${secret:%s}: %w", ref, err)
+		}
+		return v, nil
+	}
+}
+
+// FileDirs returns the directories ${file:} references may read from: the
+// list in RS_SECRETS_DIR (separated like PATH), or DefaultFileDir
+func FileDirs() []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("RS_SECRETS_DIR")) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	if len(dirs) == 0 {
+		return []string{DefaultFileDir}
+	}
+	return dirs
+}
+
+// masterKeyFile returns the file the master key is read from, if any
+func masterKeyFile() string {
+	if path := os.Getenv("RS_MASTER_KEY_FILE"); path != "" {
+		return filepath.Clean(path)
+	}
+	return ""
+}
+
+// checkFile checks that a clean absolute path is below one of dirs and is not
+// the master key file
+func checkFile(path string, dirs []string, masterKey string) error {
+	if masterKey != "" && path == masterKey {
+		return fmt.Errorf("the master key file cannot be referenced")
+	}
+	for _, dir := range dirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != "." && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("path must be in %s (see RS_SECRETS_DIR)", strings.Join(dirs, ", "))
+}
+
+// readFile reads a referenced file, checked again once symlinks are resolved
+// so that a link cannot lead out of the allowed directories
+func readFile(path string) ([]byte, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	dirs := FileDirs()
+	for i, dir := range dirs {
+		if d, err := filepath.EvalSymlinks(dir); err == nil {
+			dirs[i] = d
+		}
+	}
+	masterKey := masterKeyFile()
+	if masterKey != "" {
+		if m, err := filepath.EvalSymlinks(masterKey); err == nil {
+			masterKey = m
+		}
+	}
+	if err := checkFile(real, dirs, masterKey); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(real)
+}
+
+// ResolveConfig resolves the references in the given fields of a JSON config,
+// the secret fields of its probe mode. Values elsewhere are left as they are.
+func ResolveConfig(raw string, keys []string, store Store) (string, error) {
+	return mapFields(raw, keys, func(_, v string) (string, error) { return Resolve(v, store) })
+}
+
+// ConfigRefs returns the references held by the given fields of a JSON config
+func ConfigRefs(raw string, keys []string) []string {
+	var refs []string
+	mapFields(raw, keys, func(_, v string) (string, error) {
+		if IsRef(v) {
+			refs = append(refs, v)
+		}
+		return v, nil
+	})
+	return refs
+}
+
+// CheckConfig validates the references in a JSON config without resolving
+// them. Only the given fields, the secret fields of its probe mode, may hold
+// one.
+func CheckConfig(raw string, keys []string) error {
+	for _, key := range configKeys(raw) {
+		if !slices.Contains(keys, key) {
+			return fmt.Errorf("%s: secret references are only allowed in secret fields", key)
+		}
+	}
+	_, err := mapFields(raw, keys, func(_, v string) (string, error) {
+		if kind, ref, ok := ParseRef(v); ok {
+			return v, CheckRef(kind, ref)
+		}
+		return v, nil
+	})
+	return err
+}
+
+// configKeys lists the top-level keys of a JSON object config that hold a
+// reference, in sorted order
+func configKeys(raw string) []string {
+	if !strings.Contains(raw, "${") {
+		return nil
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil
+	}
+	var keys []string
+	for key, value := range config {
+		if v, ok := value.(string); ok && IsRef(v) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveFile(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, "token"), "s3cret\n")
+	write(filepath.Join(dir, "master"), "master key")
+	write(filepath.Join(outside, "other"), "other")
+	if err := os.Symlink(filepath.Join(outside, "other"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RS_SECRETS_DIR", dir)
+	t.Setenv("RS_MASTER_KEY_FILE", filepath.Join(dir, "master"))
+
+	if v, err := Resolve("${file:"+filepath.Join(dir, "token")+"}", nil); err != nil || v != "s3cret" {
+		t.Errorf("file in RS_SECRETS_DIR: %q, %v", v, err)
+	}
+	for _, path := range []string{
+		filepath.Join(outside, "other"),
+		filepath.Join(dir, "..", filepath.Base(outside), "other"),
+		filepath.Join(dir, "link"),
+		filepath.Join(dir, "master"),
+		"relative",
+	} {
+		if v, err := Resolve("${file:"+path+"}", nil); err == nil {
+			t.Errorf("Resolve(${file:%s}) = %q, want an error", path, v)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	keys := []string{"password"}
+	tests := []struct {
+		config string
+		ok     bool
+	}{
+		{`{"user":"root","password":"${env:RS_SECRET_SSH_PASSWORD}"}`, true},
+		{`{"user":"root","password":"${env:SSH_PASSWORD}"}`, false},
+		{`{"password":"${env:HOME}"}`, false},
+		{`{"user":"root","password":"${secret:ssh-password}"}`, true},
+		{`{"user":"${env:RS_SECRET_USER}","password":"x"}`, false},
+		{`{"password":"${env:RS_JWT_SECRET}"}`, false},
+		{`{"password":"${file:/etc/shadow}"}`, false},
+		{`{"password":"${vault:x}"}`, false},
+	}
+	for _, tt := range tests {
+		if err := CheckConfig(tt.config, keys); (err == nil) != tt.ok {
+			t.Errorf("CheckConfig(%s) = %v, want ok = %v", tt.config, err, tt.ok)
+		}
+	}
+}
+
+func TestResolveConfigSecretFieldsOnly(t *testing.T) {
+	t.Setenv("RS_SECRET_TEST", "s3cret")
+	got, err := ResolveConfig(`{"password":"${env:RS_SECRET_TEST}","url":"${env:RS_SECRET_TEST}"}`,
+		[]string{"password"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"password":"s3cret","url":"${env:RS_SECRET_TEST}"}`; got != want {
+		t.Errorf("ResolveConfig = %s, want %s", got, want)
+	}
+}
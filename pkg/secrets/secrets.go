@@ -0,0 +1,296 @@
+// Package secrets encrypts the secret fields of probe configs at rest with a
+// key derived from the master secret (RS_MASTER_KEY)
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// sealedPrefix marks an encrypted value: enc:v1:<key id>:<base64 nonce+ciphertext>
+const sealedPrefix = "enc:v1:"
+
+// Redacted replaces secret values in API responses. Saving it back keeps the
+// stored value.
+const Redacted = "********"
+
+// MinMasterKeyLen is the shortest master secret accepted
+const MinMasterKeyLen = 16
+
+// ErrNoKey is returned when an encrypted value is read without a master key
+var ErrNoKey = errors.New("secret is encrypted but no master key is set")
+
+// Box encrypts and decrypts values with AES-256-GCM under one master key
+type Box struct {
+	aead cipher.AEAD
+	id   string
+}
+
+// NewBox derives the encryption key from a master secret
+func NewBox(master string) (*Box, error) {
+	if len(master) < MinMasterKeyLen {
+		return nil, fmt.Errorf("master key must be at least %d characters", MinMasterKeyLen)
+	}
+	key, err := hkdf.Key(sha256.New, []byte(master), []byte("routelens"), "probe secrets v1", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &Box{aead: aead, id: hex.EncodeToString(sum[:4])}, nil
+}
+
+// FromEnv builds the Box for RS_MASTER_KEY, or the contents of the file named
+// by RS_MASTER_KEY_FILE. It returns nil without error if neither is set.
+func FromEnv() (*Box, error) {
+	master := os.Getenv("RS_MASTER_KEY")
+	if path := os.Getenv("RS_MASTER_KEY_FILE"); master == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("RS_MASTER_KEY_FILE: %w", err)
+		}
+		master = strings.TrimSpace(string(data))
+	}
+	if master == "" {
+		return nil, nil
+	}
+	return NewBox(master)
+}
+
+// ID identifies the key without revealing it
+func (b *Box) ID() string {
+	return b.id
+}
+
+// Seal encrypts a value. Empty values, references and already encrypted values
+// are returned as is.
+func (b *Box) Seal(plain string) (string, error) {
+	if plain == "" || IsSealed(plain) || IsRef(plain) {
+		return plain, nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + b.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed with this key. Plain values are returned as is.
+// A nil Box opens plain values only.
+func (b *Box) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	if b == nil {
+		return "", ErrNoKey
+	}
+	id, data, ok := strings.Cut(strings.TrimPrefix(value, sealedPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted secret")
+	}
+	if id != b.id {
+		return "", fmt.Errorf("secret was encrypted with another master key (key id %s, current %s)", id, b.id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", errors.New("malformed encrypted secret")
+	}
+	nonce, ciphertext := raw[:b.aead.NonceSize()], raw[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt secret: wrong key or corrupted value")
+	}
+	return string(plain), nil
+}
+
+// IsSealed reports whether a value is encrypted
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Reseal re-encrypts the given fields of a JSON config from one key to
+// another. Plain values are encrypted, and values already under the new key
+// are left alone, so an interrupted rotation can be run again. A nil from Box
+// only handles plain values; a nil to Box leaves them decrypted.
+func Reseal(from, to *Box, raw string, keys []string) (string, error) {
+	return mapFields(raw, keys, func(_, v string) (string, error) { return ResealValue(from, to, v) })
+}
+
+// ResealValue re-encrypts a single value from one key to another, like Reseal
+func ResealValue(from, to *Box, v string) (string, error) {
+	if to != nil && strings.HasPrefix(v, sealedPrefix+to.id+":") {
+		return v, nil
+	}
+	plain, err := from.Open(v)
+	if err != nil {
+		return "", err
+	}
+	if to == nil {
+		return plain, nil
+	}
+	return to.Seal(plain)
+}
+
+// HasPlain reports whether any of the given fields of a JSON config holds an
+// unencrypted secret
+func HasPlain(raw string, keys []string) bool {
+	found := false
+	mapFields(raw, keys, func(_, v string) (string, error) {
+		found = found || (v != "" && !IsSealed(v) && !IsRef(v))
+		return v, nil
+	})
+	return found
+}
+
+// mapFields applies fn to the string values of the given keys in a JSON
+// object config. Configs that are empty or not an object, and configs with
+// none of the keys, are returned unchanged. Other values are kept verbatim
+// and in their order, so numbers do not go through float64.
+func mapFields(raw string, keys []string, fn func(key, value string) (string, error)) (string, error) {
+	if raw == "" || len(keys) == 0 {
+		return raw, nil
+	}
+	members, ok := objectMembers(raw)
+	if !ok {
+		return raw, nil // Left for config validation to report
+	}
+	changed := false
+	for i, m := range members {
+		if !slices.Contains(keys, m.key) {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(m.value, &value); err != nil {
+			continue // Not a string
+		}
+		next, err := fn(m.key, value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", m.key, err)
+		}
+		if next != value {
+			if members[i].value, err = json.Marshal(next); err != nil {
+				return "", err
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return raw, nil
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(m.value)
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+// objectMember is one key of a JSON object with its undecoded value
+type objectMember struct {
+	key   string
+	value json.RawMessage
+}
+
+// objectMembers splits a JSON object into its members, in order
+func objectMembers(raw string) ([]objectMember, bool) {
+	dec := json.NewDecoder(strings.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+	var members []objectMember
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, false
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false
+		}
+		members = append(members, objectMember{key: key, value: value})
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('}') {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false // Trailing data
+	}
+	return members, true
+}
+
+// SealFields encrypts the given fields of a JSON config. With a nil Box the
+// config is stored as is.
+func SealFields(b *Box, raw string, keys []string) (string, error) {
+	if b == nil {
+		return raw, nil
+	}
+	return mapFields(raw, keys, func(_, v string) (string, error) { return b.Seal(v) })
+}
+
+// OpenFields decrypts the given fields of a JSON config
+func OpenFields(b *Box, raw string, keys []string) (string, error) {
+	return mapFields(raw, keys, func(_, v string) (string, error) { return b.Open(v) })
+}
+
+// RedactFields replaces the non-empty values of the given fields with
+// Redacted. References are shown as they are.
+func RedactFields(raw string, keys []string) string {
+	out, _ := mapFields(raw, keys, func(_, v string) (string, error) {
+		if v == "" || IsRef(v) {
+			return v, nil
+		}
+		return Redacted, nil
+	})
+	return out
+}
+
+// KeepRedacted replaces fields of an incoming config that still hold Redacted
+// with their values in the stored config, so that clients can save a config
+// they only ever saw redacted
+func KeepRedacted(raw, stored string, keys []string) (string, error) {
+	var old map[string]interface{}
+	if stored != "" {
+		_ = json.Unmarshal([]byte(stored), &old)
+	}
+	return mapFields(raw, keys, func(key, v string) (string, error) {
+		if v != Redacted {
+			return v, nil
+		}
+		prev, _ := old[key].(string)
+		if prev == "" {
+			return "", errors.New("no stored value to keep")
+		}
+		return prev, nil
+	})
+}
@@ -0,0 +1,38 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealFieldsKeepsOtherValues(t *testing.T) {
+	b, err := NewBox("routelens test master key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := `{"user":"root","port":2222,"test_bytes":9007199254740993,"password":"s3cret","key_path":""}`
+	keys := []string{"password", "key_text"}
+
+	sealed, err := SealFields(b, raw, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "s3cret") {
+		t.Fatalf("SealFields left the secret in clear: %s", sealed)
+	}
+	if want := `{"user":"root","port":2222,"test_bytes":9007199254740993,"password":"`; !strings.HasPrefix(sealed, want) {
+		t.Errorf("SealFields = %s, want prefix %s", sealed, want)
+	}
+
+	opened, err := OpenFields(b, sealed, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != raw {
+		t.Errorf("OpenFields = %s, want %s", opened, raw)
+	}
+
+	if got := RedactFields(`{"password":"","port":1}`, keys); got != `{"password":"","port":1}` {
+		t.Errorf("RedactFields changed a config without secrets: %s", got)
+	}
+}
@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrBackupUnsupported is returned for backup and restore on PostgreSQL,
+// which is backed up with its own tools (pg_dump)
+var ErrBackupUnsupported = errors.New("backup and restore are only supported for SQLite; use pg_dump for PostgreSQL")
+
+// ErrInvalidBackup is wrapped by the errors Restore returns for a file that is
+// not a backup it can restore
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Scheduled backups are named routelens-<time>.db, with .gz when compressed
+const (
+	backupPrefix     = "routelens-"
+	backupTimeFormat = "20060102-150405"
+)
+
+// restoreSnapshotKeep is how many snapshots of the data replaced by Restore
+// are kept next to the database file; older ones are deleted
+const restoreSnapshotKeep = 7
+
+// BackupInfo describes one backup file
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Backup writes a consistent snapshot of the live database to dest,
+// gzip-compressed if compress. Probes keep writing while it runs.
+func (d *DB) Backup(dest string, compress bool) error {
+	if d.backend != BackendSQLite {
+		return ErrBackupUnsupported
+	}
+	// VACUUM INTO refuses to overwrite, and a half-written dest is worse
+	// than none: snapshot to a temporary file and move it in place
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if err := d.conn.Exec("VACUUM INTO ?", tmp).Error; err != nil {
+		return fmt.Errorf("snapshot failed: %w", err)
+	}
+	if !compress {
+		return os.Rename(tmp, dest)
+	}
+	if err := gzipFile(tmp, dest+".tmp.gz"); err != nil {
+		os.Remove(dest + ".tmp.gz")
+		return err
+	}
+	return os.Rename(dest+".tmp.gz", dest)
+}
+
+// Restore replaces the data of the live database with that of the backup at
+// src, plain or gzip-compressed, e.g. one written by Backup. The backup is
+// validated and migrated to the current schema on a copy first, and the
+// current data is snapshotted next to the database file; the path of that
+// snapshot is returned and only the newest restoreSnapshotKeep snapshots are
+// kept. Errors caused by the file itself wrap ErrInvalidBackup. The swap runs in one transaction, so readers see
+// either the old or the restored data and the service can keep running.
+func (d *DB) Restore(src string) (string, error) {
+	if d.backend != BackendSQLite {
+		return "", ErrBackupUnsupported
+	}
+	staged := d.path + ".restore"
+	defer removeSQLiteFiles(staged)
+	if err := stageBackup(src, staged); err != nil {
+		return "", err
+	}
+	if err := validateBackup(staged); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	stamp := time.Now().Format(backupTimeFormat)
+	snapshot := fmt.Sprintf("%s.pre-restore-%s.bak", d.path, stamp)
+	for i := 2; fileExists(snapshot); i++ { // Restores within the same second
+		snapshot = fmt.Sprintf("%s.pre-restore-%s-%d.bak", d.path, stamp, i)
+	}
+	if err := d.conn.Exec("VACUUM INTO ?", snapshot).Error; err != nil {
+		return "", fmt.Errorf("snapshot of current data failed: %w", err)
+	}
+	current, err := d.GetSettings()
+	if err != nil {
+		return "", err
+	}
+	if err := d.replaceData(staged); err != nil {
+		return "", fmt.Errorf("restore failed (current data kept): %w", err)
+	}
+	// Backups of databases that never saved settings keep the current ones
+	if err := d.EnsureSettings(current); err != nil {
+		log.Printf("Failed to store settings after restore: %v", err)
+	}
+	log.Printf("Restored database from %s, previous data saved to %s", src, snapshot)
+	d.notifySettings()
+	d.rotateRestoreSnapshots()
+	return snapshot, nil
+}
+
+// rotateRestoreSnapshots deletes all but the newest restoreSnapshotKeep
+// snapshots taken by Restore
+func (d *DB) rotateRestoreSnapshots() {
+	paths, err := filepath.Glob(d.path + ".pre-restore-*.bak")
+	if err != nil || len(paths) <= restoreSnapshotKeep {
+		return
+	}
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modTimes[paths[i]].After(modTimes[paths[j]]) })
+	for _, path := range paths[restoreSnapshotKeep:] {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove old restore snapshot %s: %v", path, err)
+		}
+	}
+}
+
+// stageBackup copies a backup to dest, decompressing it if it is gzipped
+func stageBackup(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	magic := make([]byte, 2)
+	if n, _ := io.ReadFull(in, magic); n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%w: invalid gzip file: %v", ErrInvalidBackup, err)
+		}
+		defer gz.Close()
+		r = gz
+	} else if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	removeSQLiteFiles(dest)
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		// Truncated or corrupt gzip data, as opposed to failing to write dest
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+			return fmt.Errorf("%w: failed to read backup: %v", ErrInvalidBackup, err)
+		}
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	return out.Close()
+}
+
+// validateBackup checks that path is an intact RouteLens database this build
+// can read, and migrates it to the current schema
+func validateBackup(path string) error {
+	b, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	var result string
+	if err := b.conn.Raw("PRAGMA integrity_check").Scan(&result).Error; err != nil {
+		return fmt.Errorf("not a valid SQLite database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup is corrupt: %s", result)
+	}
+	if !b.conn.Migrator().HasTable(&Target{}) {
+		return errors.New("not a RouteLens database")
+	}
+	version, err := b.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(); version > latest {
+		return fmt.Errorf("backup has schema version %d, newer than this build supports (%d)", version, latest)
+	}
+	if err := b.migrate(0, false); err != nil {
+		return fmt.Errorf("failed to migrate backup: %w", err)
+	}
+	return nil
+}
+
+// replaceData overwrites every table with the rows of the same table in the
+// database file at path, which must have the current schema
+func (d *DB) replaceData(path string) error {
+	d.rollupMu.Lock()
+	defer d.rollupMu.Unlock()
+
+	// ATTACH is per connection and not allowed inside a transaction
+	return d.conn.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("ATTACH DATABASE ? AS restore", path).Error; err != nil {
+			return err
+		}
+		defer conn.Exec("DETACH DATABASE restore")
+
+		var tables []string
+		err := conn.Raw("SELECT name FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'").
+			Scan(&tables).Error
+		if err != nil {
+			return err
+		}
+		return conn.Transaction(func(tx *gorm.DB) error {
+			for _, table := range tables {
+				if err := tx.Exec(fmt.Sprintf(`DELETE FROM main."%s"`, table)).Error; err != nil {
+					return err
+				}
+				var cols []string
+				err := tx.Raw(`SELECT m.name FROM pragma_table_info(?, 'main') m
+					JOIN pragma_table_info(?, 'restore') r ON r.name = m.name`, table, table).
+					Scan(&cols).Error
+				if err != nil {
+					return err
+				}
+				if len(cols) == 0 {
+					continue
+				}
+				list := `"` + strings.Join(cols, `", "`) + `"`
+				err = tx.Exec(fmt.Sprintf(`INSERT INTO main."%s" (%s) SELECT %s FROM restore."%s"`, table, list, list, table)).Error
+				if err != nil {
+					return fmt.Errorf("table %s: %w", table, err)
+				}
+			}
+			// AUTOINCREMENT counters, so new rows don't reuse IDs of the backup
+			if err := tx.Exec("DELETE FROM main.sqlite_sequence").Error; err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO main.sqlite_sequence (name, seq) SELECT name, seq FROM restore.sqlite_sequence").Error
+		})
+	})
+}
+
+func gzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// removeSQLiteFiles deletes a database file with its WAL and shared memory
+func removeSQLiteFiles(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// BackupName names a backup taken at the given time, as scheduled backups
+// are named
+func BackupName(at time.Time, compress bool) string {
+	name := backupPrefix + at.Format(backupTimeFormat) + ".db"
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// ListBackups lists the scheduled backups in dir, newest first
+func ListBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupInfo
+	for _, e := range entries {
+		name := e.Name()
+		stamp, ok := strings.CutPrefix(name, backupPrefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ".db")
+		at, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{Name: name, Size: info.Size(), CreatedAt: at})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// BackupScheduler periodically backs up the database to a directory,
+// keeping the newest Keep backups
+type BackupScheduler struct {
+	db       *DB
+	dir      string
+	interval time.Duration
+	stop     chan struct{}
+
+	Keep     int  // Backups kept; older ones are deleted
+	Compress bool // Gzip the backups
+}
+
+func NewBackupScheduler(db *DB, dir string, interval time.Duration) *BackupScheduler {
+	return &BackupScheduler{db: db, dir: dir, interval: interval, stop: make(chan struct{}), Keep: 7, Compress: true}
+}
+
+// Start backs up every interval until Stop, right away if the latest backup
+// is already older than that
+func (s *BackupScheduler) Start() {
+	go func() {
+		if backups, err := ListBackups(s.dir); err != nil || len(backups) == 0 ||
+			time.Since(backups[0].CreatedAt) >= s.interval {
+			s.run()
+		}
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.run()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *BackupScheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *BackupScheduler) run() {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		log.Printf("Scheduled backup failed: %v", err)
+		return
+	}
+	path := filepath.Join(s.dir, BackupName(time.Now(), s.Compress))
+	if err := s.db.Backup(path, s.Compress); err != nil {
+		log.Printf("Scheduled backup failed: %v", err)
+		return
+	}
+	log.Printf("Backed up database to %s", path)
+
+	backups, err := ListBackups(s.dir)
+	if err != nil {
+		log.Printf("Failed to list backups for rotation: %v", err)
+		return
+	}
+	for _, b := range backups[min(max(s.Keep, 1), len(backups)):] {
+		if err := os.Remove(filepath.Join(s.dir, b.Name)); err != nil {
+			log.Printf("Failed to remove old backup %s: %v", b.Name, err)
+		}
+	}
+}
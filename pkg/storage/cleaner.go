@@ -2,20 +2,177 @@ package storage
 
 import (
 	"log"
+	"sync/atomic"
 	"time"
 )
 
-// PruneOldData deletes records older than the specified retention days
+const (
+	// pruneBatchSize bounds the rows deleted per statement, so that each
+	// delete holds the SQLite write lock only briefly
+	pruneBatchSize = 5000
+	// pruneBatchPause lets probe writes in between batches
+	pruneBatchPause = 50 * time.Millisecond
+)
+
+// PruneReport describes one run of the retention job
+type PruneReport struct {
+	StartedAt     time.Time `json:"started_at"`
+	Duration      string    `json:"duration"`
+	RetentionDays int       `json:"retention_days"`
+	RowsRemoved   int64     `json:"rows_removed"`
+	Vacuumed      bool      `json:"vacuumed"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// PruneOldData deletes records older than the specified retention days,
+// and rollups past their own (longer) retention
 func (d *DB) PruneOldData(retentionDays int) error {
-	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	_, err := d.pruneRetention(time.Now(), retentionDays)
+	return err
+}
+
+func (d *DB) pruneRetention(now time.Time, retentionDays int) (int64, error) {
+	n, err := d.pruneBefore(now.AddDate(0, 0, -retentionDays))
+	if err != nil {
+		return n, err
+	}
+	rollups, err := d.pruneRollups(now, retentionDays)
+	if rollups > 0 {
+		log.Printf("Pruned %d old rollups", rollups)
+	}
+	return n + rollups, err
+}
+
+// pruneBefore deletes measurements, route history and DNS records older than
+// cutoff in batches of pruneBatchSize and returns the number of rows removed
+func (d *DB) pruneBefore(cutoff time.Time) (int64, error) {
+	var total int64
+	for _, t := range []struct {
+		name   string
+		model  interface{}
+		column string
+	}{
+		{"latency records", &LatencyRecord{}, "created_at"},
+		{"speed records", &SpeedRecord{}, "created_at"},
+		{"traces", &TraceRecord{}, "created_at"},
+		{"hops", &HopRecord{}, "created_at"},
+		{"route changes", &RouteChange{}, "created_at"},
+		{"route paths", &RoutePath{}, "last_seen"}, // Paths still in use are kept
+		{"DNS records", &DNSRecord{}, "created_at"},
+	} {
+		n, err := d.pruneTable(t.model, t.column+" < ?", cutoff)
+		total += n
+		if n > 0 {
+			log.Printf("Pruned %d old %s (older than %s)", n, t.name, cutoff.Format("2006-01-02"))
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
 
-	result := d.conn.Where("created_at < ?", cutoff).Delete(&MonitorRecord{})
-	if result.Error != nil {
-		return result.Error
+// pruneTable deletes the rows of model matching the condition in batches
+func (d *DB) pruneTable(model interface{}, query string, args ...interface{}) (int64, error) {
+	var total int64
+	for {
+		batch := d.conn.Model(model).Select("id").Where(query, args...).Limit(pruneBatchSize)
+		result := d.conn.Where("id IN (?)", batch).Delete(model)
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+		if result.RowsAffected < pruneBatchSize {
+			return total, nil
+		}
+		time.Sleep(pruneBatchPause)
 	}
+}
+
+// LastPrune returns the report of the retention job's latest run, if any
+func (d *DB) LastPrune() *PruneReport {
+	return d.lastPrune.Load()
+}
+
+// pruneInterval is how often the retention cleaner runs
+const pruneInterval = 6 * time.Hour
 
-	if result.RowsAffected > 0 {
-		log.Printf("Pruned %d old records (older than %s)", result.RowsAffected, cutoff.Format("2006-01-02"))
+// RetentionCleaner periodically prunes data older than the retention setting
+type RetentionCleaner struct {
+	db      *DB
+	days    atomic.Int64
+	stop    chan struct{}
+	trigger chan struct{} // Asks the cleaner goroutine for an early prune
+
+	// Vacuum returns freed pages to the filesystem after each prune
+	// (see DB.EnableIncrementalVacuum)
+	Vacuum bool
+}
+
+func NewRetentionCleaner(db *DB, retentionDays int) *RetentionCleaner {
+	c := &RetentionCleaner{db: db, stop: make(chan struct{}), trigger: make(chan struct{}, 1)}
+	c.days.Store(int64(retentionDays))
+	return c
+}
+
+// SetRetention changes the retention period, pruning right away if it shrank.
+// The prune runs on the cleaner goroutine, so it never overlaps a scheduled one.
+func (c *RetentionCleaner) SetRetention(days int) {
+	if prev := c.days.Swap(int64(days)); int64(days) < prev {
+		select {
+		case c.trigger <- struct{}{}:
+		default: // A prune is already pending
+		}
+	}
+}
+
+// Start prunes once, then every pruneInterval until Stop
+func (c *RetentionCleaner) Start() {
+	go func() {
+		c.prune()
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.prune()
+			case <-c.trigger:
+				c.prune()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *RetentionCleaner) Stop() {
+	close(c.stop)
+}
+
+func (c *RetentionCleaner) prune() {
+	days := int(c.days.Load())
+	if days < 1 {
+		return
+	}
+	report := &PruneReport{StartedAt: time.Now(), RetentionDays: days}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).Round(time.Millisecond).String()
+		c.db.lastPrune.Store(report)
+	}()
+
+	n, err := c.db.pruneRetention(report.StartedAt, days)
+	report.RowsRemoved = n
+	if err != nil {
+		report.Error = err.Error()
+		log.Printf("Failed to prune data older than %d days: %v", days, err)
+		return
+	}
+	if c.Vacuum && n > 0 {
+		if err := c.db.IncrementalVacuum(); err != nil {
+			report.Error = err.Error()
+			log.Printf("Incremental vacuum failed: %v", err)
+			return
+		}
+		report.Vacuumed = true
 	}
-	return nil
 }
@@ -3,49 +3,158 @@ package storage
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/glebarez/sqlite"
+	"github.com/yuanweize/RouteLens/pkg/secrets"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
+// Database backends
+const (
+	BackendSQLite   = "sqlite"
+	BackendPostgres = "postgres"
+)
+
 type DB struct {
-	conn *gorm.DB
+	conn    *gorm.DB
+	backend string
+	path    string // SQLite database file; empty for PostgreSQL
+
+	settingsMu   sync.RWMutex
+	settingsSubs []func(SystemSettings) // Settings change subscribers
+
+	lastPrune atomic.Pointer[PruneReport] // Latest retention job run
+	rollupMu  sync.Mutex                  // Serializes rollup bucket updates
+
+	secrets    *secrets.Box  // Encrypts probe config secrets; nil stores them plain
+	secretKeys SecretKeyFunc // Secret config keys of a probe mode; nil when none are known
 }
 
-// NewDB initializes the SQLite database
-func NewDB(dbPath string) (*DB, error) {
-	// Ensure directory exists
-	dir := filepath.Dir(dbPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create db dir: %w", err)
+// SecretKeyFunc returns the keys of a probe mode's config that hold secrets,
+// e.g. prober.SecretKeys
+type SecretKeyFunc func(probeType string) []string
+
+// ParseDSN picks the backend of a database DSN: postgres:// and
+// postgresql:// URLs select PostgreSQL; sqlite:// URLs and plain file paths
+// select SQLite. conn is what the driver is opened with.
+func ParseDSN(dsn string) (backend, conn string) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return BackendPostgres, dsn
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return BackendSQLite, strings.TrimPrefix(dsn, "sqlite://")
+	default:
+		return BackendSQLite, dsn
 	}
+}
 
-	// GORM Config
-	config := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Warn), // Quiet logs
+// RedactDSN hides the password of a database URL for logging
+func RedactDSN(dsn string) string {
+	if backend, _ := ParseDSN(dsn); backend != BackendPostgres {
+		return dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "postgres://(invalid DSN)"
 	}
+	return u.Redacted()
+}
 
-	// Open DB
-	db, err := gorm.Open(sqlite.Open(dbPath), config)
+// NewDB opens the database named by dsn (see ParseDSN) and applies all
+// pending migrations
+func NewDB(dsn string) (*DB, error) {
+	d, err := Open(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open sqlite: %w", err)
+		return nil, err
+	}
+	if err := d.Migrate(0); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("migration failed: %w", err)
+	}
+	return d, nil
+}
+
+// Open opens the database named by dsn without migrating it, e.g. to inspect
+// or step through migrations
+func Open(dsn string) (*DB, error) {
+	// GORM Config
+	config := &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Warn), // Quiet logs
+		TranslateError: true,                                // Driver errors as gorm.ErrDuplicatedKey etc., on every backend
 	}
 
-	// Enable WAL Mode for better concurrency
-	// "PRAGMA journal_mode=WAL;"
-	if res := db.Exec("PRAGMA journal_mode=WAL;"); res.Error != nil {
-		log.Printf("Warning: Failed to enable WAL mode: %v", res.Error)
+	backend, conn := ParseDSN(dsn)
+	d := &DB{backend: backend}
+	var db *gorm.DB
+	var err error
+	switch backend {
+	case BackendPostgres:
+		db, err = gorm.Open(postgres.Open(conn), config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open postgres: %w", err)
+		}
+	default:
+		d.path = conn
+		// Ensure directory exists
+		if err := os.MkdirAll(filepath.Dir(conn), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create db dir: %w", err)
+		}
+		db, err = gorm.Open(sqlite.Open(conn), config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sqlite: %w", err)
+		}
+
+		// Enable WAL Mode for better concurrency
+		if res := db.Exec("PRAGMA journal_mode=WAL;"); res.Error != nil {
+			log.Printf("Warning: Failed to enable WAL mode: %v", res.Error)
+		}
 	}
 
-	// Auto Migrate
-	if err := db.AutoMigrate(&MonitorRecord{}, &Target{}, &User{}); err != nil {
-		return nil, fmt.Errorf("migration failed: %w", err)
+	d.conn = db
+	return d, nil
+}
+
+// Backend returns BackendSQLite or BackendPostgres
+func (d *DB) Backend() string {
+	return d.backend
+}
+
+// Path returns the SQLite database file, or "" on PostgreSQL
+func (d *DB) Path() string {
+	return d.path
+}
+
+// SetSecretBox sets the key probe config secrets are encrypted with when
+// targets are saved
+func (d *DB) SetSecretBox(b *secrets.Box) {
+	d.secrets = b
+}
+
+// SetSecretKeys sets how the secret keys of a probe config are found. Without
+// it probe configs are stored as they are.
+func (d *DB) SetSecretKeys(fn SecretKeyFunc) {
+	d.secretKeys = fn
+}
+
+// secretKeysOf returns the secret config keys of a probe mode
+func (d *DB) secretKeysOf(probeType string) []string {
+	if d.secretKeys == nil {
+		return nil
 	}
+	return d.secretKeys(probeType)
+}
 
-	return &DB{conn: db}, nil
+// SecretBox returns the key probe config secrets are encrypted with, or nil
+func (d *DB) SecretBox() *secrets.Box {
+	return d.secrets
 }
 
 // Close closes the underlying db connection (optional, GORM manages pool)
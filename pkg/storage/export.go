@@ -0,0 +1,56 @@
+package storage
+
+import "time"
+
+// RecordFilter selects records by target and time range for streaming
+type RecordFilter struct {
+	TargetIDs []uint // Empty for all targets
+	Start     time.Time
+	End       time.Time
+}
+
+// EachLatency calls fn for every latency record matching f, oldest first,
+// reading them one at a time from the database
+func (d *DB) EachLatency(f RecordFilter, fn func(*LatencyRecord) error) error {
+	return eachRecord(d, f, fn)
+}
+
+// EachSpeed calls fn for every speed record matching f, oldest first
+func (d *DB) EachSpeed(f RecordFilter, fn func(*SpeedRecord) error) error {
+	return eachRecord(d, f, fn)
+}
+
+// EachHop calls fn for every trace hop matching f, oldest trace first and
+// by TTL within a trace
+func (d *DB) EachHop(f RecordFilter, fn func(*HopRecord) error) error {
+	return eachRecord(d, f, fn, "ttl asc")
+}
+
+// eachRecord streams the rows of T through fn without loading them all.
+// An error from fn stops the iteration and is returned.
+func eachRecord[T any](d *DB, f RecordFilter, fn func(*T) error, order ...string) error {
+	q := d.conn.Model(new(T)).Where("created_at BETWEEN ? AND ?", f.Start, f.End)
+	if len(f.TargetIDs) > 0 {
+		q = q.Where("target_id IN ?", f.TargetIDs)
+	}
+	q = q.Order("created_at asc")
+	for _, o := range order {
+		q = q.Order(o)
+	}
+	rows, err := q.Order("id asc").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r T
+		if err := d.conn.ScanRows(rows, &r); err != nil {
+			return err
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// hopBatchSize bounds the rows inserted per statement
+const hopBatchSize = 500
+
+// traceBlob is the part of the TraceJson payload the hop table is built from
+type traceBlob struct {
+	Hops []struct {
+		Hop            int     `json:"hop"`
+		IP             string  `json:"ip"`
+		ASN            string  `json:"asn"`
+		Loss           float64 `json:"loss"`
+		LatencyLastMs  float64 `json:"latency_last_ms"`
+		LatencyAvgMs   float64 `json:"latency_avg_ms"`
+		LatencyBestMs  float64 `json:"latency_best_ms"`
+		LatencyWorstMs float64 `json:"latency_worst_ms"`
+	} `json:"hops"`
+}
+
+// hopsOf extracts the hops of a trace. Traces that failed were stored as an
+// empty array and yield none.
+func hopsOf(r *TraceRecord) []HopRecord {
+	var blob traceBlob
+	if err := json.Unmarshal(r.TraceJson, &blob); err != nil {
+		return nil
+	}
+	hops := make([]HopRecord, 0, len(blob.Hops))
+	for _, h := range blob.Hops {
+		hop := HopRecord{
+			CreatedAt: r.CreatedAt,
+			TraceID:   r.ID,
+			TargetID:  r.TargetID,
+			Target:    r.Target,
+			TTL:       h.Hop,
+			IP:        h.IP,
+			ASN:       h.ASN,
+			Loss:      h.Loss,
+			LatencyMs: h.LatencyAvgMs,
+			BestMs:    h.LatencyBestMs,
+			WorstMs:   h.LatencyWorstMs,
+		}
+		if hop.IP == "*" {
+			hop.IP = ""
+		}
+		if hop.LatencyMs == 0 {
+			hop.LatencyMs = h.LatencyLastMs // Traceroute hops have a single RTT
+		}
+		if hop.BestMs == 0 && hop.WorstMs == 0 {
+			hop.BestMs, hop.WorstMs = hop.LatencyMs, hop.LatencyMs
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// HopSummary aggregates the samples of one hop over a time range
+type HopSummary struct {
+	Samples   int     `json:"samples"`    // Traces that reached the hop
+	Drops     int     `json:"drops"`      // Samples with packet loss
+	LossAvg   float64 `json:"loss_avg"`   // Percent
+	LatencyMs float64 `json:"latency_ms"` // Average RTT over samples that answered
+	BestMs    float64 `json:"best_ms"`
+	WorstMs   float64 `json:"worst_ms"`
+}
+
+// SummarizeHops aggregates hop samples, e.g. from GetHopHistory
+func SummarizeHops(hops []HopRecord) HopSummary {
+	var sum HopSummary
+	answered := 0
+	for _, h := range hops {
+		sum.Samples++
+		sum.LossAvg += h.Loss
+		if h.Loss > 0 {
+			sum.Drops++
+		}
+		if h.LatencyMs <= 0 {
+			continue
+		}
+		if answered == 0 || h.BestMs < sum.BestMs {
+			sum.BestMs = h.BestMs
+		}
+		sum.WorstMs = max(sum.WorstMs, h.WorstMs)
+		sum.LatencyMs += h.LatencyMs
+		answered++
+	}
+	if sum.Samples > 0 {
+		sum.LossAvg /= float64(sum.Samples)
+	}
+	if answered > 0 {
+		sum.LatencyMs /= float64(answered)
+	}
+	return sum
+}
+
+// GetHopHistory fetches the samples of one hop within a time range: the hop
+// at ttl on the route to the target, or wherever ip showed up when ip is set
+// (limited to the routes to the target unless targetID is 0)
+func (d *DB) GetHopHistory(targetID uint, ttl int, ip string, start, end time.Time) ([]HopRecord, error) {
+	q := d.conn.Where("created_at BETWEEN ? AND ?", start, end)
+	if targetID != 0 {
+		q = q.Where("target_id = ?", targetID)
+	}
+	if ip != "" {
+		q = q.Where("ip = ?", ip)
+	} else {
+		q = q.Where("ttl = ?", ttl)
+	}
+	var hops []HopRecord
+	err := q.Order("created_at asc, ttl asc").Find(&hops).Error
+	return hops, err
+}
+
+// backfillHops fills the hop table from the traces that have no hops yet,
+// i.e. those stored before the table existed. As migration 3, it works on the
+// tables of the baseline.
+func backfillHops(db *gorm.DB) error {
+	var total int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var traces []v1TraceRecord
+		withHops := tx.Model(&v1HopRecord{}).Distinct("trace_id")
+		return tx.Where("id NOT IN (?)", withHops).Order("id").FindInBatches(&traces, hopBatchSize, func(_ *gorm.DB, _ int) error {
+			var hops []v1HopRecord
+			for _, tr := range traces {
+				for _, h := range hopsOf(&TraceRecord{ID: tr.ID, CreatedAt: tr.CreatedAt, Target: tr.Target, TraceJson: tr.TraceJson}) {
+					hops = append(hops, v1HopRecord{
+						CreatedAt: h.CreatedAt, TraceID: h.TraceID, Target: h.Target, TTL: h.TTL, IP: h.IP, ASN: h.ASN,
+						Loss: h.Loss, LatencyMs: h.LatencyMs, BestMs: h.BestMs, WorstMs: h.WorstMs,
+					})
+				}
+			}
+			if len(hops) == 0 {
+				return nil
+			}
+			total += len(hops)
+			return tx.CreateInBatches(hops, hopBatchSize).Error
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		log.Printf("Backfilled %d hops from stored traces", total)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// JitterWindow is the number of latest latency samples jitter is computed over
+const JitterWindow = 10
+
+// TargetSnapshot holds the latest measurements of a target. Nil records and
+// a zero HopsTrace mean the target has none yet.
+type TargetSnapshot struct {
+	Latency   *LatencyRecord
+	JitterMs  float64 // Mean difference between consecutive latency samples
+	Jitter    bool    // False with fewer than two answered samples
+	Speed     *SpeedRecord
+	Hops      int  // Hops of the latest trace
+	HopsTrace uint // ID of that trace
+}
+
+// GetTargetSnapshots returns the latest measurements of the given targets,
+// keyed by target ID. Only the newest rows of each target are read, so the
+// cost does not grow with the retention.
+func (d *DB) GetTargetSnapshots(targetIDs []uint) (map[uint]*TargetSnapshot, error) {
+	snaps := make(map[uint]*TargetSnapshot, len(targetIDs))
+	for _, id := range targetIDs {
+		snaps[id] = &TargetSnapshot{}
+	}
+	if len(targetIDs) == 0 {
+		return snaps, nil
+	}
+
+	latencies, err := latestPerTarget[LatencyRecord](d, "latency_records",
+		"id, created_at, target_id, latency_ms, packet_loss", targetIDs, JitterWindow)
+	if err != nil {
+		return nil, err
+	}
+	byTarget := make(map[uint][]LatencyRecord)
+	for _, r := range latencies {
+		byTarget[r.TargetID] = append(byTarget[r.TargetID], r)
+	}
+	for id, records := range byTarget {
+		snap := snaps[id]
+		snap.Latency = &records[0]
+		snap.JitterMs, snap.Jitter = jitterOf(records)
+	}
+
+	speeds, err := latestPerTarget[SpeedRecord](d, "speed_records",
+		"id, created_at, target_id, speed_up, speed_down", targetIDs, 1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range speeds {
+		snaps[speeds[i].TargetID].Speed = &speeds[i]
+	}
+
+	// Hops are counted in hop_records rather than decoded from the trace blobs
+	traces, err := latestPerTarget[TraceRecord](d, "trace_records", "id, created_at, target_id", targetIDs, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(traces) == 0 {
+		return snaps, nil
+	}
+	traceIDs := make([]uint, len(traces))
+	for i, tr := range traces {
+		traceIDs[i] = tr.ID
+		snaps[tr.TargetID].HopsTrace = tr.ID
+	}
+	var counts []struct {
+		TraceID uint
+		Hops    int
+	}
+	err = d.conn.Model(&HopRecord{}).Select("trace_id, COUNT(*) AS hops").
+		Where("trace_id IN ?", traceIDs).Group("trace_id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	hops := make(map[uint]int, len(counts))
+	for _, c := range counts {
+		hops[c.TraceID] = c.Hops
+	}
+	for _, tr := range traces {
+		snaps[tr.TargetID].Hops = hops[tr.ID]
+	}
+	return snaps, nil
+}
+
+// snapshotChunk bounds the targets combined into one query, below SQLite's
+// limit of 500 terms in a compound SELECT
+const snapshotChunk = 100
+
+// latestPerTarget reads the given columns of the newest n rows of each of the
+// targets, ordered by target and then newest first. Every target is a LIMIT subquery served by the (target_id,
+// created_at) index, combined with UNION ALL into one query per chunk.
+func latestPerTarget[T any](d *DB, table, columns string, targetIDs []uint, n int) ([]T, error) {
+	var rows []T
+	for start := 0; start < len(targetIDs); start += snapshotChunk {
+		ids := targetIDs[start:min(start+snapshotChunk, len(targetIDs))]
+		parts := make([]string, len(ids))
+		args := make([]interface{}, len(ids))
+		for i, id := range ids {
+			parts[i] = fmt.Sprintf("SELECT * FROM (SELECT %s FROM %s WHERE target_id = ? ORDER BY created_at DESC, id DESC LIMIT %d) AS t%d",
+				columns, table, n, i)
+			args[i] = id
+		}
+		var chunk []T
+		query := strings.Join(parts, " UNION ALL ") + " ORDER BY target_id, created_at DESC, id DESC"
+		if err := d.conn.Raw(query, args...).Scan(&chunk).Error; err != nil {
+			return nil, err
+		}
+		rows = append(rows, chunk...)
+	}
+	return rows, nil
+}
+
+// jitterOf is the mean absolute difference between consecutive latency
+// samples, skipping samples where every packet was lost
+func jitterOf(records []LatencyRecord) (float64, bool) {
+	var sum float64
+	n := 0
+	prev := -1.0
+	for _, r := range records {
+		if r.PacketLoss >= 100 {
+			continue
+		}
+		if prev >= 0 {
+			sum += math.Abs(r.LatencyMs - prev)
+			n++
+		}
+		prev = r.LatencyMs
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
@@ -0,0 +1,512 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaMigration records an applied migration in the schema_migrations table
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"type:varchar(128);not null" json:"name"`
+	AppliedAt time.Time `gorm:"not null" json:"applied_at"`
+}
+
+// migration is one step of the schema. Steps are applied in order, each in
+// its own transaction, and never edited once released: schema changes go in
+// a new step.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+var migrations = []migration{
+	// Baseline: creates the tables of a fresh database, and brings databases
+	// from before versioned migrations up to the same schema
+	{1, "create tables", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v1LatencyRecord{}, &v1SpeedRecord{}, &v1TraceRecord{}, &v1Target{}, &v1User{},
+			&v1HopRecord{}, &v1RoutePath{}, &v1RouteChange{}, &v1DNSRecord{}, &v1Setting{}, &v1SettingAudit{}, &v1RollupRecord{})
+	}},
+	{2, "split monitor_records", splitMonitorRecords},
+	{3, "backfill trace hops", backfillHops},
+	{4, "link records to targets by id", linkRecordsToTargets},
+	{5, "create secrets store", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v5Secret{})
+	}},
+	{6, "index records by target and time", indexRecordsByTargetTime},
+	{7, "backfill rollups", backfillRollups},
+}
+
+// LatestSchemaVersion is the version Migrate(0) migrates to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationState describes one migration and whether it has been applied
+type MigrationState struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"` // nil while pending
+}
+
+// MigrationStatus lists every migration with when it was applied
+func (d *DB) MigrationStatus() ([]MigrationState, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationState{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			st.AppliedAt = &a.AppliedAt
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// SchemaVersion returns the highest applied migration, 0 for a fresh database
+func (d *DB) SchemaVersion() (int, error) {
+	applied, err := d.appliedMigrations()
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, err
+}
+
+func (d *DB) appliedMigrations() (map[int]SchemaMigration, error) {
+	if !d.conn.Migrator().HasTable(&SchemaMigration{}) {
+		return map[int]SchemaMigration{}, nil
+	}
+	var rows []SchemaMigration
+	if err := d.conn.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// Migrate applies the pending migrations up to version to (0 = latest). On
+// SQLite the database file is backed up first unless it is fresh. Only
+// up-migrations exist, so a database past to is an error.
+func (d *DB) Migrate(to int) error {
+	return d.migrate(to, true)
+}
+
+// migrate is Migrate, optionally without the pre-migration backup
+func (d *DB) migrate(to int, backup bool) error {
+	latest := LatestSchemaVersion()
+	if to == 0 {
+		to = latest
+	}
+	if to < 0 || to > latest {
+		return fmt.Errorf("unknown schema version %d (latest is %d)", to, latest)
+	}
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	current := 0
+	for v := range applied {
+		current = max(current, v)
+	}
+	if current > to {
+		return fmt.Errorf("database is at schema version %d, cannot migrate down to %d", current, to)
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok && m.version <= to {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if backup {
+		if err := d.backupBeforeMigrate(current, pending[0].version); err != nil {
+			return fmt.Errorf("pre-migration backup failed: %w", err)
+		}
+	}
+	if err := d.conn.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		err := d.conn.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// backupBeforeMigrate snapshots the SQLite file next to it before migration
+// next runs. Fresh databases have nothing worth keeping.
+func (d *DB) backupBeforeMigrate(current, next int) error {
+	if d.backend != BackendSQLite || (current == 0 && !d.conn.Migrator().HasTable(&Target{})) {
+		return nil
+	}
+	path := fmt.Sprintf("%s.pre-v%d-%s.bak", d.path, next, time.Now().Format("20060102-150405"))
+	if err := d.conn.Exec("VACUUM INTO ?", path).Error; err != nil {
+		return err
+	}
+	log.Printf("Backed up database to %s before migrating", path)
+	return nil
+}
+
+// The v1 types are the tables as the baseline migration creates them. Like
+// the migrations, they are never edited: model changes get a migration of
+// their own, with the columns it adds declared as they were then.
+
+type v1Target struct {
+	ID               uint      `gorm:"primaryKey"`
+	CreatedAt        time.Time `gorm:"not null"`
+	UpdatedAt        time.Time
+	Name             string     `gorm:"type:varchar(64);not null"`
+	Address          string     `gorm:"type:varchar(128);uniqueIndex;not null"`
+	Desc             string     `gorm:"type:text"`
+	Enabled          bool       `gorm:"default:true"`
+	ProbeType        string     `gorm:"column:probe_type;type:varchar(20);default:'MODE_ICMP'"`
+	ProbeConfig      string     `gorm:"column:probe_config;type:text"`
+	AddressFamily    string     `gorm:"column:address_family;type:varchar(8);default:'auto'"`
+	TimeoutSec       int        `gorm:"column:timeout_sec;default:0"`
+	PingIntervalSec  int        `gorm:"column:ping_interval_sec;default:0"`
+	TraceIntervalSec int        `gorm:"column:trace_interval_sec;default:0"`
+	SpeedIntervalSec int        `gorm:"column:speed_interval_sec;default:0"`
+	LastError        string     `gorm:"column:last_error;type:text"`
+	LastErrorAt      *time.Time `gorm:"column:last_error_at"`
+	LastErrorKind    string     `gorm:"column:last_error_kind;type:varchar(16)"`
+}
+
+func (v1Target) TableName() string { return "targets" }
+
+type v1User struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"not null"`
+	Username  string    `gorm:"type:varchar(64);uniqueIndex;not null"`
+	Password  string    `gorm:"type:varchar(128);not null"`
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1LatencyRecord struct {
+	ID            uint      `gorm:"primaryKey"`
+	CreatedAt     time.Time `gorm:"index;not null"`
+	Target        string    `gorm:"index;type:varchar(128);not null"`
+	LatencyMs     float64   `gorm:"not null"`
+	PacketLoss    float64   `gorm:"not null"`
+	IPFamily      string    `gorm:"column:ip_family;type:varchar(4)"`
+	LatencySource string    `gorm:"column:latency_source;type:varchar(16)"`
+	HTTPStatus    int       `gorm:"column:http_status;default:0"`
+	HTTPDNSMs     float64   `gorm:"column:http_dns_ms;default:0"`
+	HTTPConnectMs float64   `gorm:"column:http_connect_ms;default:0"`
+	HTTPTLSMs     float64   `gorm:"column:http_tls_ms;default:0"`
+	HTTPTTFBMs    float64   `gorm:"column:http_ttfb_ms;default:0"`
+	HTTPTotalMs   float64   `gorm:"column:http_total_ms;default:0"`
+}
+
+func (v1LatencyRecord) TableName() string { return "latency_records" }
+
+type v1SpeedRecord struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index;not null"`
+	Target    string    `gorm:"index;type:varchar(128);not null"`
+	ProbeType string    `gorm:"column:probe_type;type:varchar(20)"`
+	SpeedUp   float64   `gorm:"not null"`
+	SpeedDown float64   `gorm:"not null"`
+}
+
+func (v1SpeedRecord) TableName() string { return "speed_records" }
+
+type v1TraceRecord struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index;not null"`
+	Target    string    `gorm:"index;type:varchar(128);not null"`
+	TraceJson []byte    `gorm:"type:text;not null"`
+}
+
+func (v1TraceRecord) TableName() string { return "trace_records" }
+
+type v1HopRecord struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index;not null"`
+	TraceID   uint      `gorm:"index;not null"`
+	Target    string    `gorm:"index:idx_hop_target_ttl;type:varchar(128);not null"`
+	TTL       int       `gorm:"column:ttl;index:idx_hop_target_ttl;not null"`
+	IP        string    `gorm:"index;type:varchar(64)"`
+	ASN       string    `gorm:"type:varchar(32)"`
+	Loss      float64   `gorm:"not null"`
+	LatencyMs float64   `gorm:"not null"`
+	BestMs    float64   `gorm:"not null"`
+	WorstMs   float64   `gorm:"not null"`
+}
+
+func (v1HopRecord) TableName() string { return "hop_records" }
+
+type v1RoutePath struct {
+	ID          uint      `gorm:"primaryKey"`
+	Target      string    `gorm:"uniqueIndex:idx_route_path;type:varchar(128);not null"`
+	Fingerprint string    `gorm:"uniqueIndex:idx_route_path;type:varchar(64);not null"`
+	Hops        string    `gorm:"type:text"` // JSON
+	FirstSeen   time.Time `gorm:"not null"`
+	LastSeen    time.Time `gorm:"index;not null"`
+	Seen        int       `gorm:"not null;default:0"`
+}
+
+func (v1RoutePath) TableName() string { return "route_paths" }
+
+type v1RouteChange struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index;not null"`
+	Target     string    `gorm:"index;type:varchar(128);not null"`
+	FromPathID uint      `gorm:"not null"`
+	ToPathID   uint      `gorm:"not null"`
+	Diff       string    `gorm:"type:text"` // JSON
+}
+
+func (v1RouteChange) TableName() string { return "route_changes" }
+
+type v1DNSRecord struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index;not null"`
+	Target    string    `gorm:"index;type:varchar(128);not null"`
+	Resolver  string    `gorm:"type:varchar(255);not null"`
+	Name      string    `gorm:"type:varchar(255);not null"`
+	QType     string    `gorm:"column:qtype;type:varchar(8);not null"`
+	Rcode     string    `gorm:"type:varchar(16)"`
+	QueryMs   float64   `gorm:"default:0"`
+	Answers   string    `gorm:"type:text"` // JSON
+	Changed   bool      `gorm:"default:false"`
+	Error     string    `gorm:"type:text"`
+}
+
+func (v1DNSRecord) TableName() string { return "dns_records" }
+
+type v1Setting struct {
+	Key       string `gorm:"primaryKey;type:varchar(64)"`
+	Value     string `gorm:"type:text;not null"`
+	UpdatedAt time.Time
+}
+
+func (v1Setting) TableName() string { return "settings" }
+
+type v1SettingAudit struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index;not null"`
+	Key       string    `gorm:"type:varchar(64);not null"`
+	OldValue  string    `gorm:"type:text"`
+	NewValue  string    `gorm:"type:text"`
+	Actor     string    `gorm:"type:varchar(64)"`
+}
+
+func (v1SettingAudit) TableName() string { return "setting_audits" }
+
+type v1RollupRecord struct {
+	ID             uint      `gorm:"primaryKey"`
+	Target         string    `gorm:"uniqueIndex:idx_rollup_bucket;type:varchar(128);not null"`
+	Resolution     string    `gorm:"uniqueIndex:idx_rollup_bucket;type:varchar(4);not null"`
+	Bucket         time.Time `gorm:"uniqueIndex:idx_rollup_bucket;not null"`
+	Samples        int       `gorm:"not null;default:0"`
+	LatencySamples int       `gorm:"not null;default:0"`
+	LatencyMin     float64   `gorm:"not null;default:0"`
+	LatencyAvg     float64   `gorm:"not null;default:0"`
+	LatencyMax     float64   `gorm:"not null;default:0"`
+	LatencyP95     float64   `gorm:"column:latency_p95;not null;default:0"`
+	LossAvg        float64   `gorm:"not null;default:0"`
+	LossMax        float64   `gorm:"not null;default:0"`
+	SpeedSamples   int       `gorm:"not null;default:0"`
+	SpeedDownAvg   float64   `gorm:"not null;default:0"`
+	SpeedDownMax   float64   `gorm:"not null;default:0"`
+	SpeedUpAvg     float64   `gorm:"not null;default:0"`
+	SpeedUpMax     float64   `gorm:"not null;default:0"`
+	HTTPSamples    int       `gorm:"column:http_samples;not null;default:0"`
+	HTTPDNSMs      float64   `gorm:"column:http_dns_ms;not null;default:0"`
+	HTTPConnectMs  float64   `gorm:"column:http_connect_ms;not null;default:0"`
+	HTTPTLSMs      float64   `gorm:"column:http_tls_ms;not null;default:0"`
+	HTTPTTFBMs     float64   `gorm:"column:http_ttfb_ms;not null;default:0"`
+	HTTPTotalMs    float64   `gorm:"column:http_total_ms;not null;default:0"`
+	HTTPTotalMax   float64   `gorm:"column:http_total_max;not null;default:0"`
+	LatencyHist    string    `gorm:"type:text"` // JSON
+}
+
+func (v1RollupRecord) TableName() string { return "rollup_records" }
+
+// legacyRecordTable held latency, speed and trace data in one row type, with
+// zeros for whatever the row was not about
+const legacyRecordTable = "monitor_records"
+
+// splitMonitorRecords moves the rows of the legacy monitor_records table into
+// the latency, speed and trace tables and drops it. Rows with a speed are
+// speed tests; all others are latency samples, with their trace if any.
+func splitMonitorRecords(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(legacyRecordTable) {
+		return nil
+	}
+
+	// Columns added over time may be missing from old databases
+	latencyCols := []string{"created_at", "target", "latency_ms", "packet_loss"}
+	for _, col := range []string{"ip_family", "latency_source", "http_status", "http_dns_ms",
+		"http_connect_ms", "http_tls_ms", "http_ttfb_ms", "http_total_ms"} {
+		if m.HasColumn(legacyRecordTable, col) {
+			latencyCols = append(latencyCols, col)
+		}
+	}
+	cols := strings.Join(latencyCols, ", ")
+	const isSpeed = "(speed_up > 0 OR speed_down > 0)"
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var counts [3]int64
+		for i, stmt := range []string{
+			fmt.Sprintf("INSERT INTO latency_records (%s) SELECT %s FROM %s WHERE NOT %s ORDER BY id",
+				cols, cols, legacyRecordTable, isSpeed),
+			fmt.Sprintf("INSERT INTO speed_records (created_at, target, speed_up, speed_down) "+
+				"SELECT created_at, target, speed_up, speed_down FROM %s WHERE %s ORDER BY id",
+				legacyRecordTable, isSpeed),
+			fmt.Sprintf("INSERT INTO trace_records (created_at, target, trace_json) "+
+				"SELECT created_at, target, trace_json FROM %s WHERE NOT %s AND trace_json IS NOT NULL AND trace_json != '' ORDER BY id",
+				legacyRecordTable, isSpeed),
+		} {
+			res := tx.Exec(stmt)
+			if res.Error != nil {
+				return fmt.Errorf("split %s: %w", legacyRecordTable, res.Error)
+			}
+			counts[i] = res.RowsAffected
+		}
+		if err := tx.Migrator().DropTable(legacyRecordTable); err != nil {
+			return err
+		}
+		log.Printf("Split %s into %d latency, %d speed and %d trace records",
+			legacyRecordTable, counts[0], counts[1], counts[2])
+		return nil
+	})
+}
+
+// v4TargetDataTables are the tables holding per-target data that migration 4
+// keys by target_id
+var v4TargetDataTables = []string{
+	"latency_records", "speed_records", "trace_records", "hop_records",
+	"route_paths", "route_changes", "rollup_records", "dns_records",
+}
+
+// v4TargetID and v4ArchivedAt are the columns migration 4 adds, as they were
+// then. The target_id column goes to each of v4TargetDataTables.
+type v4TargetID struct {
+	TargetID uint `gorm:"column:target_id;not null;default:0"`
+}
+
+type v4ArchivedAt struct {
+	ArchivedAt *time.Time `gorm:"column:archived_at"`
+}
+
+func (v4ArchivedAt) TableName() string { return "targets" }
+
+// linkRecordsToTargets keys per-target data by target_id instead of the
+// address, so that editing an address keeps the history. Rows whose address
+// matches no target were already orphaned and keep target_id 0; their derived
+// rollups and paths are dropped as they would collide on the new keys. The
+// unique keys of rollups and paths are created here rather than in the
+// baseline, so that it never builds them over unlinked rows. Target addresses
+// become unique among active targets only, for archiving.
+func linkRecordsToTargets(tx *gorm.DB) error {
+	m := tx.Migrator()
+	if !m.HasColumn(&v4ArchivedAt{}, "ArchivedAt") {
+		if err := m.AddColumn(&v4ArchivedAt{}, "ArchivedAt"); err != nil {
+			return err
+		}
+	}
+	for _, table := range v4TargetDataTables {
+		tm := tx.Table(table).Migrator()
+		if !tm.HasColumn(&v4TargetID{}, "TargetID") {
+			if err := tm.AddColumn(&v4TargetID{}, "TargetID"); err != nil {
+				return err
+			}
+		}
+		err := tx.Exec(fmt.Sprintf("UPDATE %[1]s SET target_id = (SELECT id FROM targets WHERE targets.address = %[1]s.target) "+
+			"WHERE target_id = 0 AND target IN (SELECT address FROM targets)", table)).Error
+		if err != nil {
+			return fmt.Errorf("link %s: %w", table, err)
+		}
+	}
+	for _, table := range []string{"rollup_records", "route_paths", "route_changes"} {
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE target_id = 0", table)).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, idx := range []struct{ table, name string }{
+		{"targets", "idx_targets_address"},
+		{"hop_records", "idx_hop_target_ttl"},
+		{"route_changes", "idx_route_changes_target"},
+		{"route_paths", "idx_route_path"},
+		{"rollup_records", "idx_rollup_bucket"},
+	} {
+		if m.HasIndex(idx.table, idx.name) {
+			if err := m.DropIndex(idx.table, idx.name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, stmt := range []string{
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_rollup_target_bucket ON rollup_records (target_id, resolution, bucket)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_route_path_target ON route_paths (target_id, fingerprint)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_targets_address_active ON targets (address) WHERE archived_at IS NULL",
+		"CREATE INDEX IF NOT EXISTS idx_targets_archived_at ON targets (archived_at)",
+		"CREATE INDEX IF NOT EXISTS idx_hop_target_id_ttl ON hop_records (target_id, ttl)",
+		"CREATE INDEX IF NOT EXISTS idx_latency_records_target_id ON latency_records (target_id)",
+		"CREATE INDEX IF NOT EXISTS idx_speed_records_target_id ON speed_records (target_id)",
+		"CREATE INDEX IF NOT EXISTS idx_trace_records_target_id ON trace_records (target_id)",
+		"CREATE INDEX IF NOT EXISTS idx_route_changes_target_id ON route_changes (target_id)",
+		"CREATE INDEX IF NOT EXISTS idx_dns_records_target_id ON dns_records (target_id)",
+	} {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexRecordsByTargetTime replaces the target_id indexes of the record
+// tables with (target_id, created_at) ones, which also serve the latest
+// records of a target without scanning its history
+func indexRecordsByTargetTime(tx *gorm.DB) error {
+	for _, table := range []string{"latency_records", "speed_records", "trace_records"} {
+		stmts := []string{
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%[1]s_target_time ON %[1]s (target_id, created_at)", table),
+			fmt.Sprintf("DROP INDEX IF EXISTS idx_%s_target_id", table),
+		}
+		for _, stmt := range stmts {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// v5Secret is the secrets table as migration 5 creates it
+type v5Secret struct {
+	Name      string    `gorm:"primaryKey;type:varchar(64)"`
+	Value     string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+func (v5Secret) TableName() string { return "secrets" }
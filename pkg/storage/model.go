@@ -10,24 +10,48 @@ type Target struct {
 	CreatedAt time.Time `gorm:"not null" json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Name      string    `gorm:"type:varchar(64);not null" json:"name"`
-	Address   string    `gorm:"type:varchar(128);uniqueIndex;not null" json:"address"` // IP or Domain
+	Address   string    `gorm:"type:varchar(128);uniqueIndex:idx_targets_address_active,where:archived_at IS NULL;not null" json:"address"` // IP or Domain, unique among active targets
 	Desc      string    `gorm:"type:text" json:"desc"`
 	Enabled   bool      `gorm:"default:true" json:"enabled"`
 
 	// --- Probing Configuration (Phase 13) ---
-	// ProbeMode: ICMP, SSH, HTTP, IPERF3
+	// ProbeMode: any type registered in the prober registry (ICMP, SSH, HTTP, IPERF3, ...)
 	ProbeType string `gorm:"column:probe_type;type:varchar(20);default:'MODE_ICMP'" json:"probe_type"`
 
 	// ProbeConfig (JSON stored as text for flexibility)
 	// Includes URL for HTTP, Port for Iperf, Credentials for SSH
 	ProbeConfig string `gorm:"column:probe_config;type:text" json:"probe_config"`
 
+	// AddressFamily: auto (prefer IPv4), v4 or v6 - applies to ping and trace
+	AddressFamily string `gorm:"column:address_family;type:varchar(8);default:'auto'" json:"address_family"`
+
+	// TimeoutSec bounds each probe run of this target (0 = monitor default)
+	TimeoutSec int `gorm:"column:timeout_sec;default:0" json:"timeout_sec"`
+
+	// Probe intervals in seconds (0 = global setting). Traces run with the
+	// first ping after their interval has elapsed.
+	PingIntervalSec  int `gorm:"column:ping_interval_sec;default:0" json:"ping_interval_sec"`
+	TraceIntervalSec int `gorm:"column:trace_interval_sec;default:0" json:"trace_interval_sec"`
+	SpeedIntervalSec int `gorm:"column:speed_interval_sec;default:0" json:"speed_interval_sec"`
+
 	// --- Error Tracking (Phase Polish) ---
 	// LastError stores the most recent probe error message
 	LastError   string     `gorm:"column:last_error;type:text" json:"last_error"`
 	LastErrorAt *time.Time `gorm:"column:last_error_at" json:"last_error_at"`
+	// LastErrorKind tells a probe that ran out of time apart from one that failed
+	LastErrorKind string `gorm:"column:last_error_kind;type:varchar(16)" json:"last_error_kind,omitempty"`
+
+	// ArchivedAt is set when the target was deleted but its data kept. Archived
+	// targets are not probed and free their address for new targets.
+	ArchivedAt *time.Time `gorm:"column:archived_at;index" json:"archived_at,omitempty"`
 }
 
+// Target error kinds
+const (
+	TargetErrorKindError   = "error"
+	TargetErrorKindTimeout = "timeout"
+)
+
 // User represents a system administrator
 type User struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
@@ -36,27 +60,137 @@ type User struct {
 	Password  string    `gorm:"type:varchar(128);not null" json:"-"` // Hashed
 }
 
-// MonitorRecord represents a single monitoring data point (snapshot)
-type MonitorRecord struct {
+// LatencyRecord is one latency sample of a target: a ping, or the fallback
+// probe that answered when ICMP did not
+type LatencyRecord struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	CreatedAt time.Time `gorm:"index;not null" json:"created_at"` // Time-series index
-	Target    string    `gorm:"index;type:varchar(128);not null" json:"target"`
+	TargetID  uint      `gorm:"index;not null;default:0" json:"target_id"`
+	Target    string    `gorm:"index;type:varchar(128);not null" json:"target"` // Address at the time
 
-	// Ping Metrics (Always present)
 	LatencyMs  float64 `gorm:"not null" json:"latency_ms"`  // Average RTT in milliseconds
 	PacketLoss float64 `gorm:"not null" json:"packet_loss"` // Loss Percentage (0.0 - 100.0)
 
+	// IPFamily is the address family actually probed (v4 or v6)
+	IPFamily string `gorm:"column:ip_family;type:varchar(4)" json:"ip_family,omitempty"`
+	// LatencySource is the probe mode that measured the latency (MODE_ICMP, or e.g. MODE_TCP when ICMP is blocked)
+	LatencySource string `gorm:"column:latency_source;type:varchar(16)" json:"latency_source,omitempty"`
+
+	// HTTP Request Phases (MODE_HTTP_TIMING targets only), in milliseconds
+	HTTPStatus    int     `gorm:"column:http_status;default:0" json:"http_status,omitempty"`
+	HTTPDNSMs     float64 `gorm:"column:http_dns_ms;default:0" json:"http_dns_ms,omitempty"`
+	HTTPConnectMs float64 `gorm:"column:http_connect_ms;default:0" json:"http_connect_ms,omitempty"`
+	HTTPTLSMs     float64 `gorm:"column:http_tls_ms;default:0" json:"http_tls_ms,omitempty"`
+	HTTPTTFBMs    float64 `gorm:"column:http_ttfb_ms;default:0" json:"http_ttfb_ms,omitempty"`
+	HTTPTotalMs   float64 `gorm:"column:http_total_ms;default:0" json:"http_total_ms,omitempty"`
+}
+
+// SpeedRecord is the result of one bandwidth test
+type SpeedRecord struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index;not null" json:"created_at"`
+	TargetID  uint      `gorm:"index;not null;default:0" json:"target_id"`
+	Target    string    `gorm:"index;type:varchar(128);not null" json:"target"`                 // Address at the time
+	ProbeType string    `gorm:"column:probe_type;type:varchar(20)" json:"probe_type,omitempty"` // Empty for migrated rows
+
+	SpeedUp   float64 `gorm:"not null" json:"speed_up"`   // Mbps
+	SpeedDown float64 `gorm:"not null" json:"speed_down"` // Mbps
+}
+
+// TraceRecord is one route trace of a target
+type TraceRecord struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index;not null" json:"created_at"`
+	TargetID  uint      `gorm:"index;not null;default:0" json:"target_id"`
+	Target    string    `gorm:"index;type:varchar(128);not null" json:"target"` // Address at the time
+
 	// Traceroute Data (JSON Blob)
-	TraceJson []byte `gorm:"type:text" json:"trace_json,omitempty"`
+	TraceJson []byte `gorm:"type:text;not null" json:"trace_json"`
+}
+
+// HopRecord is one hop of a TraceRecord, kept in its own table so single hops
+// can be charted over time
+type HopRecord struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index;not null" json:"created_at"` // Time of the trace
+	TraceID   uint      `gorm:"index;not null" json:"trace_id"`
+	TargetID  uint      `gorm:"index:idx_hop_target_id_ttl;not null;default:0" json:"target_id"`
+	Target    string    `gorm:"type:varchar(128);not null" json:"target"` // Address at the time
+	TTL       int       `gorm:"column:ttl;index:idx_hop_target_id_ttl;not null" json:"ttl"`
+	IP        string    `gorm:"index;type:varchar(64)" json:"ip"` // Empty for hops that did not answer
+	ASN       string    `gorm:"type:varchar(32)" json:"asn,omitempty"`
+
+	Loss      float64 `gorm:"not null" json:"loss"`       // Percent
+	LatencyMs float64 `gorm:"not null" json:"latency_ms"` // Average RTT
+	BestMs    float64 `gorm:"not null" json:"best_ms"`
+	WorstMs   float64 `gorm:"not null" json:"worst_ms"`
+}
 
-	// Speed Test Metrics
-	SpeedUp   float64 `gorm:"default:0" json:"speed_up"`   // Mbps
-	SpeedDown float64 `gorm:"default:0" json:"speed_down"` // Mbps
+// RollupRecord aggregates the latency and speed records of one target over
+// one time bucket. Its JSON mirrors those records (averages under the same
+// keys) so charts can plot either. (TargetID, Resolution, Bucket) is unique,
+// see migration 4.
+type RollupRecord struct {
+	ID         uint      `gorm:"primaryKey" json:"-"`
+	TargetID   uint      `gorm:"not null;default:0" json:"target_id"`
+	Target     string    `gorm:"type:varchar(128);not null" json:"target"`   // Latest address
+	Resolution string    `gorm:"type:varchar(4);not null" json:"resolution"` // 1m, 1h or 1d
+	Bucket     time.Time `gorm:"not null" json:"created_at"`                 // Bucket start (UTC)
+
+	// Ping records in the bucket; latency stats cover those with a latency
+	Samples        int     `gorm:"not null;default:0" json:"samples"`
+	LatencySamples int     `gorm:"not null;default:0" json:"-"`
+	LatencyMin     float64 `gorm:"not null;default:0" json:"latency_min"`
+	LatencyAvg     float64 `gorm:"not null;default:0" json:"latency_ms"`
+	LatencyMax     float64 `gorm:"not null;default:0" json:"latency_max"`
+	LatencyP95     float64 `gorm:"column:latency_p95;not null;default:0" json:"latency_p95"` // Estimated from LatencyHist
+	LossAvg        float64 `gorm:"not null;default:0" json:"packet_loss"`
+	LossMax        float64 `gorm:"not null;default:0" json:"packet_loss_max"`
+
+	// Speed test records in the bucket
+	SpeedSamples int     `gorm:"not null;default:0" json:"speed_samples"`
+	SpeedDownAvg float64 `gorm:"not null;default:0" json:"speed_down"`
+	SpeedDownMax float64 `gorm:"not null;default:0" json:"speed_down_max"`
+	SpeedUpAvg   float64 `gorm:"not null;default:0" json:"speed_up"`
+	SpeedUpMax   float64 `gorm:"not null;default:0" json:"speed_up_max"`
+
+	// HTTP timing phases of the ping records that have them, averaged
+	HTTPSamples   int     `gorm:"column:http_samples;not null;default:0" json:"http_samples,omitempty"`
+	HTTPDNSMs     float64 `gorm:"column:http_dns_ms;not null;default:0" json:"http_dns_ms,omitempty"`
+	HTTPConnectMs float64 `gorm:"column:http_connect_ms;not null;default:0" json:"http_connect_ms,omitempty"`
+	HTTPTLSMs     float64 `gorm:"column:http_tls_ms;not null;default:0" json:"http_tls_ms,omitempty"`
+	HTTPTTFBMs    float64 `gorm:"column:http_ttfb_ms;not null;default:0" json:"http_ttfb_ms,omitempty"`
+	HTTPTotalMs   float64 `gorm:"column:http_total_ms;not null;default:0" json:"http_total_ms,omitempty"`
+	HTTPTotalMax  float64 `gorm:"column:http_total_max;not null;default:0" json:"http_total_max,omitempty"`
+
+	// LatencyHist counts latencies per log-scale bucket (see histBucket)
+	LatencyHist map[int]uint32 `gorm:"type:text;serializer:json" json:"-"`
+}
+
+// DNSRecord is the answer of one resolver to a MODE_DNS probe
+type DNSRecord struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index;not null" json:"created_at"`
+	TargetID  uint      `gorm:"index;not null;default:0" json:"target_id"`
+	Target    string    `gorm:"index;type:varchar(128);not null" json:"target"` // Address at the time
+	Resolver  string    `gorm:"type:varchar(255);not null" json:"resolver"`
+	Name      string    `gorm:"type:varchar(255);not null" json:"name"`
+	QType     string    `gorm:"column:qtype;type:varchar(8);not null" json:"qtype"`
+	Rcode     string    `gorm:"type:varchar(16)" json:"rcode,omitempty"` // Empty when the query failed
+	QueryMs   float64   `gorm:"default:0" json:"query_ms"`
+	Answers   []string  `gorm:"serializer:json;type:text" json:"answers"`
+	Changed   bool      `gorm:"default:false" json:"changed"` // Rcode or answers differ from the previous result
+	Error     string    `gorm:"type:text" json:"error,omitempty"`
 }
 
+// Probe modes as persisted in Target.ProbeType. They match the types the
+// prober registry registers, which storage does not depend on.
 const (
-	ProbeModeICMP  = "MODE_ICMP"
-	ProbeModeHTTP  = "MODE_HTTP"
-	ProbeModeSSH   = "MODE_SSH"
-	ProbeModeIPERF = "MODE_IPERF"
+	ProbeModeICMP       = "MODE_ICMP"
+	ProbeModeHTTP       = "MODE_HTTP"
+	ProbeModeSSH        = "MODE_SSH"
+	ProbeModeIPERF      = "MODE_IPERF"
+	ProbeModeTCP        = "MODE_TCP"
+	ProbeModeHTTPTiming = "MODE_HTTP_TIMING"
+	ProbeModeDNS        = "MODE_DNS"
 )
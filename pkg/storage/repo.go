@@ -1,84 +1,267 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/secrets"
+	"gorm.io/gorm"
 )
 
-// SaveRecord persists a monitoring record
-func (d *DB) SaveRecord(r *MonitorRecord) error {
-	return d.conn.Create(r).Error
-}
+// --- Latency Records ---
 
-// GetHistory fetches records for a specific target within a time range.
-// Optimization: We exclude TraceJson to reduce I/O for general charts.
-func (d *DB) GetHistory(target string, start, end time.Time) ([]MonitorRecord, error) {
-	var records []MonitorRecord
+// SaveLatency persists a latency sample and folds it into the rollups
+func (d *DB) SaveLatency(r *LatencyRecord) error {
+	if err := d.conn.Create(r).Error; err != nil {
+		return err
+	}
+	// Rollups are derived data: failing to update them must not lose the record
+	if err := d.updateRollups(r.TargetID, r.Target, r.CreatedAt, func(ru *RollupRecord) { ru.addLatency(r) }); err != nil {
+		log.Printf("Failed to update rollups for %s: %v", r.Target, err)
+	}
+	return nil
+}
 
-	err := d.conn.Model(&MonitorRecord{}).
-		Select("id, created_at, target, latency_ms, packet_loss, speed_up, speed_down"). // Exclude TraceJson
-		Where("target = ? AND created_at BETWEEN ? AND ?", target, start, end).
+// GetLatencyHistory fetches the latency samples of a target within a time range
+func (d *DB) GetLatencyHistory(targetID uint, start, end time.Time) ([]LatencyRecord, error) {
+	var records []LatencyRecord
+	err := d.conn.
+		Where("target_id = ? AND created_at BETWEEN ? AND ?", targetID, start, end).
 		Order("created_at asc").
 		Find(&records).Error
+	return records, err
+}
+
+// GetLatestLatency fetches the most recent latency sample of a target
+func (d *DB) GetLatestLatency(targetID uint) (*LatencyRecord, error) {
+	var r LatencyRecord
+	err := d.conn.
+		Where("target_id = ?", targetID).
+		Order("created_at desc").
+		Limit(1).
+		First(&r).Error
+	return &r, err
+}
+
+// --- Speed Records ---
+
+// SaveSpeed persists a bandwidth test result and folds it into the rollups
+func (d *DB) SaveSpeed(r *SpeedRecord) error {
+	if err := d.conn.Create(r).Error; err != nil {
+		return err
+	}
+	if err := d.updateRollups(r.TargetID, r.Target, r.CreatedAt, func(ru *RollupRecord) { ru.addSpeed(r) }); err != nil {
+		log.Printf("Failed to update rollups for %s: %v", r.Target, err)
+	}
+	return nil
+}
 
+// GetSpeedHistory fetches the bandwidth tests of a target within a time range
+func (d *DB) GetSpeedHistory(targetID uint, start, end time.Time) ([]SpeedRecord, error) {
+	var records []SpeedRecord
+	err := d.conn.
+		Where("target_id = ? AND created_at BETWEEN ? AND ?", targetID, start, end).
+		Order("created_at asc").
+		Find(&records).Error
 	return records, err
 }
 
-// GetRecordDetail fetches the full record including TraceJson by ID
-func (d *DB) GetRecordDetail(id uint) (*MonitorRecord, error) {
-	var r MonitorRecord
+// GetLatestSpeed fetches the most recent bandwidth test of a target
+func (d *DB) GetLatestSpeed(targetID uint) (*SpeedRecord, error) {
+	var r SpeedRecord
+	err := d.conn.
+		Where("target_id = ?", targetID).
+		Order("created_at desc").
+		Limit(1).
+		First(&r).Error
+	return &r, err
+}
+
+// --- Trace Records ---
+
+// SaveTrace persists a route trace along with its hops
+func (d *DB) SaveTrace(r *TraceRecord) error {
+	return d.conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(r).Error; err != nil {
+			return err
+		}
+		if hops := hopsOf(r); len(hops) > 0 {
+			return tx.CreateInBatches(hops, hopBatchSize).Error
+		}
+		return nil
+	})
+}
+
+// GetTraceDetail fetches a trace by ID
+func (d *DB) GetTraceDetail(id uint) (*TraceRecord, error) {
+	var r TraceRecord
 	err := d.conn.First(&r, id).Error
 	return &r, err
 }
 
-// GetLatestRecord fetches the most recent record for a target
-func (d *DB) GetLatestRecord(target string) (*MonitorRecord, error) {
-	var r MonitorRecord
+// GetLatestTrace fetches the most recent trace of a target
+func (d *DB) GetLatestTrace(targetID uint) (*TraceRecord, error) {
+	var r TraceRecord
 	err := d.conn.
-		Where("target = ?", target).
+		Where("target_id = ?", targetID).
 		Order("created_at desc").
 		Limit(1).
 		First(&r).Error
 	return &r, err
 }
 
-// GetLatestTrace fetches the most recent record that includes traceroute data
-func (d *DB) GetLatestTrace(target string) (*MonitorRecord, error) {
-	var r MonitorRecord
+// --- DNS Records ---
+
+// SaveDNSRecords persists the per-resolver answers of one DNS probe
+func (d *DB) SaveDNSRecords(records []DNSRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return d.conn.Create(&records).Error
+}
+
+// GetLatestDNSRecord fetches the previous answer of a resolver for the same question
+func (d *DB) GetLatestDNSRecord(targetID uint, resolver, name, qtype string) (*DNSRecord, error) {
+	var r DNSRecord
 	err := d.conn.
-		Where("target = ? AND trace_json IS NOT NULL AND trace_json != ''", target).
+		Where("target_id = ? AND resolver = ? AND name = ? AND qtype = ?", targetID, resolver, name, qtype).
 		Order("created_at desc").
 		Limit(1).
 		First(&r).Error
 	return &r, err
 }
 
+// GetDNSHistory fetches DNS records for a target within a time range
+func (d *DB) GetDNSHistory(targetID uint, start, end time.Time) ([]DNSRecord, error) {
+	var records []DNSRecord
+	err := d.conn.
+		Where("target_id = ? AND created_at BETWEEN ? AND ?", targetID, start, end).
+		Order("created_at asc").
+		Find(&records).Error
+	return records, err
+}
+
 // --- Target Management ---
 
-// CreateTarget inserts a new target. Returns error if address already exists.
+// ErrDuplicateAddress is returned when another active target has the address
+var ErrDuplicateAddress = errors.New("a target with this address already exists")
+
+// CreateTarget inserts a new target. Returns ErrDuplicateAddress if an active
+// target has the address already.
 func (d *DB) CreateTarget(t *Target) error {
-	return d.conn.Create(t).Error
+	if err := d.sealTarget(t); err != nil {
+		return err
+	}
+	return targetError(d.conn.Create(t).Error)
 }
 
-// UpdateTarget updates an existing target by ID.
-// Only updates non-zero fields to avoid overwriting with defaults.
+// targetError maps the violation of the unique address index, the only
+// unique key of a target besides its ID
+func targetError(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDuplicateAddress
+	}
+	return err
+}
+
+// targetSettings are the columns of a target its owner edits. Zero values
+// are written too, e.g. a 0 interval to fall back to the global setting.
+var targetSettings = []string{
+	"name", "address", "desc", "enabled", "probe_type", "probe_config", "address_family",
+	"timeout_sec", "ping_interval_sec", "trace_interval_sec", "speed_interval_sec", "updated_at",
+}
+
+// UpdateTarget updates the settings of an existing target by ID. Creation
+// time, archiving and error state are left alone.
 func (d *DB) UpdateTarget(t *Target) error {
 	if t.ID == 0 {
 		return fmt.Errorf("cannot update target without ID")
 	}
-	return d.conn.Model(t).Updates(t).Error
+	if err := d.sealTarget(t); err != nil {
+		return err
+	}
+	return targetError(d.conn.Model(t).Select(targetSettings).Updates(t).Error)
 }
 
 // SaveTarget creates or updates a target based on whether ID is set.
 // WARNING: For updates, prefer UpdateTarget to avoid GORM Save() pitfalls.
 func (d *DB) SaveTarget(t *Target) error {
+	if err := d.sealTarget(t); err != nil {
+		return err
+	}
 	if t.ID == 0 {
 		return d.conn.Create(t).Error
 	}
 	return d.conn.Save(t).Error
 }
 
+// sealTarget encrypts the secret fields of the target's probe config
+func (d *DB) sealTarget(t *Target) error {
+	config, err := secrets.SealFields(d.secrets, t.ProbeConfig, d.secretKeysOf(t.ProbeType))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt probe config: %w", err)
+	}
+	t.ProbeConfig = config
+	return nil
+}
+
+// ResealSecrets re-encrypts the probe config secrets of all targets, archived
+// ones included, and the entries of the secrets store from one key to another
+// in one transaction (see secrets.Reseal). It returns the number of targets
+// and entries changed.
+func (d *DB) ResealSecrets(from, to *secrets.Box) (int, error) {
+	changed := 0
+	err := d.conn.Transaction(func(tx *gorm.DB) error {
+		n, err := resealStoredSecrets(tx, from, to)
+		if err != nil {
+			return err
+		}
+		changed += n
+		var targets []Target
+		if err := tx.Find(&targets).Error; err != nil {
+			return err
+		}
+		for _, t := range targets {
+			config, err := secrets.Reseal(from, to, t.ProbeConfig, d.secretKeysOf(t.ProbeType))
+			if err != nil {
+				return fmt.Errorf("target %d (%s): %w", t.ID, t.Name, err)
+			}
+			if config == t.ProbeConfig {
+				continue
+			}
+			if err := tx.Model(&Target{}).Where("id = ?", t.ID).Update("probe_config", config).Error; err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// CountPlainSecrets returns the number of targets whose probe config holds
+// unencrypted secrets, plus the unencrypted entries of the secrets store
+func (d *DB) CountPlainSecrets() (int, error) {
+	var targets []Target
+	if err := d.conn.Select("id", "probe_type", "probe_config").Find(&targets).Error; err != nil {
+		return 0, err
+	}
+	var n64 int64
+	if err := d.conn.Model(&Secret{}).Where("value NOT LIKE ?", "enc:%").Count(&n64).Error; err != nil {
+		return 0, err
+	}
+	n := int(n64)
+	for _, t := range targets {
+		if secrets.HasPlain(t.ProbeConfig, d.secretKeysOf(t.ProbeType)) {
+			n++
+		}
+	}
+	return n, nil
+}
+
 // GetTargetByID retrieves a target by its ID
 func (d *DB) GetTargetByID(id uint) (*Target, error) {
 	var t Target
@@ -86,13 +269,56 @@ func (d *DB) GetTargetByID(id uint) (*Target, error) {
 	return &t, err
 }
 
+// GetTargetByAddress retrieves the active target with the given address, or
+// the most recently archived one if no active target has it
+func (d *DB) GetTargetByAddress(address string) (*Target, error) {
+	var t Target
+	err := d.conn.Where("address = ?", address).
+		Order("archived_at IS NOT NULL, archived_at desc").
+		First(&t).Error
+	return &t, err
+}
+
+// targetData lists the tables holding per-target data, keyed by target_id
+var targetData = []interface{}{
+	&LatencyRecord{}, &SpeedRecord{}, &TraceRecord{}, &HopRecord{},
+	&RoutePath{}, &RouteChange{}, &RollupRecord{}, &DNSRecord{},
+}
+
+// DeleteTarget removes a target along with all of its data
 func (d *DB) DeleteTarget(id uint) error {
-	return d.conn.Delete(&Target{}, id).Error
+	return d.conn.Transaction(func(tx *gorm.DB) error {
+		for _, model := range targetData {
+			if err := tx.Where("target_id = ?", id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&Target{}, id).Error
+	})
 }
 
+// ArchiveTarget stops probing a target but keeps it and its data, freeing
+// its address for a new target
+func (d *DB) ArchiveTarget(id uint) error {
+	return d.conn.Model(&Target{}).
+		Where("id = ? AND archived_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"archived_at": time.Now(),
+			"enabled":     false,
+		}).Error
+}
+
+// GetArchivedTargets lists the archived targets, most recent first
+func (d *DB) GetArchivedTargets() ([]Target, error) {
+	var targets []Target
+	err := d.conn.Where("archived_at IS NOT NULL").Order("archived_at desc").Find(&targets).Error
+	return targets, err
+}
+
+// GetTargets lists the active (non-archived) targets
 func (d *DB) GetTargets(onlyEnabled bool) ([]Target, error) {
 	var targets []Target
-	query := d.conn.Model(&Target{})
+	query := d.conn.Model(&Target{}).Where("archived_at IS NULL")
 	if onlyEnabled {
 		query = query.Where("enabled = ?", true)
 	}
@@ -101,23 +327,34 @@ func (d *DB) GetTargets(onlyEnabled bool) ([]Target, error) {
 }
 
 // UpdateTargetError updates the last_error and last_error_at fields for a target
-func (d *DB) UpdateTargetError(address string, errMsg string) error {
+func (d *DB) UpdateTargetError(id uint, errMsg string) error {
+	return d.setTargetError(id, errMsg, TargetErrorKindError)
+}
+
+// UpdateTargetTimeout records that a probe of the target ran out of time
+func (d *DB) UpdateTargetTimeout(id uint, errMsg string) error {
+	return d.setTargetError(id, errMsg, TargetErrorKindTimeout)
+}
+
+func (d *DB) setTargetError(id uint, errMsg, kind string) error {
 	now := time.Now()
 	return d.conn.Model(&Target{}).
-		Where("address = ?", address).
+		Where("id = ?", id).
 		Updates(map[string]interface{}{
-			"last_error":    errMsg,
-			"last_error_at": now,
+			"last_error":      errMsg,
+			"last_error_at":   now,
+			"last_error_kind": kind,
 		}).Error
 }
 
 // ClearTargetError clears the error fields for a target (on successful probe)
-func (d *DB) ClearTargetError(address string) error {
+func (d *DB) ClearTargetError(id uint) error {
 	return d.conn.Model(&Target{}).
-		Where("address = ?", address).
+		Where("id = ?", id).
 		Updates(map[string]interface{}{
-			"last_error":    "",
-			"last_error_at": nil,
+			"last_error":      "",
+			"last_error_at":   nil,
+			"last_error_kind": "",
 		}).Error
 }
 
@@ -156,6 +393,7 @@ func (d *DB) HasAnyUser() bool {
 
 // DatabaseStats returns database statistics
 type DatabaseStats struct {
+	Backend       string `json:"backend"` // sqlite or postgres
 	SizeBytes     int64  `json:"size_bytes"`
 	SizeHuman     string `json:"size_human"`
 	RecordCount   int64  `json:"record_count"`
@@ -163,48 +401,127 @@ type DatabaseStats struct {
 	OldestRecord  string `json:"oldest_record,omitempty"`
 	NewestRecord  string `json:"newest_record,omitempty"`
 	RetentionDays int    `json:"retention_days"`
+	AutoVacuum    string `json:"auto_vacuum,omitempty"` // SQLite: none, full or incremental
+
+	LastPrune *PruneReport `json:"last_prune,omitempty"` // Latest retention job run
+}
+
+// SizeBytes returns the size of the database file and its write-ahead log,
+// or of the database on the server for PostgreSQL
+func (d *DB) SizeBytes() (int64, error) {
+	if d.backend == BackendPostgres {
+		var size int64
+		err := d.conn.Raw("SELECT pg_database_size(current_database())").Scan(&size).Error
+		return size, err
+	}
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if wal, err := os.Stat(d.path + "-wal"); err == nil {
+		size += wal.Size()
+	}
+	return size, nil
 }
 
 // GetDatabaseStats returns statistics about the database
-func (d *DB) GetDatabaseStats(dbPath string, retentionDays int) (*DatabaseStats, error) {
-	stats := &DatabaseStats{RetentionDays: retentionDays}
+func (d *DB) GetDatabaseStats(retentionDays int) (*DatabaseStats, error) {
+	stats := &DatabaseStats{Backend: d.backend, RetentionDays: retentionDays, LastPrune: d.LastPrune()}
 
-	// File size
-	if fi, err := os.Stat(dbPath); err == nil {
-		stats.SizeBytes = fi.Size()
-		stats.SizeHuman = formatBytes(fi.Size())
+	if size, err := d.SizeBytes(); err == nil {
+		stats.SizeBytes = size
+		stats.SizeHuman = formatBytes(size)
 	}
 
 	// Record count
-	d.conn.Model(&MonitorRecord{}).Count(&stats.RecordCount)
+	for _, model := range []interface{}{&LatencyRecord{}, &SpeedRecord{}, &TraceRecord{}} {
+		var n int64
+		d.conn.Model(model).Count(&n)
+		stats.RecordCount += n
+	}
 
 	// Target count
-	d.conn.Model(&Target{}).Count(&stats.TargetCount)
+	d.conn.Model(&Target{}).Where("archived_at IS NULL").Count(&stats.TargetCount)
 
 	// Oldest and newest records
-	var oldest, newest MonitorRecord
-	if d.conn.Model(&MonitorRecord{}).Order("created_at ASC").First(&oldest).Error == nil {
+	var oldest, newest LatencyRecord
+	if d.conn.Order("created_at ASC").First(&oldest).Error == nil {
 		stats.OldestRecord = oldest.CreatedAt.Format(time.RFC3339)
 	}
-	if d.conn.Model(&MonitorRecord{}).Order("created_at DESC").First(&newest).Error == nil {
+	if d.conn.Order("created_at DESC").First(&newest).Error == nil {
 		stats.NewestRecord = newest.CreatedAt.Format(time.RFC3339)
 	}
+	if d.backend == BackendSQLite {
+		if mode, err := d.autoVacuumMode(); err == nil {
+			stats.AutoVacuum = autoVacuumModes[mode]
+		}
+	}
 
 	return stats, nil
 }
 
 // CleanOldRecords deletes records older than the specified number of days
 func (d *DB) CleanOldRecords(days int) (int64, error) {
-	cutoff := time.Now().AddDate(0, 0, -days)
-	result := d.conn.Where("created_at < ?", cutoff).Delete(&MonitorRecord{})
-	return result.RowsAffected, result.Error
+	return d.pruneBefore(time.Now().AddDate(0, 0, -days))
 }
 
-// VacuumDatabase runs VACUUM to reclaim space
+// VacuumDatabase runs VACUUM to reclaim space. On PostgreSQL it also
+// refreshes the planner statistics; the file shrinks only on SQLite.
 func (d *DB) VacuumDatabase() error {
+	if d.backend == BackendPostgres {
+		return d.conn.Exec("VACUUM ANALYZE").Error
+	}
 	return d.conn.Exec("VACUUM").Error
 }
 
+// SQLite auto_vacuum modes by PRAGMA value
+var autoVacuumModes = []string{"none", "full", "incremental"}
+
+func (d *DB) autoVacuumMode() (int, error) {
+	var mode int
+	err := d.conn.Raw("PRAGMA auto_vacuum").Scan(&mode).Error
+	if err == nil && (mode < 0 || mode >= len(autoVacuumModes)) {
+		err = fmt.Errorf("unknown auto_vacuum mode %d", mode)
+	}
+	return mode, err
+}
+
+// EnableIncrementalVacuum switches the database to incremental auto_vacuum.
+// Existing databases need a full VACUUM for the switch, which runs once here.
+// SQLite only: PostgreSQL servers run their own autovacuum.
+func (d *DB) EnableIncrementalVacuum() error {
+	if d.backend != BackendSQLite {
+		return fmt.Errorf("incremental auto_vacuum is not available on %s", d.backend)
+	}
+	mode, err := d.autoVacuumMode()
+	if err != nil || autoVacuumModes[mode] == "incremental" {
+		return err
+	}
+	log.Printf("Switching database to incremental auto_vacuum (one-time VACUUM)...")
+	if err := d.conn.Exec("PRAGMA auto_vacuum = INCREMENTAL").Error; err != nil {
+		return err
+	}
+	return d.VacuumDatabase()
+}
+
+// IncrementalVacuum returns the free pages left by deletes to the filesystem.
+// It is a no-op unless EnableIncrementalVacuum was called.
+func (d *DB) IncrementalVacuum() error {
+	if d.backend != BackendSQLite {
+		return nil
+	}
+	// The pragma frees one page per step, so drain it rather than Exec it
+	rows, err := d.conn.Raw("PRAGMA incremental_vacuum").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
 func formatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
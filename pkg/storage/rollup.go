@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// History resolutions. ResolutionRaw returns the raw records, the others RollupRecords.
+const (
+	ResolutionRaw  = "raw"
+	ResolutionAuto = "auto"
+	Resolution1m   = "1m"
+	Resolution1h   = "1h"
+	Resolution1d   = "1d"
+)
+
+// History kinds: which measurements a history query returns
+const (
+	HistoryLatency = "latency"
+	HistorySpeed   = "speed"
+)
+
+// rollupResolutions lists the maintained rollups, with how long each is kept
+// as a multiple of the raw data retention
+var rollupResolutions = []struct {
+	name string
+	size time.Duration
+	keep int
+}{
+	{Resolution1m, time.Minute, 2},
+	{Resolution1h, time.Hour, 12},
+	{Resolution1d, 24 * time.Hour, 60},
+}
+
+// Latency histogram: bucket i counts latencies up to histBase*histGrowth^i ms,
+// which keeps p95 estimates within one bucket width (15%)
+const (
+	histBase    = 0.1
+	histGrowth  = 1.15
+	histBuckets = 96 // Up to ~67s
+)
+
+func histBucket(ms float64) int {
+	if ms <= histBase {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(ms/histBase) / math.Log(histGrowth)))
+	return min(i, histBuckets-1)
+}
+
+func histUpper(i int) float64 {
+	return histBase * math.Pow(histGrowth, float64(i))
+}
+
+// ParseResolution validates a history resolution; empty means auto
+func ParseResolution(s string) (string, error) {
+	switch s {
+	case "":
+		return ResolutionAuto, nil
+	case ResolutionRaw, ResolutionAuto, Resolution1m, Resolution1h, Resolution1d:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid resolution %q: must be raw, 1m, 1h, 1d or auto", s)
+}
+
+// ParseHistoryKind validates a history kind; empty means latency
+func ParseHistoryKind(s string) (string, error) {
+	switch s {
+	case "":
+		return HistoryLatency, nil
+	case HistoryLatency, HistorySpeed:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid kind %q: must be latency or speed", s)
+}
+
+// autoResolution picks the coarsest resolution that still gives a detailed
+// chart for the range: at most a few thousand points
+func autoResolution(span time.Duration) string {
+	switch {
+	case span <= 6*time.Hour:
+		return ResolutionRaw
+	case span <= 2*24*time.Hour:
+		return Resolution1m
+	case span <= 60*24*time.Hour:
+		return Resolution1h
+	default:
+		return Resolution1d
+	}
+}
+
+// addLatency folds one latency sample into the rollup
+func (ru *RollupRecord) addLatency(r *LatencyRecord) {
+	one := RollupRecord{Samples: 1, LossAvg: r.PacketLoss, LossMax: r.PacketLoss}
+	if r.LatencyMs > 0 {
+		one.LatencySamples = 1
+		one.LatencyMin, one.LatencyAvg, one.LatencyMax = r.LatencyMs, r.LatencyMs, r.LatencyMs
+		one.LatencyHist = map[int]uint32{histBucket(r.LatencyMs): 1}
+	}
+	if r.HTTPStatus != 0 { // Request timing succeeded
+		one.HTTPSamples = 1
+		one.HTTPDNSMs, one.HTTPConnectMs, one.HTTPTLSMs = r.HTTPDNSMs, r.HTTPConnectMs, r.HTTPTLSMs
+		one.HTTPTTFBMs, one.HTTPTotalMs, one.HTTPTotalMax = r.HTTPTTFBMs, r.HTTPTotalMs, r.HTTPTotalMs
+	}
+	ru.merge(&one)
+}
+
+// addSpeed folds one bandwidth test into the rollup
+func (ru *RollupRecord) addSpeed(r *SpeedRecord) {
+	ru.merge(&RollupRecord{
+		SpeedSamples: 1,
+		SpeedDownAvg: r.SpeedDown, SpeedDownMax: r.SpeedDown,
+		SpeedUpAvg: r.SpeedUp, SpeedUpMax: r.SpeedUp,
+	})
+}
+
+// merge folds another rollup of the same bucket into ru
+func (ru *RollupRecord) merge(o *RollupRecord) {
+	if o.Samples > 0 {
+		ru.LossAvg = weightedAvg(ru.LossAvg, ru.Samples, o.LossAvg, o.Samples)
+		ru.LossMax = math.Max(ru.LossMax, o.LossMax)
+		ru.Samples += o.Samples
+	}
+	if o.LatencySamples > 0 {
+		if ru.LatencySamples == 0 || o.LatencyMin < ru.LatencyMin {
+			ru.LatencyMin = o.LatencyMin
+		}
+		ru.LatencyMax = math.Max(ru.LatencyMax, o.LatencyMax)
+		ru.LatencyAvg = weightedAvg(ru.LatencyAvg, ru.LatencySamples, o.LatencyAvg, o.LatencySamples)
+		ru.LatencySamples += o.LatencySamples
+		if ru.LatencyHist == nil {
+			ru.LatencyHist = make(map[int]uint32, len(o.LatencyHist))
+		}
+		for i, n := range o.LatencyHist {
+			ru.LatencyHist[i] += n
+		}
+		ru.LatencyP95 = ru.percentile(0.95)
+	}
+	if o.HTTPSamples > 0 {
+		n, on := ru.HTTPSamples, o.HTTPSamples
+		ru.HTTPDNSMs = weightedAvg(ru.HTTPDNSMs, n, o.HTTPDNSMs, on)
+		ru.HTTPConnectMs = weightedAvg(ru.HTTPConnectMs, n, o.HTTPConnectMs, on)
+		ru.HTTPTLSMs = weightedAvg(ru.HTTPTLSMs, n, o.HTTPTLSMs, on)
+		ru.HTTPTTFBMs = weightedAvg(ru.HTTPTTFBMs, n, o.HTTPTTFBMs, on)
+		ru.HTTPTotalMs = weightedAvg(ru.HTTPTotalMs, n, o.HTTPTotalMs, on)
+		ru.HTTPTotalMax = math.Max(ru.HTTPTotalMax, o.HTTPTotalMax)
+		ru.HTTPSamples += on
+	}
+	if o.SpeedSamples > 0 {
+		ru.SpeedDownAvg = weightedAvg(ru.SpeedDownAvg, ru.SpeedSamples, o.SpeedDownAvg, o.SpeedSamples)
+		ru.SpeedUpAvg = weightedAvg(ru.SpeedUpAvg, ru.SpeedSamples, o.SpeedUpAvg, o.SpeedSamples)
+		ru.SpeedDownMax = math.Max(ru.SpeedDownMax, o.SpeedDownMax)
+		ru.SpeedUpMax = math.Max(ru.SpeedUpMax, o.SpeedUpMax)
+		ru.SpeedSamples += o.SpeedSamples
+	}
+}
+
+// percentile estimates a latency percentile from the histogram, clamped to
+// the exact min and max
+func (ru *RollupRecord) percentile(p float64) float64 {
+	var total uint32
+	keys := make([]int, 0, len(ru.LatencyHist))
+	for i, n := range ru.LatencyHist {
+		keys = append(keys, i)
+		total += n
+	}
+	sort.Ints(keys)
+	rank := uint32(math.Ceil(p * float64(total)))
+	var seen uint32
+	for _, i := range keys {
+		seen += ru.LatencyHist[i]
+		if seen >= rank {
+			return math.Min(math.Max(histUpper(i), ru.LatencyMin), ru.LatencyMax)
+		}
+	}
+	return ru.LatencyMax
+}
+
+func weightedAvg(a float64, na int, b float64, nb int) float64 {
+	return (a*float64(na) + b*float64(nb)) / float64(na+nb)
+}
+
+// updateRollups applies add to the bucket holding at in every resolution.
+// address is the target's current address, kept on the rollup for reference.
+func (d *DB) updateRollups(targetID uint, address string, at time.Time, add func(*RollupRecord)) error {
+	d.rollupMu.Lock() // Read-modify-write of shared buckets
+	defer d.rollupMu.Unlock()
+
+	return d.conn.Transaction(func(tx *gorm.DB) error {
+		for _, res := range rollupResolutions {
+			bucket := at.UTC().Truncate(res.size)
+			var ru RollupRecord
+			err := tx.Where("target_id = ? AND resolution = ? AND bucket = ?", targetID, res.name, bucket).
+				Limit(1).Find(&ru).Error
+			if err != nil {
+				return err
+			}
+			if ru.ID == 0 {
+				ru = RollupRecord{TargetID: targetID, Resolution: res.name, Bucket: bucket}
+			}
+			ru.Target = address
+			add(&ru)
+			if err := tx.Save(&ru).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetRollups fetches the rollups of a target at one resolution whose bucket
+// overlaps the time range, keeping only buckets with samples of the given kind
+func (d *DB) GetRollups(targetID uint, kind, resolution string, start, end time.Time) ([]RollupRecord, error) {
+	size, ok := rollupSize(resolution)
+	if !ok {
+		return nil, fmt.Errorf("no rollups at resolution %q", resolution)
+	}
+	q := d.conn.Omit("latency_hist").
+		Where("target_id = ? AND resolution = ? AND bucket BETWEEN ? AND ?", targetID, resolution, start.UTC().Truncate(size), end.UTC())
+	if kind == HistorySpeed {
+		q = q.Where("speed_samples > 0")
+	} else {
+		q = q.Where("samples > 0")
+	}
+	var rollups []RollupRecord
+	err := q.Order("bucket asc").Find(&rollups).Error
+	return rollups, err
+}
+
+// GetHistoryAt returns the latency or speed history of a target at the given
+// resolution: []LatencyRecord or []SpeedRecord for raw, []RollupRecord
+// otherwise. Auto picks by range and falls back to raw data while the range
+// holds records older than the first rollup. The resolution actually used is
+// returned.
+func (d *DB) GetHistoryAt(targetID uint, kind, resolution string, start, end time.Time) (interface{}, string, error) {
+	if resolution == ResolutionAuto {
+		resolution = autoResolution(end.Sub(start))
+		if resolution != ResolutionRaw {
+			var first RollupRecord
+			err := d.conn.Select("bucket").Where("target_id = ? AND resolution = ?", targetID, resolution).
+				Order("bucket asc").Limit(1).Find(&first).Error
+			if err != nil {
+				return nil, "", err
+			}
+			uncovered, err := d.hasRecordsBefore(targetID, kind, start, first.Bucket)
+			if err != nil {
+				return nil, "", err
+			}
+			if first.Bucket.IsZero() || uncovered {
+				resolution = ResolutionRaw // Data from before rollups existed
+			}
+		}
+	}
+	if resolution == ResolutionRaw {
+		if kind == HistorySpeed {
+			records, err := d.GetSpeedHistory(targetID, start, end)
+			return records, resolution, err
+		}
+		records, err := d.GetLatencyHistory(targetID, start, end)
+		return records, resolution, err
+	}
+	rollups, err := d.GetRollups(targetID, kind, resolution, start, end)
+	return rollups, resolution, err
+}
+
+// hasRecordsBefore reports whether the target has records of the kind from
+// start up to before, which no rollup covers
+func (d *DB) hasRecordsBefore(targetID uint, kind string, start, before time.Time) (bool, error) {
+	if !before.After(start) {
+		return false, nil
+	}
+	var model interface{} = &LatencyRecord{}
+	if kind == HistorySpeed {
+		model = &SpeedRecord{}
+	}
+	var ids []uint
+	err := d.conn.Model(model).Where("target_id = ? AND created_at >= ? AND created_at < ?", targetID, start, before).
+		Limit(1).Pluck("id", &ids).Error
+	return len(ids) > 0, err
+}
+
+func rollupSize(resolution string) (time.Duration, bool) {
+	for _, res := range rollupResolutions {
+		if res.name == resolution {
+			return res.size, true
+		}
+	}
+	return 0, false
+}
+
+// pruneRollups deletes rollups past their retention, which is a multiple of
+// the raw retention
+func (d *DB) pruneRollups(now time.Time, retentionDays int) (int64, error) {
+	var total int64
+	for _, res := range rollupResolutions {
+		cutoff := now.AddDate(0, 0, -retentionDays*res.keep).UTC()
+		n, err := d.pruneTable(&RollupRecord{}, "resolution = ? AND bucket < ?", res.name, cutoff)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// rollupBackfillBatch bounds the records read and the rollups written per
+// statement by the rollup backfill
+const rollupBackfillBatch = 1000
+
+// backfillRollups builds the rollups of the records stored before rollups
+// existed, so that long history ranges of upgraded databases are not served
+// from raw records. Each target and resolution is filled up to its oldest
+// rollup, so no record is counted twice; the records of that one bucket from
+// before the upgrade stay out of it. As migration 7, it reads and writes the
+// columns as they were then.
+func backfillRollups(tx *gorm.DB) error {
+	var targets []struct {
+		ID      uint
+		Address string
+	}
+	if err := tx.Table("targets").Select("id, address").Order("id").Find(&targets).Error; err != nil {
+		return err
+	}
+	total := 0
+	for _, t := range targets {
+		n, err := backfillTargetRollups(tx, t.ID, t.Address)
+		if err != nil {
+			return fmt.Errorf("target %d: %w", t.ID, err)
+		}
+		total += n
+	}
+	if total > 0 {
+		log.Printf("Backfilled %d rollups from stored records", total)
+	}
+	return nil
+}
+
+// backfillTargetRollups backfills the rollups of one target and returns how
+// many it wrote
+func backfillTargetRollups(tx *gorm.DB, targetID uint, address string) (int, error) {
+	// Buckets from the oldest rollup on are kept by SaveLatency and SaveSpeed
+	limits := make(map[string]time.Time, len(rollupResolutions))
+	for _, res := range rollupResolutions {
+		var first struct{ Bucket time.Time }
+		err := tx.Table("rollup_records").Select("bucket").Where("target_id = ? AND resolution = ?", targetID, res.name).
+			Order("bucket asc").Limit(1).Scan(&first).Error
+		if err != nil {
+			return 0, err
+		}
+		limits[res.name] = first.Bucket
+	}
+
+	type bucketKey struct {
+		resolution string
+		bucket     time.Time
+	}
+	rollups := make(map[bucketKey]*RollupRecord)
+	add := func(at time.Time, fn func(*RollupRecord)) {
+		for _, res := range rollupResolutions {
+			bucket := at.UTC().Truncate(res.size)
+			if limit := limits[res.name]; !limit.IsZero() && !bucket.Before(limit.UTC()) {
+				continue
+			}
+			k := bucketKey{res.name, bucket}
+			ru := rollups[k]
+			if ru == nil {
+				ru = &RollupRecord{TargetID: targetID, Target: address, Resolution: res.name, Bucket: bucket}
+				rollups[k] = ru
+			}
+			fn(ru)
+		}
+	}
+
+	var latencies []LatencyRecord
+	err := tx.Table("latency_records").
+		Select("id, created_at, latency_ms, packet_loss, http_status, http_dns_ms, http_connect_ms, http_tls_ms, http_ttfb_ms, http_total_ms").
+		Where("target_id = ?", targetID).
+		FindInBatches(&latencies, rollupBackfillBatch, func(*gorm.DB, int) error {
+			for i := range latencies {
+				r := &latencies[i]
+				add(r.CreatedAt, func(ru *RollupRecord) { ru.addLatency(r) })
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return 0, err
+	}
+	var speeds []SpeedRecord
+	err = tx.Table("speed_records").Select("id, created_at, speed_up, speed_down").
+		Where("target_id = ?", targetID).
+		FindInBatches(&speeds, rollupBackfillBatch, func(*gorm.DB, int) error {
+			for i := range speeds {
+				r := &speeds[i]
+				add(r.CreatedAt, func(ru *RollupRecord) { ru.addSpeed(r) })
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	rows := make([]map[string]interface{}, 0, len(rollups))
+	for _, ru := range rollups {
+		row, err := v7RollupRow(ru)
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, row)
+	}
+	for start := 0; start < len(rows); start += rollupBackfillBatch {
+		if err := tx.Table("rollup_records").Create(rows[start:min(start+rollupBackfillBatch, len(rows))]).Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// v7RollupRow lists the columns of a rollup as migration 7 writes them
+func v7RollupRow(ru *RollupRecord) (map[string]interface{}, error) {
+	hist, err := json.Marshal(ru.LatencyHist)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"target_id": ru.TargetID, "target": ru.Target, "resolution": ru.Resolution, "bucket": ru.Bucket,
+		"samples": ru.Samples, "latency_samples": ru.LatencySamples,
+		"latency_min": ru.LatencyMin, "latency_avg": ru.LatencyAvg, "latency_max": ru.LatencyMax, "latency_p95": ru.LatencyP95,
+		"loss_avg": ru.LossAvg, "loss_max": ru.LossMax,
+		"speed_samples": ru.SpeedSamples, "speed_down_avg": ru.SpeedDownAvg, "speed_down_max": ru.SpeedDownMax,
+		"speed_up_avg": ru.SpeedUpAvg, "speed_up_max": ru.SpeedUpMax,
+		"http_samples": ru.HTTPSamples, "http_dns_ms": ru.HTTPDNSMs, "http_connect_ms": ru.HTTPConnectMs,
+		"http_tls_ms": ru.HTTPTLSMs, "http_ttfb_ms": ru.HTTPTTFBMs, "http_total_ms": ru.HTTPTotalMs, "http_total_max": ru.HTTPTotalMax,
+		"latency_hist": string(hist),
+	}, nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RouteHop is one hop of a route path
+type RouteHop struct {
+	TTL int    `json:"ttl"`
+	IP  string `json:"ip,omitempty"` // Empty for hops that did not answer
+	ASN string `json:"asn,omitempty"`
+}
+
+// RoutePath is a distinct route to a target, identified by the fingerprint
+// of its hops. A path seen again after a reroute keeps its row.
+// (TargetID, Fingerprint) is unique, see migration 4.
+type RoutePath struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	TargetID    uint       `gorm:"not null;default:0" json:"target_id"`
+	Target      string     `gorm:"type:varchar(128);not null" json:"target"` // Address when first seen
+	Fingerprint string     `gorm:"type:varchar(64);not null" json:"fingerprint"`
+	Hops        []RouteHop `gorm:"serializer:json;type:text" json:"hops"`
+	FirstSeen   time.Time  `gorm:"not null" json:"first_seen"`
+	LastSeen    time.Time  `gorm:"index;not null" json:"last_seen"`
+	Seen        int        `gorm:"not null;default:0" json:"seen"` // Traces that took this path
+}
+
+// RouteChange records a trace that took a different path than the one before
+type RouteChange struct {
+	ID         uint        `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time   `gorm:"index;not null" json:"created_at"`
+	TargetID   uint        `gorm:"index;not null;default:0" json:"target_id"`
+	Target     string      `gorm:"type:varchar(128);not null" json:"target"` // Address at the time
+	FromPathID uint        `gorm:"not null" json:"from_path_id"`
+	ToPathID   uint        `gorm:"not null" json:"to_path_id"`
+	Diff       []HopChange `gorm:"serializer:json;type:text" json:"diff"`
+}
+
+// HopChange is a hop that differs between two paths. A zero From or To means
+// the path had no hop at that TTL.
+type HopChange struct {
+	TTL  int      `json:"ttl"`
+	From RouteHop `json:"from"`
+	To   RouteHop `json:"to"`
+}
+
+// DiffRoutes compares the hop IPs of two paths. ASNs are not compared, as
+// they depend on the trace engine, and an unanswered hop matches any hop, as
+// routers that rate-limit their answers drop probes without a reroute.
+func DiffRoutes(from, to []RouteHop) []HopChange {
+	byTTL := func(hops []RouteHop) map[int]RouteHop {
+		m := make(map[int]RouteHop, len(hops))
+		for _, h := range hops {
+			m[h.TTL] = h
+		}
+		return m
+	}
+	a, b := byTTL(from), byTTL(to)
+	maxTTL := 0
+	for _, hops := range [][]RouteHop{from, to} {
+		for _, h := range hops {
+			maxTTL = max(maxTTL, h.TTL)
+		}
+	}
+
+	var diff []HopChange
+	for ttl := 1; ttl <= maxTTL; ttl++ {
+		f, t := a[ttl], b[ttl]
+		if f.IP == t.IP || unanswered(f) || unanswered(t) {
+			continue
+		}
+		diff = append(diff, HopChange{TTL: ttl, From: f, To: t})
+	}
+	return diff
+}
+
+// unanswered reports whether a path has the hop but it did not answer
+func unanswered(h RouteHop) bool {
+	return h.TTL != 0 && h.IP == ""
+}
+
+// ObserveRoute records the path a trace of target t took at the given time.
+// If it differs from the path of the previous trace, the change is stored and
+// returned; otherwise change is nil. The first path of a target is no change.
+func (d *DB) ObserveRoute(t Target, fingerprint string, hops []RouteHop, at time.Time) (change *RouteChange, err error) {
+	err = d.conn.Transaction(func(tx *gorm.DB) error {
+		var current RoutePath
+		err := tx.Where("target_id = ?", t.ID).Order("last_seen desc").Limit(1).Find(&current).Error
+		if err != nil {
+			return err
+		}
+		if current.ID != 0 && (current.Fingerprint == fingerprint || len(DiffRoutes(current.Hops, hops)) == 0) {
+			current.LastSeen = at
+			current.Seen++
+			if current.Fingerprint != fingerprint && !slices.ContainsFunc(hops, unanswered) {
+				// The same path with every hop answered, or fingerprinted the
+				// way an earlier version did: keep this form unless taken
+				var taken int64
+				err := tx.Model(&RoutePath{}).Where("target_id = ? AND fingerprint = ?", t.ID, fingerprint).Count(&taken).Error
+				if err != nil {
+					return err
+				}
+				if taken == 0 {
+					current.Fingerprint, current.Hops = fingerprint, hops
+				}
+			}
+			return tx.Save(&current).Error
+		}
+
+		var next RoutePath
+		err = tx.Where("target_id = ? AND fingerprint = ?", t.ID, fingerprint).Limit(1).Find(&next).Error
+		if err != nil {
+			return err
+		}
+		if next.ID == 0 {
+			next = RoutePath{TargetID: t.ID, Target: t.Address, Fingerprint: fingerprint, Hops: hops, FirstSeen: at}
+		}
+		next.LastSeen = at
+		next.Seen++
+		if err := tx.Save(&next).Error; err != nil {
+			return err
+		}
+		if current.ID == 0 {
+			return nil
+		}
+
+		change = &RouteChange{
+			CreatedAt:  at,
+			TargetID:   t.ID,
+			Target:     t.Address,
+			FromPathID: current.ID,
+			ToPathID:   next.ID,
+			Diff:       DiffRoutes(current.Hops, hops),
+		}
+		return tx.Create(change).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// GetRoutePaths fetches the distinct paths to a target seen within a time
+// range, in order of first appearance
+func (d *DB) GetRoutePaths(targetID uint, start, end time.Time) ([]RoutePath, error) {
+	var paths []RoutePath
+	err := d.conn.
+		Where("target_id = ? AND last_seen >= ? AND first_seen <= ?", targetID, start, end).
+		Order("first_seen asc").
+		Find(&paths).Error
+	return paths, err
+}
+
+// GetRouteChanges fetches the route changes of a target within a time range
+func (d *DB) GetRouteChanges(targetID uint, start, end time.Time) ([]RouteChange, error) {
+	var changes []RouteChange
+	err := d.conn.
+		Where("target_id = ? AND created_at BETWEEN ? AND ?", targetID, start, end).
+		Order("created_at asc").
+		Find(&changes).Error
+	return changes, err
+}
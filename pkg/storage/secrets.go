@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/yuanweize/RouteLens/pkg/secrets"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Secret is an entry of the local secrets store, referenced from probe
+// configs as ${secret:name}. The value is encrypted with the master key when
+// one is set and never leaves the server through the API.
+type Secret struct {
+	Name      string    `gorm:"primaryKey;type:varchar(64)" json:"name"`
+	Value     string    `gorm:"type:text;not null" json:"-"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ErrSecretNotFound is returned for a name missing from the secrets store
+var ErrSecretNotFound = errors.New("not found in the secrets store")
+
+// SetSecret creates or replaces an entry of the secrets store
+func (d *DB) SetSecret(name, value string) error {
+	if err := secrets.CheckName(name); err != nil {
+		return err
+	}
+	if value == "" {
+		return errors.New("secret value is empty")
+	}
+	if d.secrets != nil {
+		var err error
+		if value, err = d.secrets.Seal(value); err != nil {
+			return fmt.Errorf("failed to encrypt secret: %w", err)
+		}
+	}
+	now := time.Now()
+	return d.conn.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).Create(&Secret{Name: name, Value: value, CreatedAt: now, UpdatedAt: now}).Error
+}
+
+// ListSecrets returns the entries of the secrets store by name, without values
+func (d *DB) ListSecrets() ([]Secret, error) {
+	var list []Secret
+	err := d.conn.Select("name", "created_at", "updated_at").Order("name asc").Find(&list).Error
+	return list, err
+}
+
+// DeleteSecret removes an entry of the secrets store
+func (d *DB) DeleteSecret(name string) error {
+	res := d.conn.Where("name = ?", name).Delete(&Secret{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSecretNotFound
+	}
+	return nil
+}
+
+// LookupSecret returns the decrypted value of an entry of the secrets store,
+// implementing secrets.Store
+func (d *DB) LookupSecret(name string) (string, error) {
+	var s Secret
+	if err := d.conn.Where("name = ?", name).Limit(1).Find(&s).Error; err != nil {
+		return "", err
+	}
+	if s.Name == "" {
+		return "", ErrSecretNotFound
+	}
+	return d.secrets.Open(s.Value)
+}
+
+// SecretUsers returns the names of the targets, archived ones included, whose
+// probe config references the given entry of the secrets store
+func (d *DB) SecretUsers(name string) ([]string, error) {
+	var targets []Target
+	if err := d.conn.Select("name", "probe_type", "probe_config").Find(&targets).Error; err != nil {
+		return nil, err
+	}
+	ref := "${" + secrets.RefSecret + ":" + name + "}"
+	var users []string
+	for _, t := range targets {
+		if slices.Contains(secrets.ConfigRefs(t.ProbeConfig, d.secretKeysOf(t.ProbeType)), ref) {
+			users = append(users, t.Name)
+		}
+	}
+	return users, nil
+}
+
+// resealStoredSecrets re-encrypts the entries of the secrets store from one
+// key to another within tx and returns the number changed
+func resealStoredSecrets(tx *gorm.DB, from, to *secrets.Box) (int, error) {
+	var list []Secret
+	if err := tx.Find(&list).Error; err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, s := range list {
+		value, err := secrets.ResealValue(from, to, s.Value)
+		if err != nil {
+			return 0, fmt.Errorf("secret %s: %w", s.Name, err)
+		}
+		if value == s.Value {
+			continue
+		}
+		if err := tx.Model(&Secret{}).Where("name = ?", s.Name).Update("value", value).Error; err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SystemSettings are the runtime settings editable from the settings page
+type SystemSettings struct {
+	RetentionDays     int `json:"retention_days"`
+	SpeedTestInterval int `json:"speed_test_interval_minutes"`
+	PingInterval      int `json:"ping_interval_seconds"`
+	TraceInterval     int `json:"trace_interval_seconds"` // 0 = trace on every ping
+}
+
+// Setting keys as persisted in the settings table
+const (
+	SettingRetentionDays     = "retention_days"
+	SettingSpeedTestInterval = "speed_test_interval_minutes"
+	SettingPingInterval      = "ping_interval_seconds"
+	SettingTraceInterval     = "trace_interval_seconds"
+)
+
+// Setting is one persisted system setting
+type Setting struct {
+	Key       string    `gorm:"primaryKey;type:varchar(64)" json:"key"`
+	Value     string    `gorm:"type:text;not null" json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SettingAudit records one change of a setting and who made it
+type SettingAudit struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index;not null" json:"created_at"`
+	Key       string    `gorm:"type:varchar(64);not null" json:"key"`
+	OldValue  string    `gorm:"type:text" json:"old_value"`
+	NewValue  string    `gorm:"type:text" json:"new_value"`
+	Actor     string    `gorm:"type:varchar(64)" json:"actor"`
+}
+
+// settingFields maps each setting key to its SystemSettings field
+var settingFields = []struct {
+	key   string
+	field func(*SystemSettings) *int
+}{
+	{SettingRetentionDays, func(s *SystemSettings) *int { return &s.RetentionDays }},
+	{SettingSpeedTestInterval, func(s *SystemSettings) *int { return &s.SpeedTestInterval }},
+	{SettingPingInterval, func(s *SystemSettings) *int { return &s.PingInterval }},
+	{SettingTraceInterval, func(s *SystemSettings) *int { return &s.TraceInterval }},
+}
+
+// GetSetting returns the raw value of a setting; ok is false if it was never set
+func (d *DB) GetSetting(key string) (value string, ok bool, err error) {
+	var s Setting
+	err = d.conn.Where("key = ?", key).Limit(1).Find(&s).Error
+	if err != nil || s.Key == "" {
+		return "", false, err
+	}
+	return s.Value, true, nil
+}
+
+// GetSettingInt returns an integer setting, or def if it is unset or malformed
+func (d *DB) GetSettingInt(key string, def int) (int, error) {
+	v, ok, err := d.GetSetting(key)
+	if err != nil || !ok {
+		return def, err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("setting %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// SetSetting stores a setting, recording the change in the audit log
+func (d *DB) SetSetting(key, value, actor string) error {
+	changed := false
+	err := d.conn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		changed, err = setSetting(tx, key, value, actor)
+		return err
+	})
+	if err == nil && changed {
+		d.notifySettings()
+	}
+	return err
+}
+
+// SetSettingInt stores an integer setting, recording the change in the audit log
+func (d *DB) SetSettingInt(key string, value int, actor string) error {
+	return d.SetSetting(key, strconv.Itoa(value), actor)
+}
+
+// setSetting upserts one setting and audits it. It reports whether the value changed.
+func setSetting(tx *gorm.DB, key, value, actor string) (bool, error) {
+	var prev Setting
+	if err := tx.Where("key = ?", key).Limit(1).Find(&prev).Error; err != nil {
+		return false, err
+	}
+	if prev.Key != "" && prev.Value == value {
+		return false, nil
+	}
+	s := Setting{Key: key, Value: value}
+	if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&s).Error; err != nil {
+		return false, err
+	}
+	audit := SettingAudit{Key: key, OldValue: prev.Value, NewValue: value, Actor: actor}
+	return true, tx.Create(&audit).Error
+}
+
+// EnsureSettings stores defaults for settings that were never saved, so a
+// fresh database starts from the configured defaults
+func (d *DB) EnsureSettings(defaults SystemSettings) error {
+	return d.conn.Transaction(func(tx *gorm.DB) error {
+		for _, f := range settingFields {
+			s := Setting{Key: f.key, Value: strconv.Itoa(*f.field(&defaults))}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&s).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetSettings returns the stored system settings. Unset keys are zero.
+func (d *DB) GetSettings() (SystemSettings, error) {
+	var rows []Setting
+	if err := d.conn.Find(&rows).Error; err != nil {
+		return SystemSettings{}, err
+	}
+	values := make(map[string]string, len(rows))
+	for _, r := range rows {
+		values[r.Key] = r.Value
+	}
+
+	var st SystemSettings
+	for _, f := range settingFields {
+		if v, ok := values[f.key]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return st, fmt.Errorf("setting %s: %w", f.key, err)
+			}
+			*f.field(&st) = n
+		}
+	}
+	return st, nil
+}
+
+// SaveSettings stores all system settings in one transaction, auditing each
+// changed key, and notifies subscribers if anything changed
+func (d *DB) SaveSettings(st SystemSettings, actor string) error {
+	changed := false
+	err := d.conn.Transaction(func(tx *gorm.DB) error {
+		for _, f := range settingFields {
+			c, err := setSetting(tx, f.key, strconv.Itoa(*f.field(&st)), actor)
+			if err != nil {
+				return err
+			}
+			changed = changed || c
+		}
+		return nil
+	})
+	if err == nil && changed {
+		d.notifySettings()
+	}
+	return err
+}
+
+// GetSettingAudit returns the most recent setting changes, newest first
+func (d *DB) GetSettingAudit(limit int) ([]SettingAudit, error) {
+	var audits []SettingAudit
+	err := d.conn.Order("created_at desc, id desc").Limit(limit).Find(&audits).Error
+	return audits, err
+}
+
+// OnSettingsChange registers fn to be called with the new settings after
+// every change. Callbacks run synchronously and must not block.
+func (d *DB) OnSettingsChange(fn func(SystemSettings)) {
+	d.settingsMu.Lock()
+	d.settingsSubs = append(d.settingsSubs, fn)
+	d.settingsMu.Unlock()
+}
+
+func (d *DB) notifySettings() {
+	st, err := d.GetSettings()
+	if err != nil {
+		log.Printf("Failed to reload settings: %v", err)
+		return
+	}
+	d.settingsMu.RLock()
+	subs := slices.Clone(d.settingsSubs)
+	d.settingsMu.RUnlock()
+	for _, fn := range subs {
+		fn(st)
+	}
+}
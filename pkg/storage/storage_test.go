@@ -0,0 +1,566 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// forEachBackend runs fn against a fresh, migrated database on every backend:
+// SQLite in a temporary directory, and PostgreSQL in a throwaway schema of
+// the database named by RS_TEST_POSTGRES_DSN (skipped when unset)
+func forEachBackend(t *testing.T, fn func(t *testing.T, db *DB)) {
+	t.Run(BackendSQLite, func(t *testing.T) {
+		db, err := NewDB(filepath.Join(t.TempDir(), "routelens.db"))
+		if err != nil {
+			t.Fatalf("open sqlite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		fn(t, db)
+	})
+	t.Run(BackendPostgres, func(t *testing.T) {
+		dsn := os.Getenv("RS_TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("RS_TEST_POSTGRES_DSN not set")
+		}
+		fn(t, openPostgresSchema(t, dsn))
+	})
+}
+
+func openPostgresSchema(t *testing.T, dsn string) *DB {
+	admin, err := Open(dsn)
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	schema := fmt.Sprintf("routelens_test_%d", time.Now().UnixNano())
+	if err := admin.conn.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.conn.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("invalid RS_TEST_POSTGRES_DSN: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	db, err := NewDB(u.String())
+	if err != nil {
+		t.Fatalf("open postgres schema: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		version, err := db.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != LatestSchemaVersion() {
+			t.Errorf("schema version %d, want %d", version, LatestSchemaVersion())
+		}
+		if err := db.Migrate(0); err != nil {
+			t.Errorf("migrating again: %v", err)
+		}
+	})
+}
+
+// The baseline types are the tables of releases before versioned
+// migrations, which upgraded databases start from
+type baselineTarget struct {
+	ID          uint      `gorm:"primaryKey"`
+	CreatedAt   time.Time `gorm:"not null"`
+	UpdatedAt   time.Time
+	Name        string     `gorm:"type:varchar(64);not null"`
+	Address     string     `gorm:"type:varchar(128);uniqueIndex;not null"`
+	Desc        string     `gorm:"type:text"`
+	Enabled     bool       `gorm:"default:true"`
+	ProbeType   string     `gorm:"column:probe_type;type:varchar(20);default:'MODE_ICMP'"`
+	ProbeConfig string     `gorm:"column:probe_config;type:text"`
+	LastError   string     `gorm:"column:last_error;type:text"`
+	LastErrorAt *time.Time `gorm:"column:last_error_at"`
+}
+
+func (baselineTarget) TableName() string { return "targets" }
+
+type baselineUser struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"not null"`
+	Username  string    `gorm:"type:varchar(64);uniqueIndex;not null"`
+	Password  string    `gorm:"type:varchar(128);not null"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineMonitorRecord struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"index;not null"`
+	Target     string    `gorm:"index;type:varchar(128);not null"`
+	LatencyMs  float64   `gorm:"not null"`
+	PacketLoss float64   `gorm:"not null"`
+	TraceJson  []byte    `gorm:"type:text"`
+	SpeedUp    float64   `gorm:"default:0"`
+	SpeedDown  float64   `gorm:"default:0"`
+}
+
+func (baselineMonitorRecord) TableName() string { return "monitor_records" }
+
+func TestMigrateBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routelens.db")
+	old, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.conn.AutoMigrate(&baselineTarget{}, &baselineUser{}, &baselineMonitorRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+	trace := []byte(`{"target":"192.0.2.1","hops":[{"hop":1,"ip":"10.0.0.1","latency_avg_ms":1.5},{"hop":2,"ip":"*","loss":100},{"hop":3,"ip":"192.0.2.1","latency_avg_ms":9}]}`)
+	seed := []any{
+		&baselineTarget{Name: "a", Address: "192.0.2.1", Enabled: true},
+		&baselineTarget{Name: "b", Address: "example.com", Enabled: true},
+		&baselineUser{Username: "admin", Password: "hash"},
+		&baselineMonitorRecord{CreatedAt: at, Target: "192.0.2.1", LatencyMs: 10},
+		&baselineMonitorRecord{CreatedAt: at.Add(time.Minute), Target: "192.0.2.1", LatencyMs: 12, TraceJson: trace},
+		&baselineMonitorRecord{CreatedAt: at.Add(2 * time.Minute), Target: "192.0.2.1", SpeedUp: 50, SpeedDown: 90},
+		&baselineMonitorRecord{CreatedAt: at, Target: "198.51.100.9", LatencyMs: 20, PacketLoss: 25}, // Target deleted since
+		&baselineMonitorRecord{CreatedAt: at, Target: "198.51.100.9", SpeedUp: 5, SpeedDown: 5},
+	}
+	for _, row := range seed {
+		if err := old.conn.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("upgrading the baseline: %v", err)
+	}
+	defer db.Close()
+
+	if backups, _ := filepath.Glob(path + ".pre-v1-*.bak"); len(backups) != 1 {
+		t.Errorf("pre-migration backups %v, want one", backups)
+	}
+	if db.conn.Migrator().HasTable(legacyRecordTable) {
+		t.Errorf("%s was not dropped", legacyRecordTable)
+	}
+	a, err := db.GetTargetByAddress("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(model any, where string, args ...any) int64 {
+		t.Helper()
+		var n int64
+		if err := db.conn.Model(model).Where(where, args...).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, c := range []struct {
+		name  string
+		model any
+		where string
+		args  []any
+		want  int64
+	}{
+		{"users", &User{}, "1 = 1", nil, 1},
+		{"latency records", &LatencyRecord{}, "1 = 1", nil, 3},
+		{"linked latency records", &LatencyRecord{}, "target_id = ?", []any{a.ID}, 2},
+		{"orphaned latency records", &LatencyRecord{}, "target_id = 0 AND target = ?", []any{"198.51.100.9"}, 1},
+		{"speed records", &SpeedRecord{}, "1 = 1", nil, 2},
+		{"linked speed records", &SpeedRecord{}, "target_id = ?", []any{a.ID}, 1},
+		{"orphaned speed records", &SpeedRecord{}, "target_id = 0 AND target = ?", []any{"198.51.100.9"}, 1},
+		{"trace records", &TraceRecord{}, "target_id = ?", []any{a.ID}, 1},
+		{"hop records", &HopRecord{}, "target_id = ?", []any{a.ID}, 3},
+		{"silent hops", &HopRecord{}, "ip = ''", nil, 1},
+		{"orphaned rollups", &RollupRecord{}, "target_id = 0", nil, 0},
+	} {
+		if got := count(c.model, c.where, c.args...); got != c.want {
+			t.Errorf("%s: %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	if count(&RollupRecord{}, "target_id = ?", a.ID) == 0 {
+		t.Error("no rollups backfilled for the linked records")
+	}
+
+	var tr TraceRecord
+	if err := db.conn.Where("target_id = ?", a.ID).First(&tr).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n := count(&HopRecord{}, "trace_id = ?", tr.ID); n != 3 {
+		t.Errorf("%d hops linked to trace %d, want 3", n, tr.ID)
+	}
+	if !tr.CreatedAt.Equal(at.Add(time.Minute)) {
+		t.Errorf("trace created at %v, want %v", tr.CreatedAt, at.Add(time.Minute))
+	}
+}
+
+func TestTargets(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		a := &Target{Name: "a", Address: "192.0.2.1", ProbeType: ProbeModeICMP, Enabled: true, PingIntervalSec: 30, TimeoutSec: 20}
+		if err := db.CreateTarget(a); err != nil {
+			t.Fatal(err)
+		}
+		dup := &Target{Name: "dup", Address: a.Address, ProbeType: ProbeModeICMP}
+		if err := db.CreateTarget(dup); !errors.Is(err, ErrDuplicateAddress) {
+			t.Errorf("creating a duplicate address: got %v, want ErrDuplicateAddress", err)
+		}
+
+		b := &Target{Name: "b", Address: "192.0.2.2", ProbeType: ProbeModeICMP, Enabled: true}
+		if err := db.CreateTarget(b); err != nil {
+			t.Fatal(err)
+		}
+		b.Address = a.Address
+		if err := db.UpdateTarget(b); !errors.Is(err, ErrDuplicateAddress) {
+			t.Errorf("updating to a duplicate address: got %v, want ErrDuplicateAddress", err)
+		}
+
+		// Zero values reset a target to the global settings
+		db.UpdateTargetError(a.ID, "boom")
+		if err := db.UpdateTarget(&Target{ID: a.ID, Name: "a2", Address: a.Address, ProbeType: ProbeModeICMP}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.GetTargetByID(a.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "a2" || got.Enabled || got.PingIntervalSec != 0 || got.TimeoutSec != 0 {
+			t.Errorf("after update: %+v", got)
+		}
+		if got.LastError != "boom" || got.CreatedAt.IsZero() {
+			t.Errorf("update touched error state or creation time: %+v", got)
+		}
+
+		// Archiving frees the address
+		if err := db.ArchiveTarget(a.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateTarget(&Target{Name: "a3", Address: a.Address, ProbeType: ProbeModeICMP}); err != nil {
+			t.Errorf("reusing an archived address: %v", err)
+		}
+		active, err := db.GetTargets(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(active) != 2 {
+			t.Errorf("%d active targets, want 2", len(active))
+		}
+	})
+}
+
+func TestRecordsAndRollups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		tg := &Target{Name: "web", Address: "192.0.2.10", ProbeType: ProbeModeHTTPTiming}
+		if err := db.CreateTarget(tg); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().UTC().Truncate(time.Hour).Add(10 * time.Minute)
+		for i, ms := range []float64{10, 30} {
+			err := db.SaveLatency(&LatencyRecord{
+				TargetID: tg.ID, Target: tg.Address, CreatedAt: at.Add(time.Duration(i) * time.Second),
+				LatencyMs: ms, HTTPStatus: 200, HTTPTTFBMs: ms * 2, HTTPTotalMs: ms * 3,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.SaveSpeed(&SpeedRecord{TargetID: tg.ID, Target: tg.Address, CreatedAt: at, SpeedDown: 100, SpeedUp: 10}); err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := db.GetLatencyHistory(tg.ID, at.Add(-time.Minute), at.Add(time.Minute))
+		if err != nil || len(records) != 2 {
+			t.Fatalf("latency history: %d records, %v", len(records), err)
+		}
+		rollups, err := db.GetRollups(tg.ID, HistoryLatency, Resolution1h, at.Add(-time.Hour), at.Add(time.Hour))
+		if err != nil || len(rollups) != 1 {
+			t.Fatalf("hourly rollups: %d, %v", len(rollups), err)
+		}
+		ru := rollups[0]
+		if ru.Samples != 2 || ru.LatencyAvg != 20 || ru.LatencyMax != 30 || ru.SpeedSamples != 1 || ru.SpeedDownAvg != 100 {
+			t.Errorf("rollup: %+v", ru)
+		}
+		if ru.HTTPSamples != 2 || ru.HTTPTTFBMs != 40 || ru.HTTPTotalMax != 90 {
+			t.Errorf("rollup http phases: %+v", ru)
+		}
+
+		trace := &TraceRecord{TargetID: tg.ID, Target: tg.Address, CreatedAt: at,
+			TraceJson: []byte(`{"hops":[{"hop":1,"ip":"192.0.2.1"},{"hop":2,"ip":"192.0.2.10"}]}`)}
+		if err := db.SaveTrace(trace); err != nil {
+			t.Fatal(err)
+		}
+
+		other := tg.ID + 1000
+		snaps, err := db.GetTargetSnapshots([]uint{tg.ID, other})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := snaps[tg.ID]; s.Latency == nil || s.Latency.LatencyMs != 30 || !s.Jitter || s.JitterMs != 20 || s.Speed == nil ||
+			s.Speed.SpeedDown != 100 || s.HopsTrace != trace.ID || s.Hops != 2 {
+			t.Errorf("snapshot: %+v", s)
+		}
+		if s := snaps[other]; s == nil || s.Latency != nil || s.Speed != nil || s.HopsTrace != 0 {
+			t.Errorf("snapshot without records: %+v", s)
+		}
+
+		if err := db.DeleteTarget(tg.ID); err != nil {
+			t.Fatal(err)
+		}
+		records, err = db.GetLatencyHistory(tg.ID, at.Add(-time.Minute), at.Add(time.Minute))
+		if err != nil || len(records) != 0 {
+			t.Errorf("after delete: %d records, %v", len(records), err)
+		}
+	})
+}
+
+func TestBackfillRollups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		tg := &Target{Name: "old", Address: "192.0.2.30"}
+		if err := db.CreateTarget(tg); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC()
+		// Records from before rollups existed, stored without them
+		for _, age := range []time.Duration{10 * 24 * time.Hour, 3 * 24 * time.Hour} {
+			r := &LatencyRecord{TargetID: tg.ID, Target: tg.Address, CreatedAt: now.Add(-age), LatencyMs: 20}
+			if err := db.conn.Create(r).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.conn.Create(&SpeedRecord{TargetID: tg.ID, Target: tg.Address, CreatedAt: now.Add(-3 * 24 * time.Hour), SpeedDown: 50}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveLatency(&LatencyRecord{TargetID: tg.ID, Target: tg.Address, CreatedAt: now, LatencyMs: 40}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := backfillRollups(db.conn); err != nil {
+			t.Fatal(err)
+		}
+		history, resolution, err := db.GetHistoryAt(tg.ID, HistoryLatency, ResolutionAuto, now.Add(-12*24*time.Hour), now.Add(time.Minute))
+		if err != nil || resolution != Resolution1h {
+			t.Fatalf("auto history: resolution %q, %v", resolution, err)
+		}
+		samples := 0
+		for _, ru := range history.([]RollupRecord) {
+			samples += ru.Samples
+		}
+		if samples != 3 {
+			t.Errorf("hourly rollups hold %d samples, want 3", samples)
+		}
+		speeds, err := db.GetRollups(tg.ID, HistorySpeed, Resolution1d, now.Add(-12*24*time.Hour), now)
+		if err != nil || len(speeds) != 1 || speeds[0].SpeedDownAvg != 50 || speeds[0].Samples != 1 {
+			t.Errorf("daily speed rollups: %+v, %v", speeds, err)
+		}
+
+		// Running again adds nothing
+		if err := backfillRollups(db.conn); err != nil {
+			t.Fatal(err)
+		}
+		again, _, _ := db.GetHistoryAt(tg.ID, HistoryLatency, Resolution1h, now.Add(-12*24*time.Hour), now.Add(time.Minute))
+		if n := len(again.([]RollupRecord)); n != len(history.([]RollupRecord)) {
+			t.Errorf("second backfill: %d hourly rollups, want %d", n, len(history.([]RollupRecord)))
+		}
+	})
+}
+
+func TestObserveRoute(t *testing.T) {
+	hops := func(ips ...string) []RouteHop {
+		var out []RouteHop
+		for i, ip := range ips {
+			out = append(out, RouteHop{TTL: i + 1, IP: ip})
+		}
+		return out
+	}
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		tg := Target{ID: 1, Address: "192.0.2.20"}
+		at := time.Now()
+		steps := []struct {
+			fingerprint string
+			hops        []RouteHop
+			changed     bool
+		}{
+			{"a", hops("10.0.0.1", "10.0.0.2", "192.0.2.20"), false},
+			{"a*", hops("10.0.0.1", "", "192.0.2.20"), false}, // A dropped probe is no reroute
+			{"b", hops("10.0.0.1", "10.0.0.9", "192.0.2.20"), true},
+			{"a", hops("10.0.0.1", "10.0.0.2", "192.0.2.20"), true},
+		}
+		for i, st := range steps {
+			change, err := db.ObserveRoute(tg, st.fingerprint, st.hops, at.Add(time.Duration(i)*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (change != nil) != st.changed {
+				t.Errorf("step %d: changed = %v, want %v", i, change != nil, st.changed)
+			}
+			if change != nil && len(change.Diff) != 1 {
+				t.Errorf("step %d: diff %+v, want hop 2 only", i, change.Diff)
+			}
+		}
+		paths, err := db.GetRoutePaths(tg.ID, at.Add(-time.Hour), at.Add(time.Hour))
+		if err != nil || len(paths) != 2 {
+			t.Errorf("%d paths, want 2 (%v)", len(paths), err)
+		}
+	})
+}
+
+func TestSecretsStore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.SetSecret("api_token", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetSecret("api_token", "v2"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := db.LookupSecret("api_token"); err != nil || v != "v2" {
+			t.Errorf("lookup: %q, %v", v, err)
+		}
+		list, err := db.ListSecrets()
+		if err != nil || len(list) != 1 || list[0].Value != "" {
+			t.Errorf("list: %+v, %v", list, err)
+		}
+		if err := db.DeleteSecret("api_token"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteSecret("api_token"); !errors.Is(err, ErrSecretNotFound) {
+			t.Errorf("deleting again: got %v, want ErrSecretNotFound", err)
+		}
+	})
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *DB {
+		t.Helper()
+		db, err := NewDB(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	addresses := func(db *DB) []string {
+		t.Helper()
+		var got []string
+		if err := db.conn.Model(&Target{}).Order("address").Pluck("address", &got).Error; err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	src := open("src.db")
+	at := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		tg := &Target{Name: addr, Address: addr, ProbeType: ProbeModeICMP, Enabled: true}
+		if err := src.CreateTarget(tg); err != nil {
+			t.Fatal(err)
+		}
+		for i := range 3 {
+			r := &LatencyRecord{TargetID: tg.ID, Target: addr, CreatedAt: at.Add(time.Duration(i) * time.Minute), LatencyMs: float64(10 + i)}
+			if err := src.SaveLatency(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dst := open("dst.db")
+	if err := dst.CreateTarget(&Target{Name: "old", Address: "198.51.100.1", ProbeType: ProbeModeICMP}); err != nil {
+		t.Fatal(err)
+	}
+
+	var backups []string
+	for _, compress := range []bool{false, true} {
+		backup := filepath.Join(dir, BackupName(at, compress))
+		if err := src.Backup(backup, compress); err != nil {
+			t.Fatalf("backup (compress %v): %v", compress, err)
+		}
+		backups = append(backups, backup)
+		snapshot, err := dst.Restore(backup)
+		if err != nil {
+			t.Fatalf("restore (compress %v): %v", compress, err)
+		}
+		if got, want := addresses(dst), addresses(src); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("restored targets %v, want %v", got, want)
+		}
+		var want, got []LatencyRecord
+		src.conn.Order("id").Find(&want)
+		dst.conn.Order("id").Find(&got)
+		if len(got) != len(want) {
+			t.Fatalf("restored %d latency records, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].TargetID != want[i].TargetID || got[i].LatencyMs != want[i].LatencyMs || !got[i].CreatedAt.Equal(want[i].CreatedAt) {
+				t.Errorf("restored record %+v, want %+v", got[i], want[i])
+			}
+		}
+		if !fileExists(snapshot) {
+			t.Errorf("pre-restore snapshot %s missing", snapshot)
+		}
+	}
+
+	// The first snapshot holds the data the first restore replaced
+	snapshots, _ := filepath.Glob(dst.Path() + ".pre-restore-*.bak")
+	if len(snapshots) != 2 {
+		t.Fatalf("pre-restore snapshots %v, want 2", snapshots)
+	}
+	found := false
+	for _, path := range snapshots {
+		old, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(addresses(old)) == "[198.51.100.1]" {
+			found = true
+		}
+		old.Close()
+	}
+	if !found {
+		t.Error("no pre-restore snapshot holds the replaced data")
+	}
+
+	plain, err := os.ReadFile(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped, err := os.ReadFile(backups[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"text":           []byte("not a database\n"),
+		"truncated":      plain[:len(plain)/2],
+		"truncated gzip": gzipped[:len(gzipped)/2],
+	} {
+		path := filepath.Join(dir, "invalid.bak")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dst.Restore(path); !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("restoring a %s file: %v, want ErrInvalidBackup", name, err)
+		}
+	}
+	if got, want := addresses(dst), addresses(src); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("targets %v after failed restores, want %v", got, want)
+	}
+
+	for range restoreSnapshotKeep {
+		if _, err := dst.Restore(backups[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if snapshots, _ := filepath.Glob(dst.Path() + ".pre-restore-*.bak"); len(snapshots) != restoreSnapshotKeep {
+		t.Errorf("%d pre-restore snapshots kept, want %d", len(snapshots), restoreSnapshotKeep)
+	}
+}
@@ -8,6 +8,12 @@ export interface Target {
   enabled: boolean;
   probe_type: string;
   probe_config: string;
+  address_family?: 'auto' | 'v4' | 'v6';
+  // 0 = monitor default / global setting
+  timeout_sec?: number;
+  ping_interval_sec?: number;
+  trace_interval_sec?: number;
+  speed_interval_sec?: number;
   last_error?: string;
   last_error_at?: string;
 }
@@ -29,13 +35,46 @@ export const setupAdmin = (data: { username: string; password: string }) => requ
 
 export const updatePassword = (newPassword: string) => request.post('/api/v1/user/password', { new_password: newPassword });
 
+// Probe modes registered on the server, with the schema of their probe_config
+export interface ProbeConfigField {
+  key: string;
+  type: 'string' | 'int' | 'bool' | 'secret' | 'list';
+  required?: boolean;
+  default?: string | number | boolean | string[];
+  description?: string;
+}
+
+export interface ProbeType {
+  type: string;
+  label: string;
+  kind: string;
+  config: ProbeConfigField[];
+}
+
+export const getProbeTypes = () => request.get<ProbeType[]>('/api/v1/probe-types');
+
 export const getTargets = () => request.get<Target[]>('/api/v1/targets');
 
 export const saveTarget = (target: Target) => request.post<Target>('/api/v1/targets', target);
 
-export const deleteTarget = (id: number) => request.delete(`/api/v1/targets/${id}`);
+export const deleteTarget = (id: number, archive?: boolean) =>
+    request.delete(`/api/v1/targets/${id}`, { params: archive ? { archive: true } : undefined });
+
+// Secrets store: values are write-only, referenced from probe configs as ${secret:name}
+export interface SecretEntry {
+    name: string;
+    created_at: string;
+    updated_at: string;
+}
+
+export const getSecrets = () => request.get<SecretEntry[]>('/api/v1/secrets');
+
+export const saveSecret = (name: string, value: string) => request.post('/api/v1/secrets', { name, value });
+
+export const deleteSecret = (name: string, force?: boolean) =>
+    request.delete(`/api/v1/secrets/${encodeURIComponent(name)}`, { params: force ? { force: true } : undefined });
 
-export const getHistory = (params: { target: string; start?: string; end?: string }) => request.get('/api/v1/history', { params });
+export const getHistory = (params: { target: string; start?: string; end?: string; kind?: 'latency' | 'speed' }) => request.get('/api/v1/history', { params });
 
 export const getLatestTrace = (target: string, lang?: string) =>
   request.get('/api/v1/trace', { params: { target, lang } });
@@ -117,6 +156,15 @@ export const cleanDatabase = (days?: number) =>
 export const vacuumDatabase = () => 
   request.post<{ message: string }>('/api/v1/system/database/vacuum');
 
+export const backupDatabase = () =>
+  request.post<Blob>('/api/v1/system/database/backup', undefined, { responseType: 'blob', timeout: 0 });
+
+export const restoreDatabase = (file: File) => {
+  const form = new FormData();
+  form.append('file', file);
+  return request.post<{ message: string; snapshot: string }>('/api/v1/system/database/restore', form, { timeout: 0 });
+};
+
 export const getSettings = () => request.get<SystemSettings>('/api/v1/system/settings');
 
 export const saveSettings = (settings: SystemSettings) => 
@@ -97,6 +97,25 @@ const Dashboard: React.FC = () => {
     }
   );
 
+  // Speed tests are stored separately from pings
+  const { data: speedHistory = [] } = useRequest(
+    () => {
+      const end = new Date();
+      const start = new Date(end.getTime() - timeRange * 60 * 60 * 1000);
+      return getHistory({
+        target: selectedTarget,
+        start: start.toISOString(),
+        end: end.toISOString(),
+        kind: 'speed',
+      });
+    },
+    {
+      refreshDeps: [selectedTarget, timeRange],
+      ready: !!selectedTarget,
+      pollingInterval,
+    }
+  );
+
   // Re-fetch trace when language changes for localized location names
   useRequest(
     () => getLatestTrace(selectedTarget, i18n.language),
@@ -115,10 +134,10 @@ const Dashboard: React.FC = () => {
     ? history.reduce((sum: number, h: any) => sum + (h.packet_loss || h.PacketLoss || 0), 0) / history.length
     : 0;
   
-  // Find the most recent record with speed data (speed tests run less frequently than pings)
+  // Find the most recent speed test in range
   const latestSpeedRecord = useMemo(() => {
-    for (let i = history.length - 1; i >= 0; i--) {
-      const h = history[i];
+    for (let i = speedHistory.length - 1; i >= 0; i--) {
+      const h = speedHistory[i];
       const down = h.speed_down || h.SpeedDown || 0;
       const up = h.speed_up || h.SpeedUp || 0;
       if (down > 0 || up > 0) {
@@ -126,7 +145,7 @@ const Dashboard: React.FC = () => {
       }
     }
     return null;
-  }, [history]);
+  }, [speedHistory]);
 
   const lastSpeedDown = latestSpeedRecord?.down || 0;
   const lastSpeedUp = latestSpeedRecord?.up || 0;
@@ -1,11 +1,11 @@
 import React, { useEffect, useState } from 'react';
-import { Card, Form, Input, Button, Typography, Tabs, Row, Col, Descriptions, Tag, Space, Spin, Progress, Modal, message, Statistic, InputNumber, Popconfirm, Alert } from 'antd';
-import { ReloadOutlined, InfoCircleOutlined, LockOutlined, CloudDownloadOutlined, DatabaseOutlined, DeleteOutlined, ClearOutlined, SettingOutlined, GlobalOutlined } from '@ant-design/icons';
+import { Card, Form, Input, Button, Typography, Tabs, Row, Col, Descriptions, Tag, Space, Spin, Progress, Modal, message, Statistic, InputNumber, Popconfirm, Alert, Upload } from 'antd';
+import { ReloadOutlined, InfoCircleOutlined, LockOutlined, CloudDownloadOutlined, DatabaseOutlined, DeleteOutlined, ClearOutlined, SettingOutlined, GlobalOutlined, DownloadOutlined, UploadOutlined } from '@ant-design/icons';
 import { useRequest } from 'ahooks';
 import { useTranslation } from 'react-i18next';
 import { 
   updatePassword, getSystemInfo, checkUpdate, performUpdate, 
-  getDatabaseStats, cleanDatabase, vacuumDatabase, getSettings, saveSettings,
+  getDatabaseStats, cleanDatabase, vacuumDatabase, backupDatabase, restoreDatabase, getSettings, saveSettings,
   getGeoIPStatus, updateGeoIP,
   type SystemInfo, type UpdateCheckResult, type DatabaseStats, type SystemSettings, type GeoIPStatus
 } from '../api';
@@ -27,6 +27,8 @@ const Settings: React.FC = () => {
   const [loadingStats, setLoadingStats] = useState(false);
   const [cleaning, setCleaning] = useState(false);
   const [vacuuming, setVacuuming] = useState(false);
+  const [backingUp, setBackingUp] = useState(false);
+  const [restoring, setRestoring] = useState(false);
 
   // Settings state
   const [settings, setSettings] = useState<SystemSettings | null>(null);
@@ -199,6 +201,42 @@ const Settings: React.FC = () => {
     }
   };
 
+  const handleBackup = async () => {
+    setBackingUp(true);
+    try {
+      const blob = await backupDatabase();
+      const url = URL.createObjectURL(blob);
+      const a = document.createElement('a');
+      a.href = url;
+      a.download = `routelens-${new Date().toISOString().slice(0, 19).replace(/[-:T]/g, '')}.db.gz`;
+      a.click();
+      URL.revokeObjectURL(url);
+    } catch (e) {
+      message.error(t('settings.dbBackupFailed') || 'Failed to back up database');
+    } finally {
+      setBackingUp(false);
+    }
+  };
+
+  const handleRestore = (file: File) => {
+    Modal.confirm({
+      title: t('settings.confirmRestore') || 'Restore from backup?',
+      content: t('settings.confirmRestoreDesc') || 'All current data is replaced. A copy is saved next to the database file first.',
+      okButtonProps: { danger: true },
+      onOk: async () => {
+        setRestoring(true);
+        try {
+          const result = await restoreDatabase(file);
+          message.success(t('settings.dbRestoreSuccess', { snapshot: result.snapshot }) || `Database restored, previous data saved to ${result.snapshot}`);
+          fetchDatabaseStats();
+        } finally {
+          setRestoring(false);
+        }
+      },
+    });
+    return false;
+  };
+
   const handleSaveSettings = async () => {
     setSavingSettings(true);
     try {
@@ -290,6 +328,14 @@ const Settings: React.FC = () => {
                       {t('settings.optimizeDatabase') || 'Optimize (Vacuum)'}
                     </Button>
                   </Popconfirm>
+                  <Button icon={<DownloadOutlined />} loading={backingUp} onClick={handleBackup}>
+                    {t('settings.downloadBackup') || 'Download Backup'}
+                  </Button>
+                  <Upload accept=".db,.gz,.bak" showUploadList={false} beforeUpload={handleRestore}>
+                    <Button icon={<UploadOutlined />} loading={restoring} danger>
+                      {t('settings.restoreBackup') || 'Restore Backup'}
+                    </Button>
+                  </Upload>
                 </Space>
                 <Button icon={<ReloadOutlined />} onClick={fetchDatabaseStats} loading={loadingStats}>
                   {t('common.refresh') || 'Refresh'}
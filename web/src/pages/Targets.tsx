@@ -1,17 +1,20 @@
 import React, { useMemo, useState } from 'react';
-import { Button, Card, Form, Input, Modal, Select, Space, Switch, Table, Tag, Upload, message } from 'antd';
+import { Button, Card, Form, Input, InputNumber, Modal, Select, Space, Switch, Table, Tag, Upload, message } from 'antd';
 import { PlusOutlined, UploadOutlined } from '@ant-design/icons';
 import { useRequest } from 'ahooks';
 import { useTranslation } from 'react-i18next';
-import type { Target } from '../api';
-import { deleteTarget, getTargets, saveTarget } from '../api';
+import type { ProbeConfigField, Target } from '../api';
+import { deleteTarget, getProbeTypes, getTargets, saveTarget } from '../api';
 
-const probeOptions = [
-  { label: 'ICMP', value: 'MODE_ICMP' },
-  { label: 'HTTP', value: 'MODE_HTTP' },
-  { label: 'SSH', value: 'MODE_SSH' },
-  { label: 'IPERF', value: 'MODE_IPERF' },
-];
+const parseProbeConfig = (raw?: string): Record<string, unknown> => {
+  if (!raw) return {};
+  try {
+    const parsed = JSON.parse(raw);
+    return parsed && typeof parsed === 'object' && !Array.isArray(parsed) ? parsed : {};
+  } catch {
+    return {};
+  }
+};
 
 const Targets: React.FC = () => {
   const { t } = useTranslation();
@@ -20,6 +23,19 @@ const Targets: React.FC = () => {
   const [editing, setEditing] = useState<Target | null>(null);
 
   const { data = [], refresh, loading } = useRequest(getTargets);
+  // Probe modes and their config fields come from the server registry
+  const { data: probeTypes = [] } = useRequest(getProbeTypes);
+
+  const familyOptions = useMemo(() => [
+    { label: t('targets.familyAuto'), value: 'auto' },
+    { label: 'IPv4', value: 'v4' },
+    { label: 'IPv6', value: 'v6' },
+  ], [t]);
+
+  const probeOptions = useMemo(
+    () => probeTypes.map((p) => ({ label: p.label, value: p.type })),
+    [probeTypes],
+  );
 
   // Toggle target enabled/disabled status
   const handleToggleEnabled = async (record: Target, checked: boolean) => {
@@ -66,32 +82,18 @@ const Targets: React.FC = () => {
 
   const onEdit = (record: Target) => {
     setEditing(record);
-    
-    // Parse probe_config JSON to populate individual fields
-    let parsedConfig: Record<string, unknown> = {};
-    if (record.probe_config) {
-      try {
-        parsedConfig = JSON.parse(record.probe_config);
-      } catch {
-        // ignore parse error
-      }
-    }
-    
     form.setFieldsValue({
       name: record.name,
       address: record.address,
       desc: record.desc,
       enabled: record.enabled,
       probe_type: record.probe_type,
-      // HTTP fields
-      http_url: parsedConfig.url || '',
-      // SSH fields
-      ssh_user: parsedConfig.user || 'root',
-      ssh_port: parsedConfig.port || 22,
-      ssh_key_path: parsedConfig.key_path || '',
-      ssh_key_text: parsedConfig.key_text || '',
-      // iPerf fields
-      iperf_port: parsedConfig.port || 5201,
+      config: parseProbeConfig(record.probe_config),
+      address_family: record.address_family || 'auto',
+      timeout_sec: record.timeout_sec || undefined,
+      ping_interval_sec: record.ping_interval_sec || undefined,
+      trace_interval_sec: record.trace_interval_sec || undefined,
+      speed_interval_sec: record.speed_interval_sec || undefined,
     });
     setOpen(true);
   };
@@ -105,36 +107,80 @@ const Targets: React.FC = () => {
   const onCreate = () => {
     setEditing(null);
     form.resetFields();
-    form.setFieldsValue({ enabled: true, probe_type: 'MODE_ICMP' });
+    form.setFieldsValue({ enabled: true, probe_type: 'MODE_ICMP', address_family: 'auto' });
     setOpen(true);
   };
 
   const handleUpload = (file: File) => {
     const reader = new FileReader();
     reader.onload = () => {
-      form.setFieldValue('ssh_key_text', reader.result as string);
+      form.setFieldValue(['config', 'key_text'], reader.result as string);
       message.success('SSH key loaded');
     };
     reader.readAsText(file);
     return false;
   };
 
+  // Form values are merged over the stored config, so keys the form does not
+  // manage survive an edit. Modes this UI does not know keep their config as is.
   const buildProbeConfig = (values: any) => {
-    switch (values.probe_type) {
-      case 'MODE_HTTP':
-        return JSON.stringify({ url: values.http_url || '' });
-      case 'MODE_SSH':
-        return JSON.stringify({
-          user: values.ssh_user || 'root',
-          key_path: values.ssh_key_path || '',
-          key_text: values.ssh_key_text || '',
-          port: Number(values.ssh_port || 22),
-        });
-      case 'MODE_IPERF':
-        return JSON.stringify({ port: Number(values.iperf_port || 5201) });
+    const sameMode = editing && editing.probe_type === values.probe_type;
+    const desc = probeTypes.find((p) => p.type === values.probe_type);
+    if (!desc) {
+      return sameMode ? editing?.probe_config ?? '' : '';
+    }
+    const config: Record<string, unknown> = sameMode ? parseProbeConfig(editing?.probe_config) : {};
+    for (const field of desc.config) {
+      const value = values.config?.[field.key];
+      if (value === undefined || value === null || value === '' || (Array.isArray(value) && value.length === 0)) {
+        delete config[field.key];
+      } else {
+        config[field.key] = value;
+      }
+    }
+    return Object.keys(config).length > 0 ? JSON.stringify(config) : '';
+  };
+
+  const renderConfigField = (field: ProbeConfigField) => {
+    const placeholder = Array.isArray(field.default) ? field.default.join(', ')
+      : field.default !== undefined ? String(field.default) : undefined;
+    let input: React.ReactNode;
+    switch (field.type) {
+      case 'int':
+        input = <InputNumber style={{ width: '100%' }} placeholder={placeholder} />;
+        break;
+      case 'bool':
+        input = <Switch />;
+        break;
+      case 'list':
+        input = <Select mode="tags" open={false} tokenSeparators={[',', ' ']} placeholder={placeholder} />;
+        break;
+      case 'secret':
+        input = field.key === 'key_text'
+          ? <Input.TextArea rows={4} placeholder={field.description} />
+          : <Input.Password placeholder={placeholder} />;
+        break;
       default:
-        return '';
+        input = <Input placeholder={placeholder} />;
     }
+    return (
+      <React.Fragment key={field.key}>
+        <Form.Item
+          name={['config', field.key]}
+          label={field.key}
+          tooltip={field.description}
+          valuePropName={field.type === 'bool' ? 'checked' : 'value'}
+          rules={[{ required: field.required }]}
+        >
+          {input}
+        </Form.Item>
+        {field.key === 'key_text' && (
+          <Upload beforeUpload={handleUpload} showUploadList={false}>
+            <Button icon={<UploadOutlined />}>{t('targets.uploadKey')}</Button>
+          </Upload>
+        )}
+      </React.Fragment>
+    );
   };
 
   const onSubmit = async () => {
@@ -147,6 +193,11 @@ const Targets: React.FC = () => {
       enabled: values.enabled ?? true,
       probe_type: values.probe_type,
       probe_config: buildProbeConfig(values),
+      address_family: values.address_family || 'auto',
+      timeout_sec: values.timeout_sec || 0,
+      ping_interval_sec: values.ping_interval_sec || 0,
+      trace_interval_sec: values.trace_interval_sec || 0,
+      speed_interval_sec: values.speed_interval_sec || 0,
     };
     await saveTarget(payload);
     setOpen(false);
@@ -176,45 +227,26 @@ const Targets: React.FC = () => {
           </Form.Item>
           <Form.Item shouldUpdate={(prev, cur) => prev.probe_type !== cur.probe_type}>
             {({ getFieldValue }) => {
-              const mode = getFieldValue('probe_type');
-              if (mode === 'MODE_HTTP') {
-                return (
-                  <Form.Item name="http_url" label={t('targets.httpUrl')} rules={[{ required: true }]}>
-                    <Input placeholder="https://example.com/test.zip" />
-                  </Form.Item>
-                );
-              }
-              if (mode === 'MODE_SSH') {
-                return (
-                  <>
-                    <Form.Item name="ssh_user" label={t('targets.sshUser')} rules={[{ required: true }]}>
-                      <Input placeholder="root" />
-                    </Form.Item>
-                    <Form.Item name="ssh_port" label={t('targets.sshPort')}>
-                      <Input placeholder="22" />
-                    </Form.Item>
-                    <Form.Item name="ssh_key_path" label={t('targets.sshKeyPath')}>
-                      <Input placeholder="/root/.ssh/id_rsa" />
-                    </Form.Item>
-                    <Form.Item name="ssh_key_text" label={t('targets.sshKeyText')}>
-                      <Input.TextArea rows={4} placeholder="Paste private key content" />
-                    </Form.Item>
-                    <Upload beforeUpload={handleUpload} showUploadList={false}>
-                      <Button icon={<UploadOutlined />}>{t('targets.uploadKey')}</Button>
-                    </Upload>
-                  </>
-                );
-              }
-              if (mode === 'MODE_IPERF') {
-                return (
-                  <Form.Item name="iperf_port" label={t('targets.iperfPort')} rules={[{ required: true }]}>
-                    <Input placeholder="5201" />
-                  </Form.Item>
-                );
-              }
-              return null;
+              const desc = probeTypes.find((p) => p.type === getFieldValue('probe_type'));
+              if (!desc || desc.config.length === 0) return null;
+              return <>{desc.config.map(renderConfigField)}</>;
             }}
           </Form.Item>
+          <Form.Item name="address_family" label={t('targets.addressFamily')}>
+            <Select options={familyOptions} />
+          </Form.Item>
+          <Form.Item name="timeout_sec" label={t('targets.timeoutSec')}>
+            <InputNumber style={{ width: '100%' }} min={0} max={3600} placeholder={t('targets.useDefault')} />
+          </Form.Item>
+          <Form.Item name="ping_interval_sec" label={t('targets.pingIntervalSec')}>
+            <InputNumber style={{ width: '100%' }} min={0} max={86400} placeholder={t('targets.useGlobal')} />
+          </Form.Item>
+          <Form.Item name="trace_interval_sec" label={t('targets.traceIntervalSec')}>
+            <InputNumber style={{ width: '100%' }} min={0} max={86400} placeholder={t('targets.useGlobal')} />
+          </Form.Item>
+          <Form.Item name="speed_interval_sec" label={t('targets.speedIntervalSec')}>
+            <InputNumber style={{ width: '100%' }} min={0} max={86400} placeholder={t('targets.useGlobal')} />
+          </Form.Item>
           <Form.Item name="desc" label={t('targets.description')}>
             <Input.TextArea rows={3} />
           </Form.Item>